@@ -0,0 +1,312 @@
+package boltrootkeystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+// The root key store is held in a single top level bucket
+// containing three nested buckets:
+//
+//	keys: id -> created | expires | rootkey
+//	created: created | id -> empty
+//	expires: expires | id -> empty
+//
+// Times are encoded as 8-byte big-endian values (see
+// appendTime) so that byte ordering of the index entries is
+// the same as time ordering. The created index lets
+// findLatestKey walk backwards from the most recently
+// created key and stop as soon as it reaches keys that were
+// created too early; the expires index lets insertKey remove
+// expired keys without scanning the whole store.
+var (
+	keysBucket    = []byte("keys")
+	createdBucket = []byte("created")
+	expiresBucket = []byte("expires")
+)
+
+// timeLen holds the length of an encoded time.
+const timeLen = 8
+
+func (s *RootKeys) initDB() error {
+	s.initDBOnce.Do(func() {
+		s.initDBErr = s._initDB()
+	})
+	if s.initDBErr != nil {
+		return errgo.Notef(s.initDBErr, "cannot initialize database")
+	}
+	return nil
+}
+
+func (s *RootKeys) _initDB() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return errgo.Notef(err, "cannot create bucket %q", s.bucket)
+		}
+		for _, name := range [][]byte{keysBucket, createdBucket, expiresBucket} {
+			if _, err := b.CreateBucketIfNotExists(name); err != nil {
+				return errgo.Notef(err, "cannot create bucket %q", name)
+			}
+		}
+		return nil
+	})
+}
+
+// buckets holds the nested buckets used by the store within
+// a single transaction.
+type buckets struct {
+	keys    *bolt.Bucket
+	created *bolt.Bucket
+	expires *bolt.Bucket
+}
+
+func (s *RootKeys) buckets(tx *bolt.Tx) buckets {
+	b := tx.Bucket(s.bucket)
+	return buckets{
+		keys:    b.Bucket(keysBucket),
+		created: b.Bucket(createdBucket),
+		expires: b.Bucket(expiresBucket),
+	}
+}
+
+func (s *RootKeys) getKey(id []byte) (dbrootkeystore.RootKey, error) {
+	if err := s.initDB(); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	var key dbrootkeystore.RootKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := s.buckets(tx).keys.Get(id)
+		if data == nil {
+			return nil
+		}
+		var err error
+		key, err = decodeKey(id, data)
+		return errgo.Mask(err)
+	})
+	switch {
+	case err != nil:
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	case !key.IsValid():
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *RootKeys) findLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	if err := s.initDB(); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	var key dbrootkeystore.RootKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bs := s.buckets(tx)
+		min := appendTime(nil, createdAfter)
+		c := bs.created.Cursor()
+		for k, _ := c.Last(); k != nil && bytes.Compare(k[:timeLen], min) >= 0; k, _ = c.Prev() {
+			id := k[timeLen:]
+			data := bs.keys.Get(id)
+			if data == nil {
+				return errgo.Newf("root key %q in created index but not found", id)
+			}
+			k, err := decodeKey(id, data)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if k.IsValid() && !k.Expires.Before(expiresAfter) && !k.Expires.After(expiresBefore) {
+				key = k
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+func (s *RootKeys) insertKey(key dbrootkeystore.RootKey) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bs := s.buckets(tx)
+		if err := removeExpired(bs, time.Now()); err != nil {
+			return errgo.Notef(err, "cannot remove expired keys")
+		}
+		if bs.keys.Get(key.Id) != nil {
+			return errgo.WithCausef(nil, dbrootkeystore.ErrKeyExists, "duplicate root key id %q", key.Id)
+		}
+		if err := bs.keys.Put(key.Id, encodeKey(key)); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := bs.created.Put(indexKey(key.Created, key.Id), nil); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := bs.expires.Put(indexKey(key.Expires, key.Id), nil); err != nil {
+			return errgo.Mask(err)
+		}
+		return nil
+	})
+}
+
+func (s *RootKeys) deleteExpired(before time.Time) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return removeExpired(s.buckets(tx), before)
+	})
+}
+
+func (s *RootKeys) forEachKey(f func(dbrootkeystore.RootKey) error) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return s.buckets(tx).keys.ForEach(func(id, data []byte) error {
+			key, err := decodeKey(id, data)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if !key.IsValid() {
+				return nil
+			}
+			return errgo.Mask(f(key), errgo.Any)
+		})
+	})
+}
+
+func (s *RootKeys) updateKey(key dbrootkeystore.RootKey) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bs := s.buckets(tx)
+		data := bs.keys.Get(key.Id)
+		if data == nil {
+			return bakery.ErrNotFound
+		}
+		k, err := decodeKey(key.Id, data)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !k.IsValid() {
+			return bakery.ErrNotFound
+		}
+		k.RootKey = key.RootKey
+		return errgo.Mask(bs.keys.Put(key.Id, encodeKey(k)))
+	})
+}
+
+// revokeKey revokes the key with the given id by removing
+// its root key secret. The rest of the entry is left in place
+// until it expires.
+func (s *RootKeys) revokeKey(id []byte) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bs := s.buckets(tx)
+		data := bs.keys.Get(id)
+		if data == nil {
+			return bakery.ErrNotFound
+		}
+		key, err := decodeKey(id, data)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		key.RootKey = nil
+		return errgo.Mask(bs.keys.Put(id, encodeKey(key)))
+	})
+}
+
+// removeExpired removes all keys that expired before
+// the given time.
+func removeExpired(bs buckets, now time.Time) error {
+	max := appendTime(nil, now)
+	// Collect the index entries first because deleting from a
+	// bucket while iterating over it with a cursor can skip
+	// entries.
+	var expired [][]byte
+	c := bs.expires.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:timeLen], max) < 0; k, _ = c.Next() {
+		expired = append(expired, append([]byte(nil), k...))
+	}
+	for _, k := range expired {
+		id := k[timeLen:]
+		if data := bs.keys.Get(id); data != nil {
+			key, err := decodeKey(id, data)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if err := bs.created.Delete(indexKey(key.Created, id)); err != nil {
+				return errgo.Mask(err)
+			}
+			if err := bs.keys.Delete(id); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		if err := bs.expires.Delete(k); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// indexKey returns the key used for the given time and
+// root key id in the created and expires indexes.
+func indexKey(t time.Time, id []byte) []byte {
+	return append(appendTime(make([]byte, 0, timeLen+len(id)), t), id...)
+}
+
+// encodeKey returns the encoded form of the given root key
+// as stored in the keys bucket.
+func encodeKey(key dbrootkeystore.RootKey) []byte {
+	data := make([]byte, 0, 2*timeLen+len(key.RootKey))
+	data = appendTime(data, key.Created)
+	data = appendTime(data, key.Expires)
+	return append(data, key.RootKey...)
+}
+
+// decodeKey decodes a root key with the given id as
+// encoded by encodeKey. The returned key does not
+// refer to the memory in id or data, so it remains valid
+// after the transaction has finished. A revoked key
+// is returned with a nil RootKey field.
+func decodeKey(id, data []byte) (dbrootkeystore.RootKey, error) {
+	if len(data) < 2*timeLen {
+		return dbrootkeystore.RootKey{}, errgo.Newf("root key %q has invalid encoding", id)
+	}
+	key := dbrootkeystore.RootKey{
+		Id:      append([]byte(nil), id...),
+		Created: decodeTime(data[:timeLen]),
+		Expires: decodeTime(data[timeLen : 2*timeLen]),
+	}
+	if len(data) > 2*timeLen {
+		key.RootKey = append([]byte(nil), data[2*timeLen:]...)
+	}
+	return key, nil
+}
+
+// appendTime appends the encoded form of t to buf. The
+// encoding holds the time as nanoseconds since the Unix
+// epoch with the sign bit flipped so that times before the
+// epoch sort before times after it.
+func appendTime(buf []byte, t time.Time) []byte {
+	var b [timeLen]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano())^(1<<63))
+	return append(buf, b[:]...)
+}
+
+// decodeTime decodes a time encoded by appendTime.
+func decodeTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)^(1<<63)))
+}
@@ -0,0 +1,48 @@
+package boltrootkeystore
+
+import (
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+var (
+	Clock      = &clock
+	NewBacking = &newBacking
+)
+
+func Backing(keys *RootKeys) dbrootkeystore.Backing {
+	return backing{keys}
+}
+
+// RemoveAll removes all the root keys from the database.
+func RemoveAll(keys *RootKeys) error {
+	if err := keys.initDB(); err != nil {
+		return err
+	}
+	return keys.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keys.bucket)
+		for _, name := range [][]byte{keysBucket, createdBucket, expiresBucket} {
+			if err := b.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := b.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NumKeys returns the number of root keys in the database.
+func NumKeys(keys *RootKeys) (int, error) {
+	if err := keys.initDB(); err != nil {
+		return 0, err
+	}
+	var n int
+	err := keys.db.View(func(tx *bolt.Tx) error {
+		n = keys.buckets(tx).keys.Stats().KeyN
+		return nil
+	})
+	return n, err
+}
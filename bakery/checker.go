@@ -91,6 +91,14 @@ type AuthInfo struct {
 	// OpIndexes holds the index of each macaroon
 	// that was used to authorize an operation.
 	OpIndexes map[Op]int
+
+	// MacaroonIds holds information from the id of each element
+	// of Macaroons, such as when and by whom it was issued.
+	// An entry is nil if the macaroon was not valid or if the
+	// MacaroonVerifier does not implement MacaroonIdInfoVerifier.
+	// Note that the information is held for all valid macaroons,
+	// not only those that were used.
+	MacaroonIds []*MacaroonIdInfo
 }
 
 // Conditions returns the first party caveat caveat conditions hat apply to
@@ -154,6 +162,9 @@ type AuthChecker struct {
 	// conditions holds the first party caveat conditions
 	// that apply to each of the above macaroons.
 	conditions [][]string
+	// ids holds the information from the id of each
+	// of the above macaroons, if available.
+	ids        []*MacaroonIdInfo
 	initOnce   sync.Once
 	initError  error
 	initErrors []error
@@ -172,8 +183,22 @@ func (a *AuthChecker) init(ctx context.Context) error {
 func (a *AuthChecker) initOnceFunc(ctx context.Context) error {
 	a.authIndexes = make(map[Op][]int)
 	a.conditions = make([][]string, len(a.macaroons))
+	a.ids = make([]*MacaroonIdInfo, len(a.macaroons))
+	idVerifier, _ := a.p.MacaroonVerifier.(MacaroonIdInfoVerifier)
 	for i, ms := range a.macaroons {
-		ops, conditions, err := a.p.MacaroonVerifier.VerifyMacaroon(ctx, ms)
+		var ops []Op
+		var conditions []string
+		var err error
+		if idVerifier != nil {
+			var info *MacaroonIdInfo
+			info, conditions, err = idVerifier.VerifyMacaroonIdInfo(ctx, ms)
+			if err == nil {
+				ops = info.Ops
+				a.ids[i] = info
+			}
+		} else {
+			ops, conditions, err = a.p.MacaroonVerifier.VerifyMacaroon(ctx, ms)
+		}
 		if err != nil {
 			if !isVerificationError(err) {
 				return errgo.Notef(err, "cannot retrieve macaroon")
@@ -217,9 +242,10 @@ func (a *AuthChecker) Allowed(ctx context.Context) (*AuthInfo, error) {
 
 func (a *allowContext) newAuthInfo() *AuthInfo {
 	info := &AuthInfo{
-		Macaroons: a.checker.macaroons,
-		Used:      make([]bool, len(a.checker.macaroons)),
-		OpIndexes: a.opIndexes,
+		Macaroons:   a.checker.macaroons,
+		Used:        make([]bool, len(a.checker.macaroons)),
+		OpIndexes:   a.opIndexes,
+		MacaroonIds: a.checker.ids,
 	}
 	for i, status := range a.status {
 		if status&statusUsed != 0 {
@@ -2,11 +2,17 @@ package bakery
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"io"
 
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/box"
 	"gopkg.in/errgo.v1"
 
@@ -30,6 +36,8 @@ type caveatJSON struct {
 // and root key. The thirdPartyInfo key holds information about the
 // third party we're encrypting the caveat for; the key is the
 // public/private key pair of the party that's adding the caveat.
+// The location holds the location of the third party; it is
+// only recorded from version 4.
 //
 // The caveat will be encoded according to the version information
 // found in thirdPartyInfo.
@@ -39,15 +47,18 @@ func encodeCaveat(
 	thirdPartyInfo ThirdPartyInfo,
 	key *KeyPair,
 	ns *checkers.Namespace,
+	location string,
 ) ([]byte, error) {
 	switch thirdPartyInfo.Version {
 	case Version0, Version1:
 		return encodeCaveatV1(condition, rootKey, &thirdPartyInfo.PublicKey, key)
 	case Version2:
 		return encodeCaveatV2(condition, rootKey, &thirdPartyInfo.PublicKey, key)
-	default:
-		// Version 3 or later - use V3.
+	case Version3:
 		return encodeCaveatV3(condition, rootKey, &thirdPartyInfo.PublicKey, key, ns)
+	default:
+		// Version 4 or later - use V4.
+		return encodeCaveatV4(condition, rootKey, &thirdPartyInfo.PublicKey, key, ns, location)
 	}
 }
 
@@ -182,15 +193,15 @@ func encodeCaveatV2V3(
 	return box.Seal(data, secret, &nonce, thirdPartyPubKey.boxKey(), key.Private.boxKey()), nil
 }
 
-// encodeSecretPartV2V3 creates a version 2 or version 3 secret part of the third party
+// encodeSecretPartV2V3 creates a version 2 or later secret part of the third party
 // caveat. The returned data is not encrypted.
 //
 // The format has the following packed binary fields:
-// version 2 or 3 [1 byte]
+// version 2, 3 or 4 [1 byte]
 // root key length [n: uvarint]
 // root key [n bytes]
-// namespace length [n: uvarint] (v3 only)
-// namespace [n bytes] (v3 only)
+// namespace length [n: uvarint] (v3 and later)
+// namespace [n bytes] (v3 and later)
 // predicate [rest of message]
 func encodeSecretPartV2V3(version Version, condition string, rootKey, nsData []byte) []byte {
 	data := make([]byte, 0, 1+binary.MaxVarintLen64+len(rootKey)+len(condition))
@@ -206,24 +217,26 @@ func encodeSecretPartV2V3(version Version, condition string, rootKey, nsData []b
 }
 
 // decodeCaveat attempts to decode caveat by decrypting the encrypted part
-// using key.
-func decodeCaveat(key *KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
+// using whichever of the given keys the caveat was encrypted for.
+func decodeCaveat(keys []*KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
 	if len(caveat) == 0 {
 		return nil, errgo.New("empty third party caveat")
 	}
 	switch caveat[0] {
 	case byte(Version2):
-		return decodeCaveatV2V3(Version2, key, caveat)
+		return decodeCaveatV2V3(Version2, keys, caveat)
 	case byte(Version3):
 		if len(caveat) < version3CaveatMinLen {
 			// If it has the version 3 caveat tag and it's too short, it's
 			// almost certainly an id, not an encrypted payload.
 			return nil, errgo.Newf("caveat id payload not provided for caveat id %q", caveat)
 		}
-		return decodeCaveatV2V3(Version3, key, caveat)
+		return decodeCaveatV2V3(Version3, keys, caveat)
+	case byte(Version4):
+		return decodeCaveatV4(keys, caveat)
 	case 'e':
 		// 'e' will be the first byte if the caveatid is a base64 encoded JSON object.
-		return decodeCaveatV1(key, caveat)
+		return decodeCaveatV1(keys, caveat)
 	default:
 		return nil, errgo.Newf("caveat has unsupported version %d", caveat[0])
 	}
@@ -231,7 +244,7 @@ func decodeCaveat(key *KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
 
 // decodeCaveatV1 attempts to decode a base64 encoded JSON id. This
 // encoding is nominally version -1.
-func decodeCaveatV1(key *KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
+func decodeCaveatV1(keys []*KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
 	data := make([]byte, (3*len(caveat)+3)/4)
 	n, err := base64.StdEncoding.Decode(data, caveat)
 	if err != nil {
@@ -242,9 +255,16 @@ func decodeCaveatV1(key *KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error)
 	if err := json.Unmarshal(data, &wrapper); err != nil {
 		return nil, errgo.Notef(err, "cannot unmarshal caveat %q", data)
 	}
-	if !bytes.Equal(key.Public.Key[:], wrapper.ThirdPartyPublicKey.Key[:]) {
+	if wrapper.ThirdPartyPublicKey == nil {
+		return nil, errgo.New("public key mismatch")
+	}
+	candidates := matchingKeys(keys, func(pub *PublicKey) bool {
+		return pub.Key == wrapper.ThirdPartyPublicKey.Key
+	})
+	if len(candidates) == 0 {
 		return nil, errgo.New("public key mismatch")
 	}
+	key := candidates[0]
 	if wrapper.FirstPartyPublicKey == nil {
 		return nil, errgo.New("target service public key not specified")
 	}
@@ -277,7 +297,7 @@ func decodeCaveatV1(key *KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error)
 }
 
 // decodeCaveatV2V3 decodes a version 2 or version 3 caveat.
-func decodeCaveatV2V3(version Version, key *KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
+func decodeCaveatV2V3(version Version, keys []*KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
 	origCaveat := caveat
 	if len(caveat) < 1+publicKeyPrefixLen+KeyLen+NonceLen+box.Overhead {
 		return nil, errgo.New("caveat id too short")
@@ -285,7 +305,12 @@ func decodeCaveatV2V3(version Version, key *KeyPair, caveat []byte) (*ThirdParty
 	caveat = caveat[1:] // skip version (already checked)
 
 	publicKeyPrefix, caveat := caveat[:publicKeyPrefixLen], caveat[publicKeyPrefixLen:]
-	if !bytes.Equal(key.Public.Key[:publicKeyPrefixLen], publicKeyPrefix) {
+	// More than one key may share the prefix, so try
+	// all of them.
+	candidates := matchingKeys(keys, func(pub *PublicKey) bool {
+		return bytes.Equal(pub.Key[:publicKeyPrefixLen], publicKeyPrefix)
+	})
+	if len(candidates) == 0 {
 		return nil, errgo.New("public key mismatch")
 	}
 
@@ -297,8 +322,15 @@ func decodeCaveatV2V3(version Version, key *KeyPair, caveat []byte) (*ThirdParty
 	copy(nonce[:], caveat[:NonceLen])
 	caveat = caveat[NonceLen:]
 
-	data, ok := box.Open(nil, caveat, &nonce, firstPartyPub.boxKey(), key.Private.boxKey())
-	if !ok {
+	var key *KeyPair
+	var data []byte
+	for _, k := range candidates {
+		if d, ok := box.Open(nil, caveat, &nonce, firstPartyPub.boxKey(), k.Private.boxKey()); ok {
+			key, data = k, d
+			break
+		}
+	}
+	if key == nil {
 		return nil, errgo.Newf("cannot decrypt caveat id")
 	}
 	rootKey, ns, condition, err := decodeSecretPartV2V3(version, data)
@@ -316,6 +348,8 @@ func decodeCaveatV2V3(version Version, key *KeyPair, caveat []byte) (*ThirdParty
 	}, nil
 }
 
+// decodeSecretPartV2V3 decodes a secret part created by
+// encodeSecretPartV2V3.
 func decodeSecretPartV2V3(version Version, data []byte) (rootKey []byte, ns *checkers.Namespace, condition []byte, err error) {
 	fail := func(err error) ([]byte, *checkers.Namespace, []byte, error) {
 		return nil, nil, nil, err
@@ -355,6 +389,181 @@ func decodeSecretPartV2V3(version Version, data []byte) (rootKey []byte, ns *che
 	return rootKey, ns, data, nil
 }
 
+// version4CaveatKeyInfo is used as the HKDF info parameter when
+// deriving the key used to encrypt a version 4 caveat.
+const version4CaveatKeyInfo = "macaroon-bakery v4 third party caveat"
+
+// version4HeaderLen holds the length of the fixed-length part of
+// a version 4 caveat, up to and including the salt.
+const version4HeaderLen = 1 + sha256.Size + KeyLen + sha256.Size
+
+// encodeCaveatV4 creates a version 4 third-party caveat.
+func encodeCaveatV4(
+	condition string,
+	rootKey []byte,
+	thirdPartyPubKey *PublicKey,
+	key *KeyPair,
+	ns *checkers.Namespace,
+	location string,
+) ([]byte, error) {
+	return encodeCaveatV4WithRand(condition, rootKey, thirdPartyPubKey, key, ns, location, rand.Reader)
+}
+
+// encodeCaveatV4WithRand creates a version 4 third-party caveat,
+// reading the salt from r.
+//
+// The format has the following packed binary fields:
+//
+// 	version 4 [1 byte]
+// 	key id of the third-party public key (see publicKeyId) [32 bytes]
+// 	first-party Curve25519 public key [32 bytes]
+// 	salt [32 bytes]
+// 	length of location [n: uvarint]
+// 	location [n bytes]
+// 	encrypted secret part [rest of message]
+//
+// The secret part has the same format as in version 3 (see
+// encodeSecretPartV2V3). It is encrypted with ChaCha20-Poly1305 using
+// a zero nonce and a key derived with HKDF-SHA256 from the Curve25519
+// shared secret of the two parties, the salt and the
+// version4CaveatKeyInfo string. The rest of the caveat is
+// authenticated as additional data, so the caveat cannot be
+// redirected to a different location or key.
+//
+// As the salt is random, each caveat is encrypted with a different
+// key, so the zero nonce is never reused.
+func encodeCaveatV4WithRand(
+	condition string,
+	rootKey []byte,
+	thirdPartyPubKey *PublicKey,
+	key *KeyPair,
+	ns *checkers.Namespace,
+	location string,
+	r io.Reader,
+) ([]byte, error) {
+	nsData, err := ns.MarshalText()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var salt [sha256.Size]byte
+	if _, err := io.ReadFull(r, salt[:]); err != nil {
+		return nil, errgo.Notef(err, "cannot generate salt")
+	}
+	keyId := publicKeyId(thirdPartyPubKey)
+	data := make([]byte, 0, version4HeaderLen+uvarintLen(uint64(len(location)))+len(location))
+	data = append(data, byte(Version4))
+	data = append(data, keyId[:]...)
+	data = append(data, key.Public.Key[:]...)
+	data = append(data, salt[:]...)
+	data = appendUvarint(data, uint64(len(location)))
+	data = append(data, location...)
+
+	aead, err := caveatAEADV4(&key.Private, thirdPartyPubKey, salt[:])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	secret := encodeSecretPartV2V3(Version4, condition, rootKey, nsData)
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(data, nonce[:], secret, data), nil
+}
+
+// decodeCaveatV4 decodes a version 4 caveat.
+func decodeCaveatV4(keys []*KeyPair, caveat []byte) (*ThirdPartyCaveatInfo, error) {
+	if len(caveat) < version4HeaderLen+1 {
+		return nil, errgo.New("caveat id too short")
+	}
+	data := caveat[1:] // skip version (already checked)
+
+	var keyId [sha256.Size]byte
+	copy(keyId[:], data)
+	data = data[sha256.Size:]
+	candidates := matchingKeys(keys, func(pub *PublicKey) bool {
+		return publicKeyId(pub) == keyId
+	})
+	if len(candidates) == 0 {
+		return nil, errgo.New("public key mismatch")
+	}
+	key := candidates[0]
+
+	var firstPartyPub PublicKey
+	copy(firstPartyPub.Key[:], data[:KeyLen])
+	data = data[KeyLen:]
+
+	salt := data[:sha256.Size]
+	data = data[sha256.Size:]
+
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(n)+l > uint64(len(data)) {
+		return nil, errgo.Newf("invalid location length")
+	}
+	location := string(data[n : uint64(n)+l])
+	data = data[uint64(n)+l:]
+	header := caveat[:len(caveat)-len(data)]
+
+	aead, err := caveatAEADV4(&key.Private, &firstPartyPub, salt)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	secret, err := aead.Open(nil, nonce[:], data, header)
+	if err != nil {
+		return nil, errgo.Newf("cannot decrypt caveat id")
+	}
+	rootKey, ns, condition, err := decodeSecretPartV2V3(Version4, secret)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid secret part")
+	}
+	return &ThirdPartyCaveatInfo{
+		Condition:           condition,
+		FirstPartyPublicKey: firstPartyPub,
+		ThirdPartyKeyPair:   *key,
+		RootKey:             rootKey,
+		Caveat:              caveat,
+		Version:             Version4,
+		Namespace:           ns,
+		Location:            location,
+	}, nil
+}
+
+// caveatAEADV4 returns the AEAD used to encrypt a version 4 caveat
+// with the given salt. The private key of one party and the public key
+// of the other are used to derive the key, so the result is the same
+// for both parties.
+func caveatAEADV4(priv *PrivateKey, pub *PublicKey, salt []byte) (cipher.AEAD, error) {
+	var shared [KeyLen]byte
+	curve25519.ScalarMult(&shared, priv.boxKey(), pub.boxKey())
+	if shared == [KeyLen]byte{} {
+		return nil, errgo.Newf("invalid public key")
+	}
+	aeadKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], salt, []byte(version4CaveatKeyInfo)), aeadKey); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := chacha20poly1305.New(aeadKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead, nil
+}
+
+// matchingKeys returns the keys whose public key
+// satisfies the given predicate.
+func matchingKeys(keys []*KeyPair, match func(pub *PublicKey) bool) []*KeyPair {
+	var matched []*KeyPair
+	for _, k := range keys {
+		if k != nil && match(&k.Public) {
+			matched = append(matched, k)
+		}
+	}
+	return matched
+}
+
+// publicKeyId returns the identifier of the given public key used
+// in version 4 caveats, the SHA-256 hash of the key.
+func publicKeyId(k *PublicKey) [sha256.Size]byte {
+	return sha256.Sum256(k.Key[:])
+}
+
 // appendUvarint appends n to data encoded as a variable-length
 // unsigned integer.
 func appendUvarint(data []byte, n uint64) []byte {
@@ -2,6 +2,7 @@ package bakery
 
 import (
 	"bytes"
+	"encoding/hex"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -22,7 +23,7 @@ func TestV1RoundTrip(t *testing.T) {
 
 	c.Assert(err, qt.IsNil)
 
-	res, err := decodeCaveat(testThirdPartyKey, cid)
+	res, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.IsNil)
 	c.Assert(res, qt.DeepEquals, &ThirdPartyCaveatInfo{
 		FirstPartyPublicKey: testFirstPartyKey.Public,
@@ -41,7 +42,7 @@ func TestV2RoundTrip(t *testing.T) {
 
 	c.Assert(err, qt.IsNil)
 
-	res, err := decodeCaveat(testThirdPartyKey, cid)
+	res, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.IsNil)
 	c.Assert(res, qt.DeepEquals, &ThirdPartyCaveatInfo{
 		FirstPartyPublicKey: testFirstPartyKey.Public,
@@ -63,7 +64,7 @@ func TestV3RoundTrip(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 	c.Logf("cid %x", cid)
 
-	res, err := decodeCaveat(testThirdPartyKey, cid)
+	res, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.IsNil)
 	c.Assert(res, qt.DeepEquals, &ThirdPartyCaveatInfo{
 		FirstPartyPublicKey: testFirstPartyKey.Public,
@@ -78,19 +79,19 @@ func TestV3RoundTrip(t *testing.T) {
 
 func TestEmptyCaveatId(t *testing.T) {
 	c := qt.New(t)
-	_, err := decodeCaveat(testThirdPartyKey, []byte{})
+	_, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, []byte{})
 	c.Assert(err, qt.ErrorMatches, "empty third party caveat")
 }
 
 func TestCaveatIdBadVersion(t *testing.T) {
 	c := qt.New(t)
-	_, err := decodeCaveat(testThirdPartyKey, []byte{1})
+	_, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, []byte{1})
 	c.Assert(err, qt.ErrorMatches, "caveat has unsupported version 1")
 }
 
 func TestV2TooShort(t *testing.T) {
 	c := qt.New(t)
-	_, err := decodeCaveat(testThirdPartyKey, []byte{2})
+	_, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, []byte{2})
 	c.Assert(err, qt.ErrorMatches, "caveat id too short")
 }
 
@@ -101,7 +102,7 @@ func TestV2BadKey(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 	cid[1] ^= 1
 
-	_, err = decodeCaveat(testThirdPartyKey, cid)
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.ErrorMatches, "public key mismatch")
 }
 
@@ -112,7 +113,7 @@ func TestV2DecryptionError(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 	cid[5] ^= 1
 
-	_, err = decodeCaveat(testThirdPartyKey, cid)
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.ErrorMatches, "cannot decrypt caveat id")
 }
 
@@ -123,7 +124,7 @@ func TestV2EmptySecretPart(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 	cid = replaceV2SecretPart(cid, []byte{})
 
-	_, err = decodeCaveat(testThirdPartyKey, cid)
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.ErrorMatches, "invalid secret part: secret part too short")
 }
 
@@ -133,7 +134,7 @@ func TestV2BadSecretPartVersion(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 	cid = replaceV2SecretPart(cid, []byte{1})
 
-	_, err = decodeCaveat(testThirdPartyKey, cid)
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.ErrorMatches, "invalid secret part: unexpected secret part version, got 1 want 2")
 }
 
@@ -142,7 +143,7 @@ func TestV2EmptyRootKey(t *testing.T) {
 	cid, err := encodeCaveatV2("is-authenticated-user", []byte{}, &testThirdPartyKey.Public, testFirstPartyKey)
 	c.Assert(err, qt.IsNil)
 
-	res, err := decodeCaveat(testThirdPartyKey, cid)
+	res, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.IsNil)
 	c.Assert(res, qt.DeepEquals, &ThirdPartyCaveatInfo{
 		FirstPartyPublicKey: testFirstPartyKey.Public,
@@ -160,7 +161,7 @@ func TestV2LongRootKey(t *testing.T) {
 	cid, err := encodeCaveatV2("is-authenticated-user", bytes.Repeat([]byte{0}, 65536), &testThirdPartyKey.Public, testFirstPartyKey)
 	c.Assert(err, qt.IsNil)
 
-	res, err := decodeCaveat(testThirdPartyKey, cid)
+	res, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
 	c.Assert(err, qt.IsNil)
 	c.Assert(res, qt.DeepEquals, &ThirdPartyCaveatInfo{
 		FirstPartyPublicKey: testFirstPartyKey.Public,
@@ -179,3 +180,133 @@ func replaceV2SecretPart(cid, replacement []byte) []byte {
 	copy(nonce[:], cid[1+publicKeyPrefixLen+KeyLen:])
 	return box.Seal(cid, replacement, &nonce, testFirstPartyKey.Public.boxKey(), testThirdPartyKey.Private.boxKey())
 }
+
+func TestV4RoundTrip(t *testing.T) {
+	c := qt.New(t)
+	ns := checkers.NewNamespace(nil)
+	ns.Register("testns", "x")
+	cid, err := encodeCaveatV4("is-authenticated-user", []byte("a random string"), &testThirdPartyKey.Public, testFirstPartyKey, ns, "https://discharger.example.com")
+	c.Assert(err, qt.IsNil)
+
+	res, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, cid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(res, qt.DeepEquals, &ThirdPartyCaveatInfo{
+		FirstPartyPublicKey: testFirstPartyKey.Public,
+		RootKey:             []byte("a random string"),
+		Condition:           []byte("is-authenticated-user"),
+		Caveat:              cid,
+		ThirdPartyKeyPair:   *testThirdPartyKey,
+		Version:             Version4,
+		Namespace:           ns,
+		Location:            "https://discharger.example.com",
+	})
+}
+
+// v4TestVector holds a version 4 caveat encoded with
+// v4TestKey(1) as the first party key, v4TestKey(0x41) as
+// the third party key and a salt of 32 0xaa bytes.
+var v4TestVector = "" +
+	// version
+	"04" +
+	// SHA-256 of third party public key
+	"bc841db8fea3efd84555a7f8eeb925033c90c9d5034b1a4c48a6c87de3c0ebde" +
+	// first party public key
+	"07a37cbc142093c8b755dc1b10e86cb426374ad16aa853ed0bdfc0b2b86d1c7c" +
+	// salt
+	"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+	// location length and location
+	"1e" + "68747470733a2f2f646973636861726765722e6578616d706c652e636f6d" +
+	// encrypted secret part
+	"679ae49533129ce2420a9c335396f2107ba8018a637c251c6126b2c9e17ea88f" +
+	"eb176025c7691bfc020c42aaef15b697d1780d634687c111836f8397808cfa"
+
+func TestV4TestVector(t *testing.T) {
+	c := qt.New(t)
+	firstPartyKey, thirdPartyKey := v4TestKey(1), v4TestKey(0x41)
+	c.Assert(firstPartyKey.Public.String(), qt.Equals, "B6N8vBQgk8i3VdwbEOhstCY3StFqqFPtC9/AsrhtHHw=")
+	c.Assert(thirdPartyKey.Public.String(), qt.Equals, "ZLEBsdC+WocEvQePmJUAH8A+jp+VIvGI3RKNmEbUhGY=")
+	ns := checkers.NewNamespace(nil)
+	ns.Register("testns", "x")
+
+	cid, err := encodeCaveatV4WithRand(
+		"is-authenticated-user",
+		[]byte("a random string"),
+		&thirdPartyKey.Public,
+		firstPartyKey,
+		ns,
+		"https://discharger.example.com",
+		bytes.NewReader(bytes.Repeat([]byte{0xaa}, 32)),
+	)
+	c.Assert(err, qt.IsNil)
+	c.Assert(hex.EncodeToString(cid), qt.Equals, v4TestVector)
+
+	cid, err = hex.DecodeString(v4TestVector)
+	c.Assert(err, qt.IsNil)
+	res, err := decodeCaveat([]*KeyPair{thirdPartyKey}, cid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(res.Condition), qt.Equals, "is-authenticated-user")
+	c.Assert(string(res.RootKey), qt.Equals, "a random string")
+	c.Assert(res.Namespace, qt.DeepEquals, ns)
+	c.Assert(res.Location, qt.Equals, "https://discharger.example.com")
+	c.Assert(res.FirstPartyPublicKey, qt.Equals, firstPartyKey.Public)
+}
+
+func TestV4BadKey(t *testing.T) {
+	c := qt.New(t)
+	cid, err := encodeCaveatV4("is-authenticated-user", []byte("a random string"), &testThirdPartyKey.Public, testFirstPartyKey, nil, "loc")
+	c.Assert(err, qt.IsNil)
+	// A key that shares the first bytes of the third party key
+	// is still rejected.
+	key := *MustGenerateKey()
+	copy(key.Public.Key[:publicKeyPrefixLen], testThirdPartyKey.Public.Key[:])
+	_, err = decodeCaveat([]*KeyPair{&key}, cid)
+	c.Assert(err, qt.ErrorMatches, "public key mismatch")
+}
+
+func TestV4TamperedCaveat(t *testing.T) {
+	c := qt.New(t)
+	cid, err := encodeCaveatV4("is-authenticated-user", []byte("a random string"), &testThirdPartyKey.Public, testFirstPartyKey, nil, "loc1")
+	c.Assert(err, qt.IsNil)
+	locationIndex := bytes.Index(cid, []byte("loc1"))
+	c.Assert(locationIndex, qt.Not(qt.Equals), -1)
+
+	// Changing the location breaks the authentication.
+	cid1 := append([]byte(nil), cid...)
+	cid1[locationIndex+3] = '2'
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid1)
+	c.Assert(err, qt.ErrorMatches, "cannot decrypt caveat id")
+
+	// As does changing the salt.
+	cid1 = append([]byte(nil), cid...)
+	cid1[1+32+KeyLen] ^= 1
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid1)
+	c.Assert(err, qt.ErrorMatches, "cannot decrypt caveat id")
+
+	// Or the encrypted part.
+	cid1 = append([]byte(nil), cid...)
+	cid1[len(cid1)-1] ^= 1
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid1)
+	c.Assert(err, qt.ErrorMatches, "cannot decrypt caveat id")
+}
+
+func TestV4TooShort(t *testing.T) {
+	c := qt.New(t)
+	_, err := decodeCaveat([]*KeyPair{testThirdPartyKey}, []byte{4, 0})
+	c.Assert(err, qt.ErrorMatches, "caveat id too short")
+
+	cid, err := encodeCaveatV4("is-authenticated-user", []byte("a random string"), &testThirdPartyKey.Public, testFirstPartyKey, nil, "loc")
+	c.Assert(err, qt.IsNil)
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid[:version4HeaderLen+1])
+	c.Assert(err, qt.ErrorMatches, "invalid location length")
+	_, err = decodeCaveat([]*KeyPair{testThirdPartyKey}, cid[:version4HeaderLen+4])
+	c.Assert(err, qt.ErrorMatches, "cannot decrypt caveat id")
+}
+
+func v4TestKey(start byte) *KeyPair {
+	var key KeyPair
+	for i := range key.Private.Key {
+		key.Private.Key[i] = start + byte(i)
+	}
+	key.Public = key.Private.Public()
+	return &key
+}
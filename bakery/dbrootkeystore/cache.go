@@ -0,0 +1,257 @@
+package dbrootkeystore
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minShardSize holds the minimum number of entries in each cache
+// shard. Caches smaller than this use a single shard, so eviction
+// from them is exactly least-recently-used.
+const minShardSize = 64
+
+// maxShards holds the maximum number of cache shards.
+const maxShards = 16
+
+// CacheStats holds statistics about the key cache in a RootKeys
+// instance.
+type CacheStats struct {
+	// Hits holds the number of lookups that were satisfied
+	// from the cache, including lookups of keys that were
+	// cached as not found.
+	Hits uint64
+
+	// Misses holds the number of lookups that required the
+	// backing store to be consulted.
+	Misses uint64
+
+	// Evictions holds the number of entries that have been
+	// evicted from the cache to make room for others.
+	Evictions uint64
+
+	// Size holds the number of entries currently in the cache.
+	Size int
+}
+
+// cacheEntry holds a cached root key. An entry holding an invalid
+// key records that the key was not found.
+type cacheEntry struct {
+	key RootKey
+
+	// fetched holds the time that the key was fetched
+	// from the backing store.
+	fetched time.Time
+}
+
+// keyCache is a least-recently-used cache of root keys. It is
+// split into shards by key id so that concurrent lookups of
+// different keys do not contend.
+type keyCache struct {
+	// The following fields are accessed atomically. They're
+	// first in the struct so that they're 64-bit aligned.
+
+	// hits, misses and evictions hold the counts
+	// reported by CacheStats.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	// seq is incremented for each fetch from the backing
+	// store and is used to order updates to the same item.
+	seq uint64
+
+	shards []*cacheShard
+}
+
+type cacheShard struct {
+	mu  sync.Mutex
+	max int
+
+	// entries maps each key id to its element in recent.
+	entries map[string]*list.Element
+
+	// recent holds the shard's items, most recently used first.
+	recent *list.List
+}
+
+// cacheItem holds an item in a cache shard. Items are never changed
+// after they've been added to a shard, so they may be read without
+// holding the shard lock.
+type cacheItem struct {
+	id string
+
+	// seq holds the sequence number that the
+	// entry was added with.
+	seq uint64
+
+	e cacheEntry
+}
+
+// newKeyCache returns a cache that holds approximately
+// the given number of entries.
+func newKeyCache(size int) *keyCache {
+	if size < 1 {
+		size = 1
+	}
+	n := size / minShardSize
+	switch {
+	case n < 1:
+		n = 1
+	case n > maxShards:
+		n = maxShards
+	}
+	c := &keyCache{
+		shards: make([]*cacheShard, n),
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			max:     (size + n - 1) / n,
+			entries: make(map[string]*list.Element),
+			recent:  list.New(),
+		}
+	}
+	return c
+}
+
+// shard returns the shard that holds the entry
+// with the given id.
+func (c *keyCache) shard(id string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	// FNV-1a hash.
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// get returns the entry for the given id and
+// reports whether it was found.
+func (c *keyCache) get(id string) (cacheEntry, bool) {
+	sh := c.shard(id)
+	sh.mu.Lock()
+	elem, ok := sh.entries[id]
+	if ok {
+		sh.recent.MoveToFront(elem)
+	}
+	sh.mu.Unlock()
+	if !ok {
+		return cacheEntry{}, false
+	}
+	return elem.Value.(*cacheItem).e, true
+}
+
+// nextSeq returns a sequence number to be passed to add. It should
+// be called before fetching the entry from the backing store.
+func (c *keyCache) nextSeq() uint64 {
+	return atomic.AddUint64(&c.seq, 1)
+}
+
+// add adds the entry for the given id, evicting the least
+// recently used entry in its shard if necessary, and reports
+// whether the entry was added. If the cache already holds an entry
+// for the id that was added with a later sequence number, the new
+// entry is discarded, so that a slow fetch cannot overwrite more
+// recent information such as a revocation.
+func (c *keyCache) add(id string, e cacheEntry, seq uint64) bool {
+	sh := c.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	item := &cacheItem{
+		id:  id,
+		seq: seq,
+		e:   e,
+	}
+	if elem, ok := sh.entries[id]; ok {
+		if elem.Value.(*cacheItem).seq > seq {
+			return false
+		}
+		elem.Value = item
+		sh.recent.MoveToFront(elem)
+		return true
+	}
+	if len(sh.entries) >= sh.max {
+		sh.evictOldest()
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	sh.entries[id] = sh.recent.PushFront(item)
+	return true
+}
+
+// expire replaces the entry e, which must have been returned by
+// get, with an entry recording that the key was not found, and
+// reports whether it did so. It returns false if the entry for the
+// id has been replaced in the meantime, so that only one caller
+// observes the key expiring.
+func (c *keyCache) expire(id string, e cacheEntry) bool {
+	sh := c.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	elem, ok := sh.entries[id]
+	if !ok {
+		return false
+	}
+	item := elem.Value.(*cacheItem)
+	if !item.e.key.IsValid() || !item.e.fetched.Equal(e.fetched) {
+		return false
+	}
+	elem.Value = &cacheItem{
+		id:  id,
+		seq: item.seq,
+		e: cacheEntry{
+			fetched: item.e.fetched,
+		},
+	}
+	return true
+}
+
+// removeIf removes all entries for which f returns true.
+func (c *keyCache) removeIf(f func(cacheEntry) bool) {
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		for id, elem := range sh.entries {
+			if f(elem.Value.(*cacheItem).e) {
+				sh.recent.Remove(elem)
+				delete(sh.entries, id)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// len returns the number of entries in the cache.
+func (c *keyCache) len() int {
+	n := 0
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		n += len(sh.entries)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// stats returns the current cache statistics.
+func (c *keyCache) stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Size:      c.len(),
+	}
+}
+
+// evictOldest removes the least recently used entry.
+// Called with sh.mu locked.
+func (sh *cacheShard) evictOldest() {
+	elem := sh.recent.Back()
+	if elem == nil {
+		return
+	}
+	sh.recent.Remove(elem)
+	delete(sh.entries, elem.Value.(*cacheItem).id)
+}
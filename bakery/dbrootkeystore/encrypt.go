@@ -0,0 +1,316 @@
+package dbrootkeystore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// wrapMagic prefixes all root key secrets that have been wrapped by an
+// EncryptedBacking. The wrapped form of a root key secret is:
+//
+//	wrapMagic | KEK version (4 bytes, big-endian) | nonce | ciphertext
+//
+// where the ciphertext is the root key secret sealed with AES-256-GCM
+// under the KEK, using the root key id as additional data so that
+// wrapped secrets cannot be moved between keys.
+const wrapMagic = "\x00rkw"
+
+// kekVersionLen holds the length of the encoded KEK version.
+const kekVersionLen = 4
+
+// KEK holds a key-encryption key used by an EncryptedBacking.
+type KEK struct {
+	// Version identifies the KEK. It is stored with each root
+	// key secret wrapped by the KEK so that the right KEK can be
+	// chosen to unwrap it. Versions must be unique.
+	Version uint32
+
+	// Key holds the 32-byte AES-256 key.
+	Key []byte
+}
+
+// EncryptionParams holds the parameters for NewEncryptedBacking.
+type EncryptionParams struct {
+	// KEKs holds the key-encryption keys. The first KEK is used
+	// to wrap new root keys; all of them can be used to unwrap
+	// existing ones. When rotating KEKs, the old KEK should be kept
+	// after the new one until RewrapKeys has been run.
+	KEKs []KEK
+
+	// AllowPlaintext specifies that root keys which were stored
+	// before encryption was enabled are returned as they are.
+	// If it is false, such keys cause an error.
+	AllowPlaintext bool
+}
+
+// EncryptedBacking is a Backing that wraps the root key secrets stored
+// in another Backing with a key-encryption key, so that the secrets are
+// not stored in plaintext in the underlying database.
+//
+// An EncryptedBacking also implements ContextBacking, ExpiryBacking,
+// RevocationBacking and WindowInsertBacking by delegating to the
+// underlying backing; ExpiryBacking and RevocationBacking methods
+// return an error if the underlying backing does not implement them,
+// and InsertKeyIfNoneInWindow falls back to InsertKey.
+type EncryptedBacking struct {
+	backing        Backing
+	cbacking       ContextBacking
+	current        *kek
+	keks           map[uint32]*kek
+	allowPlaintext bool
+}
+
+type kek struct {
+	version uint32
+	aead    cipher.AEAD
+}
+
+var _ Backing = (*EncryptedBacking)(nil)
+var _ ContextBacking = (*EncryptedBacking)(nil)
+var _ ExpiryBacking = (*EncryptedBacking)(nil)
+var _ RevocationBacking = (*EncryptedBacking)(nil)
+var _ WindowInsertBacking = (*EncryptedBacking)(nil)
+
+// NewEncryptedBacking returns a Backing that stores keys in b, wrapping
+// the root key secrets with the KEKs in p. It can be used with any
+// Backing, for example:
+//
+//	keys := postgresrootkeystore.NewRootKeys(db, "rootkeys", 1000)
+//	b, err := dbrootkeystore.NewEncryptedBacking(keys.Backing(), params)
+//	...
+//	store := dbrootkeystore.NewRootKeys(1000, nil).NewStore(b, policy)
+func NewEncryptedBacking(b Backing, p EncryptionParams) (*EncryptedBacking, error) {
+	if len(p.KEKs) == 0 {
+		return nil, errgo.Newf("no key-encryption keys provided")
+	}
+	eb := &EncryptedBacking{
+		backing:        b,
+		cbacking:       contextBacking(b),
+		keks:           make(map[uint32]*kek),
+		allowPlaintext: p.AllowPlaintext,
+	}
+	for i, k := range p.KEKs {
+		if _, ok := eb.keks[k.Version]; ok {
+			return nil, errgo.Newf("duplicate key-encryption key version %d", k.Version)
+		}
+		if len(k.Key) != 32 {
+			return nil, errgo.Newf("key-encryption key version %d has wrong length (got %d want 32)", k.Version, len(k.Key))
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		eb.keks[k.Version] = &kek{
+			version: k.Version,
+			aead:    aead,
+		}
+		if i == 0 {
+			eb.current = eb.keks[k.Version]
+		}
+	}
+	return eb, nil
+}
+
+// GetKey implements Backing.GetKey.
+func (b *EncryptedBacking) GetKey(id []byte) (RootKey, error) {
+	return b.GetKeyContext(context.Background(), id)
+}
+
+// GetKeyContext implements ContextBacking.GetKeyContext.
+func (b *EncryptedBacking) GetKeyContext(ctx context.Context, id []byte) (RootKey, error) {
+	key, err := b.cbacking.GetKeyContext(ctx, id)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err, errgo.Is(bakery.ErrNotFound))
+	}
+	return b.unwrap(key)
+}
+
+// FindLatestKey implements Backing.FindLatestKey.
+func (b *EncryptedBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error) {
+	return b.FindLatestKeyContext(context.Background(), createdAfter, expiresAfter, expiresBefore)
+}
+
+// FindLatestKeyContext implements ContextBacking.FindLatestKeyContext.
+func (b *EncryptedBacking) FindLatestKeyContext(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error) {
+	key, err := b.cbacking.FindLatestKeyContext(ctx, createdAfter, expiresAfter, expiresBefore)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err)
+	}
+	return b.unwrap(key)
+}
+
+// InsertKey implements Backing.InsertKey.
+func (b *EncryptedBacking) InsertKey(key RootKey) error {
+	return b.InsertKeyContext(context.Background(), key)
+}
+
+// InsertKeyContext implements ContextBacking.InsertKeyContext.
+func (b *EncryptedBacking) InsertKeyContext(ctx context.Context, key RootKey) error {
+	key, err := b.wrap(key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return b.cbacking.InsertKeyContext(ctx, key)
+}
+
+// InsertKeyIfNoneInWindow implements
+// WindowInsertBacking.InsertKeyIfNoneInWindow. If the underlying
+// backing does not implement WindowInsertBacking, the key is
+// inserted unconditionally.
+func (b *EncryptedBacking) InsertKeyIfNoneInWindow(ctx context.Context, key RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error) {
+	wb, ok := b.backing.(WindowInsertBacking)
+	if !ok {
+		if err := b.InsertKeyContext(ctx, key); err != nil {
+			return RootKey{}, errgo.Mask(err)
+		}
+		return key, nil
+	}
+	wrapped, err := b.wrap(key)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err)
+	}
+	got, err := wb.InsertKeyIfNoneInWindow(ctx, wrapped, createdAfter, expiresAfter, expiresBefore)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err)
+	}
+	return b.unwrap(got)
+}
+
+// DeleteExpiredKeys implements ExpiryBacking.DeleteExpiredKeys.
+func (b *EncryptedBacking) DeleteExpiredKeys(ctx context.Context, before time.Time) error {
+	eb, ok := b.backing.(ExpiryBacking)
+	if !ok {
+		return errgo.Newf("backing does not support deleting expired keys")
+	}
+	return eb.DeleteExpiredKeys(ctx, before)
+}
+
+// RevokeKey implements RevocationBacking.RevokeKey.
+func (b *EncryptedBacking) RevokeKey(ctx context.Context, id []byte) error {
+	rb, ok := b.backing.(RevocationBacking)
+	if !ok {
+		return errgo.Newf("backing does not support revoking keys")
+	}
+	return rb.RevokeKey(ctx, id)
+}
+
+// RewrapKeys wraps all the keys in the underlying backing store that
+// are not already wrapped with the current (first) KEK with that KEK,
+// including keys stored in plaintext if AllowPlaintext is set.
+// After it has completed, older KEKs can be removed from the
+// parameters. The underlying backing must implement IterBacking and
+// UpdateBacking.
+//
+// It returns the number of keys that were rewrapped.
+func (b *EncryptedBacking) RewrapKeys(ctx context.Context) (int, error) {
+	ib, ok := b.backing.(IterBacking)
+	if !ok {
+		return 0, errgo.Newf("backing does not support iterating over keys")
+	}
+	ub, ok := b.backing.(UpdateBacking)
+	if !ok {
+		return 0, errgo.Newf("backing does not support updating keys")
+	}
+	// Gather all the keys before updating any of them because
+	// the backing store may not be modified while iterating.
+	var keys []RootKey
+	if err := ib.ForEachKey(ctx, func(key RootKey) error {
+		if v, ok := wrappedVersion(key.RootKey); !ok || v != b.current.version {
+			keys = append(keys, key)
+		}
+		return nil
+	}); err != nil {
+		return 0, errgo.Notef(err, "cannot iterate over keys")
+	}
+	n := 0
+	for _, key := range keys {
+		key, err := b.unwrap(key)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		key, err = b.wrap(key)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		if err := ub.UpdateKey(ctx, key); err != nil {
+			if errgo.Cause(err) == bakery.ErrNotFound {
+				// The key has been deleted or revoked since
+				// we started.
+				continue
+			}
+			return n, errgo.Notef(err, "cannot update key %q", key.Id)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// wrap returns a copy of key with its secret wrapped with the current
+// KEK.
+func (b *EncryptedBacking) wrap(key RootKey) (RootKey, error) {
+	k := b.current
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return RootKey{}, errgo.Notef(err, "cannot generate nonce")
+	}
+	data := make([]byte, 0, len(wrapMagic)+kekVersionLen+len(nonce)+len(key.RootKey)+k.aead.Overhead())
+	data = append(data, wrapMagic...)
+	var version [kekVersionLen]byte
+	binary.BigEndian.PutUint32(version[:], k.version)
+	data = append(data, version[:]...)
+	data = append(data, nonce...)
+	key.RootKey = k.aead.Seal(data, nonce, key.RootKey, key.Id)
+	return key, nil
+}
+
+// unwrap returns a copy of key with its secret unwrapped.
+// Invalid (revoked or zero) keys are returned unchanged.
+func (b *EncryptedBacking) unwrap(key RootKey) (RootKey, error) {
+	if !key.IsValid() {
+		return key, nil
+	}
+	v, ok := wrappedVersion(key.RootKey)
+	if !ok {
+		if b.allowPlaintext {
+			return key, nil
+		}
+		return RootKey{}, errgo.Newf("root key %q is not encrypted", key.Id)
+	}
+	k := b.keks[v]
+	if k == nil {
+		return RootKey{}, errgo.Newf("root key %q encrypted with unknown key-encryption key version %d", key.Id, v)
+	}
+	data := key.RootKey[len(wrapMagic)+kekVersionLen:]
+	if len(data) < k.aead.NonceSize() {
+		return RootKey{}, errgo.Newf("root key %q has invalid encrypted secret", key.Id)
+	}
+	nonce, ciphertext := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+	secret, err := k.aead.Open(nil, nonce, ciphertext, key.Id)
+	if err != nil {
+		return RootKey{}, errgo.Newf("cannot decrypt root key %q: %v", key.Id, err)
+	}
+	key.RootKey = secret
+	return key, nil
+}
+
+// wrappedVersion returns the version of the KEK used to wrap the given
+// root key secret and reports whether the secret was wrapped.
+func wrappedVersion(secret []byte) (uint32, bool) {
+	if len(secret) < len(wrapMagic)+kekVersionLen || !bytes.HasPrefix(secret, []byte(wrapMagic)) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(secret[len(wrapMagic):]), true
+}
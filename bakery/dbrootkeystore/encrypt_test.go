@@ -0,0 +1,184 @@
+package dbrootkeystore_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+var (
+	kek1 = dbrootkeystore.KEK{
+		Version: 1,
+		Key:     bytes.Repeat([]byte{1}, 32),
+	}
+	kek2 = dbrootkeystore.KEK{
+		Version: 2,
+		Key:     bytes.Repeat([]byte{2}, 32),
+	}
+)
+
+var newEncryptedBackingErrorTests = []struct {
+	about       string
+	params      dbrootkeystore.EncryptionParams
+	expectError string
+}{{
+	about:       "no keys",
+	expectError: `no key-encryption keys provided`,
+}, {
+	about: "duplicate version",
+	params: dbrootkeystore.EncryptionParams{
+		KEKs: []dbrootkeystore.KEK{kek1, kek2, kek1},
+	},
+	expectError: `duplicate key-encryption key version 1`,
+}, {
+	about: "wrong key length",
+	params: dbrootkeystore.EncryptionParams{
+		KEKs: []dbrootkeystore.KEK{{
+			Version: 3,
+			Key:     []byte("short"),
+		}},
+	},
+	expectError: `key-encryption key version 3 has wrong length \(got 5 want 32\)`,
+}}
+
+func TestNewEncryptedBackingError(t *testing.T) {
+	c := qt.New(t)
+	for i, test := range newEncryptedBackingErrorTests {
+		c.Logf("test %d: %v", i, test.about)
+		b, err := dbrootkeystore.NewEncryptedBacking(make(memBacking), test.params)
+		c.Assert(err, qt.ErrorMatches, test.expectError)
+		c.Assert(b, qt.IsNil)
+	}
+}
+
+func TestEncryptedBacking(t *testing.T) {
+	c := qt.New(t)
+	mb := make(memBacking)
+	b := newEncryptedBacking(c, mb, false, kek1)
+	policy := dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	}
+	ctx := context.Background()
+	key, id, err := dbrootkeystore.NewRootKeys(10, nil).NewStore(b, policy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	// The secret is not stored in plaintext.
+	stored := mb[string(id)].RootKey
+	c.Assert(bytes.Contains(stored, key), qt.Equals, false)
+
+	// Another store using the same backing can get the key
+	// both by id and as the current key.
+	store := dbrootkeystore.NewRootKeys(10, nil).NewStore(b, policy)
+	key1, err := store.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key1, qt.DeepEquals, key)
+	key1, id1, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key1, qt.DeepEquals, key)
+	c.Assert(id1, qt.DeepEquals, id)
+}
+
+func TestEncryptedBackingPlaintextKey(t *testing.T) {
+	c := qt.New(t)
+	mb := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("id"),
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		RootKey: []byte("plaintext key"),
+	}})
+	_, err := newEncryptedBacking(c, mb, false, kek1).GetKey([]byte("id"))
+	c.Assert(err, qt.ErrorMatches, `root key "id" is not encrypted`)
+
+	key, err := newEncryptedBacking(c, mb, true, kek1).GetKey([]byte("id"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key.RootKey), qt.Equals, "plaintext key")
+}
+
+func TestEncryptedBackingBindsKeyId(t *testing.T) {
+	c := qt.New(t)
+	mb := make(memBacking)
+	b := newEncryptedBacking(c, mb, false, kek1)
+	for _, id := range []string{"id0", "id1"} {
+		err := b.InsertKey(dbrootkeystore.RootKey{
+			Id:      []byte(id),
+			Created: epoch,
+			Expires: epoch.Add(time.Hour),
+			RootKey: []byte("key for " + id),
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+	// Swap the wrapped secrets.
+	k0, k1 := mb["id0"], mb["id1"]
+	k0.RootKey, k1.RootKey = k1.RootKey, k0.RootKey
+	mb["id0"], mb["id1"] = k0, k1
+
+	_, err := b.GetKey([]byte("id0"))
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt root key "id0": .*`)
+}
+
+func TestEncryptedBackingRotation(t *testing.T) {
+	c := qt.New(t)
+	mb := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("plain"),
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		RootKey: []byte("plain key"),
+	}})
+	err := newEncryptedBacking(c, mb, false, kek1).InsertKey(dbrootkeystore.RootKey{
+		Id:      []byte("old"),
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		RootKey: []byte("old key"),
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	// Keys wrapped with the old KEK can be read while
+	// it's still provided.
+	b := newEncryptedBacking(c, mb, true, kek2, kek1)
+	key, err := b.GetKey([]byte("old"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key.RootKey), qt.Equals, "old key")
+
+	n, err := b.RewrapKeys(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+
+	// Running it again does nothing.
+	n, err = b.RewrapKeys(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 0)
+
+	// All keys can now be read with just the new KEK.
+	b = newEncryptedBacking(c, mb, false, kek2)
+	key, err = b.GetKey([]byte("old"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key.RootKey), qt.Equals, "old key")
+	key, err = b.GetKey([]byte("plain"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key.RootKey), qt.Equals, "plain key")
+
+	// But not with the old one.
+	_, err = newEncryptedBacking(c, mb, false, kek1).GetKey([]byte("old"))
+	c.Assert(err, qt.ErrorMatches, `root key "old" encrypted with unknown key-encryption key version 2`)
+}
+
+func TestEncryptedBackingRewrapUnsupported(t *testing.T) {
+	c := qt.New(t)
+	b := newEncryptedBacking(c, &funcBacking{Backing: make(memBacking)}, false, kek1)
+	_, err := b.RewrapKeys(context.Background())
+	c.Assert(err, qt.ErrorMatches, `backing does not support iterating over keys`)
+}
+
+func newEncryptedBacking(c *qt.C, b dbrootkeystore.Backing, allowPlaintext bool, keks ...dbrootkeystore.KEK) *dbrootkeystore.EncryptedBacking {
+	eb, err := dbrootkeystore.NewEncryptedBacking(b, dbrootkeystore.EncryptionParams{
+		KEKs:           keks,
+		AllowPlaintext: allowPlaintext,
+	})
+	c.Assert(err, qt.Equals, nil)
+	return eb
+}
@@ -0,0 +1,93 @@
+package dbrootkeystore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// DeleteExpired deletes all keys that expired before the given time
+// from the given backing store, which must implement ExpiryBacking,
+// and removes them from the cache.
+func (s *RootKeys) DeleteExpired(ctx context.Context, b Backing, before time.Time) error {
+	eb, ok := b.(ExpiryBacking)
+	if !ok {
+		return errgo.Newf("backing does not support deleting expired keys")
+	}
+	start := s.clock.Now()
+	if err := eb.DeleteExpiredKeys(ctx, before); err != nil {
+		s.observer().BackingError(ctx, "DeleteExpiredKeys", err, s.since(start))
+		return errgo.Notef(err, "cannot delete expired keys")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeExpired(before)
+	return nil
+}
+
+// removeExpired removes all keys that expired before the given
+// time from the cache. Cached negative entries are left alone.
+//
+// Called with s.mu locked.
+func (s *RootKeys) removeExpired(before time.Time) {
+	s.cache.removeIf(func(e cacheEntry) bool {
+		return e.key.IsValid() && e.key.Expires.Before(before)
+	})
+	recent := s.recent[:0]
+	for _, e := range s.recent {
+		if !e.key.Expires.Before(before) {
+			recent = append(recent, e)
+		}
+	}
+	s.recent = recent
+	for p, e := range s.current {
+		if e.key.Expires.Before(before) {
+			delete(s.current, p)
+		}
+	}
+}
+
+// StartCollector starts a goroutine that deletes expired keys from
+// the given backing store, which must implement ExpiryBacking,
+// every interval, which must be positive. Errors are logged to the
+// given logger, which may be nil.
+//
+// The returned function stops the collector and waits for it to
+// finish.
+func (s *RootKeys) StartCollector(b Backing, interval time.Duration, logger bakery.Logger) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, errgo.Newf("non-positive collection interval %v", interval)
+	}
+	if _, ok := b.(ExpiryBacking); !ok {
+		return nil, errgo.Newf("backing does not support deleting expired keys")
+	}
+	if logger == nil {
+		logger = bakery.DefaultLogger("bakery.dbrootkeystore")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if err := s.DeleteExpired(ctx, b, s.clock.Now()); err != nil && ctx.Err() == nil {
+				logger.Infof(ctx, "cannot collect expired root keys: %v", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}, nil
+}
@@ -0,0 +1,3 @@
+package dbrootkeystore
+
+var ExportScryptN = &exportScryptN
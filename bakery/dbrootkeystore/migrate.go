@@ -0,0 +1,324 @@
+package dbrootkeystore
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// CopyKeys copies all the keys in src that have not expired at the
+// given time into dst, preserving their ids, creation times and
+// expiry times, so that macaroons minted with keys in src can be
+// verified using dst. The src backing must implement IterBacking,
+// and must not refer to the same database as dst. Keys that already
+// exist in dst are left alone, so an interrupted copy can safely be
+// run again.
+//
+// Note that the root key secrets are copied as stored, so keys copied
+// from an EncryptedBacking's underlying backing will only be usable
+// through an EncryptedBacking with the same key-encryption keys.
+//
+// It returns the number of keys that were copied.
+func CopyKeys(ctx context.Context, dst, src Backing, now time.Time) (int, error) {
+	ib, ok := src.(IterBacking)
+	if !ok {
+		return 0, errgo.Newf("backing does not support iterating over keys")
+	}
+	cb := contextBacking(dst)
+	n := 0
+	err := ib.ForEachKey(ctx, func(key RootKey) error {
+		if now.After(key.Expires) {
+			return nil
+		}
+		copied, err := insertIfAbsent(ctx, cb, key)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if copied {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, errgo.Notef(err, "cannot copy keys")
+	}
+	return n, nil
+}
+
+// exportMagic holds the prefix of an export file.
+const exportMagic = "\x00bakery-rootkeys-v1\n"
+
+const (
+	// exportSaltLen holds the length of the salt used
+	// to derive the export file key from the passphrase.
+	exportSaltLen = 16
+
+	// maxExportRecordLen holds the maximum length of a single
+	// encrypted record in an export file.
+	maxExportRecordLen = 64 * 1024
+)
+
+// exportScryptN holds the scrypt cost parameter used to derive export
+// file keys. It is a variable so that it can be changed for
+// testing.
+var exportScryptN = 1 << 15
+
+// exportedKey is the form of a root key held in each record
+// of an export file.
+type exportedKey struct {
+	Id      []byte    `json:"id"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	RootKey []byte    `json:"rootkey"`
+}
+
+// ExportKeys writes all the keys in src that have not expired at the
+// given time to w, encrypted with a key derived from the given
+// passphrase. The src backing must implement IterBacking. The
+// resulting file can be read by ImportKeys.
+//
+// The file starts with a fixed header and a random salt used to
+// derive the encryption key with scrypt; it is followed by a
+// sequence of length-prefixed records, each holding one key encoded as
+// JSON and sealed with NaCl secretbox, and ends with an empty record
+// so that truncation can be detected.
+//
+// It returns the number of keys that were exported.
+func ExportKeys(ctx context.Context, w io.Writer, src Backing, now time.Time, passphrase []byte) (int, error) {
+	ib, ok := src.(IterBacking)
+	if !ok {
+		return 0, errgo.Newf("backing does not support iterating over keys")
+	}
+	var salt [exportSaltLen]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return 0, errgo.Notef(err, "cannot generate salt")
+	}
+	key, err := exportKey(passphrase, salt[:])
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(exportMagic)
+	bw.Write(salt[:])
+	ew := &exportWriter{
+		w:   bw,
+		key: key,
+	}
+	n := 0
+	err = ib.ForEachKey(ctx, func(k RootKey) error {
+		if now.After(k.Expires) {
+			return nil
+		}
+		data, err := json.Marshal(exportedKey{
+			Id:      k.Id,
+			Created: k.Created,
+			Expires: k.Expires,
+			RootKey: k.RootKey,
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := ew.writeRecord(data, false); err != nil {
+			return errgo.Mask(err)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot export keys")
+	}
+	if err := ew.writeRecord(nil, true); err != nil {
+		return 0, errgo.Notef(err, "cannot export keys")
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, errgo.Notef(err, "cannot export keys")
+	}
+	return n, nil
+}
+
+// ImportKeys reads keys written by ExportKeys from r and inserts
+// those that have not expired at the given time into dst. Keys that
+// already exist in dst are left alone.
+//
+// It returns the number of keys that were inserted.
+func ImportKeys(ctx context.Context, dst Backing, r io.Reader, now time.Time, passphrase []byte) (int, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(exportMagic)+exportSaltLen)
+	if _, err := io.ReadFull(br, hdr); err != nil || string(hdr[:len(exportMagic)]) != exportMagic {
+		return 0, errgo.Newf("not a root key export file")
+	}
+	key, err := exportKey(passphrase, hdr[len(exportMagic):])
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	er := &exportReader{
+		r:   br,
+		key: key,
+	}
+	cb := contextBacking(dst)
+	n := 0
+	for {
+		data, final, err := er.readRecord()
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		if final {
+			return n, nil
+		}
+		var k exportedKey
+		if err := json.Unmarshal(data, &k); err != nil {
+			return n, errgo.Notef(err, "invalid record in root key export file")
+		}
+		if now.After(k.Expires) {
+			continue
+		}
+		inserted, err := insertIfAbsent(ctx, cb, RootKey{
+			Id:      k.Id,
+			Created: k.Created,
+			Expires: k.Expires,
+			RootKey: k.RootKey,
+		})
+		if err != nil {
+			return n, errgo.Notef(err, "cannot import keys")
+		}
+		if inserted {
+			n++
+		}
+	}
+}
+
+// exportWriter writes encrypted records to an export file.
+type exportWriter struct {
+	w     io.Writer
+	key   *[32]byte
+	count uint64
+}
+
+// writeRecord writes the given data as a single record. If final is
+// true, the record marks the end of the file.
+func (w *exportWriter) writeRecord(data []byte, final bool) error {
+	nonce := exportNonce(w.count, final)
+	w.count++
+	sealed := secretbox.Seal(nil, data, &nonce, w.key)
+	if len(sealed) > maxExportRecordLen {
+		return errgo.Newf("record too large")
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(sealed)))
+	if _, err := w.w.Write(lenBuf[:]); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := w.w.Write(sealed); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// exportReader reads encrypted records from an export file.
+type exportReader struct {
+	r     io.Reader
+	key   *[32]byte
+	count uint64
+}
+
+// readRecord reads the next record and reports whether it was the
+// final record.
+func (r *exportReader) readRecord() (data []byte, final bool, err error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r.r, lenBuf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, errgo.Newf("root key export file is truncated")
+		}
+		return nil, false, errgo.Mask(err)
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxExportRecordLen {
+		return nil, false, errgo.Newf("invalid record in root key export file")
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, errgo.Newf("root key export file is truncated")
+		}
+		return nil, false, errgo.Mask(err)
+	}
+	// Try the nonce for a normal record first, then
+	// the nonce for the final record.
+	for _, final := range []bool{false, true} {
+		nonce := exportNonce(r.count, final)
+		if data, ok := secretbox.Open(nil, sealed, &nonce, r.key); ok {
+			r.count++
+			return data, final, nil
+		}
+	}
+	return nil, false, errgo.Newf("cannot decrypt root key export file (wrong passphrase?)")
+}
+
+// exportNonce returns the nonce used for the record with the given
+// sequence number. Records are numbered so that they cannot be
+// reordered or removed without detection.
+func exportNonce(count uint64, final bool) [24]byte {
+	var nonce [24]byte
+	binary.BigEndian.PutUint64(nonce[:], count)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// exportKey derives the export file key from the given
+// passphrase and salt.
+func exportKey(passphrase, salt []byte) (*[32]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errgo.Newf("empty passphrase")
+	}
+	k, err := scrypt.Key(passphrase, salt, exportScryptN, 8, 1, 32)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot derive key")
+	}
+	var key [32]byte
+	copy(key[:], k)
+	return &key, nil
+}
+
+// insertIfAbsent inserts the given key into b unless a key with
+// the same id already exists there, and reports whether it did so.
+// A key that has been revoked in b counts as existing, so it
+// is never brought back to life.
+func insertIfAbsent(ctx context.Context, b ContextBacking, key RootKey) (bool, error) {
+	_, err := b.GetKeyContext(ctx, key.Id)
+	if err == nil {
+		return false, nil
+	}
+	if errgo.Cause(err) != bakery.ErrNotFound {
+		return false, errgo.Notef(err, "cannot get key %q", key.Id)
+	}
+	// Some backings report revoked keys as not found, so the
+	// insert may still find the id taken.
+	err = b.InsertKeyContext(ctx, key)
+	if errgo.Cause(err) == ErrKeyExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Notef(err, "cannot insert key %q", key.Id)
+	}
+	return true, nil
+}
+
+// contextBacking returns b as a ContextBacking.
+func contextBacking(b Backing) ContextBacking {
+	if cb, ok := b.(ContextBacking); ok {
+		return cb
+	}
+	return backingWrapper{b: b}
+}
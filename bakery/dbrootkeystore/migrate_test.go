@@ -0,0 +1,203 @@
+package dbrootkeystore_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+var migrateKeys = []dbrootkeystore.RootKey{{
+	Id:      []byte("id0"),
+	Created: epoch,
+	Expires: epoch.Add(time.Hour),
+	RootKey: []byte("key0"),
+}, {
+	Id:      []byte("id1"),
+	Created: epoch.Add(time.Minute),
+	Expires: epoch.Add(2 * time.Hour),
+	RootKey: []byte("key1"),
+}, {
+	Id:      []byte("expired"),
+	Created: epoch.Add(-time.Hour),
+	Expires: epoch.Add(-time.Minute),
+	RootKey: []byte("expired key"),
+}, {
+	Id:      []byte("revoked"),
+	Created: epoch,
+	Expires: epoch.Add(time.Hour),
+}}
+
+func TestCopyKeys(t *testing.T) {
+	c := qt.New(t)
+	src := memBackingWithKeys(migrateKeys)
+	dst := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("id0"),
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		RootKey: []byte("existing key0"),
+	}})
+	n, err := dbrootkeystore.CopyKeys(context.Background(), dst, src, epoch)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 1)
+	c.Assert(dst, qt.HasLen, 2)
+	c.Assert(dst["id1"], qt.DeepEquals, migrateKeys[1])
+	c.Assert(string(dst["id0"].RootKey), qt.Equals, "existing key0")
+
+	// Copying again does nothing.
+	n, err = dbrootkeystore.CopyKeys(context.Background(), dst, src, epoch)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 0)
+}
+
+func TestCopyKeysOntoRevokedKey(t *testing.T) {
+	c := qt.New(t)
+	src := memBackingWithKeys(migrateKeys[:2])
+	dst := hideRevokedBacking{memBackingWithKeys(migrateKeys[:1])}
+	err := dst.RevokeKey(context.Background(), []byte("id0"))
+	c.Assert(err, qt.Equals, nil)
+	n, err := dbrootkeystore.CopyKeys(context.Background(), dst, src, epoch)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 1)
+	c.Assert(dst.memBacking["id1"], qt.DeepEquals, migrateKeys[1])
+
+	// The revoked key has not been brought back to life.
+	_, err = dst.GetKey([]byte("id0"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+	c.Assert(dst.memBacking["id0"].RootKey, qt.IsNil)
+}
+
+func TestCopyKeysWithUnsupportedBacking(t *testing.T) {
+	c := qt.New(t)
+	src := &funcBacking{Backing: make(memBacking)}
+	_, err := dbrootkeystore.CopyKeys(context.Background(), make(memBacking), src, epoch)
+	c.Assert(err, qt.ErrorMatches, `backing does not support iterating over keys`)
+}
+
+func TestCopyKeysInsertError(t *testing.T) {
+	c := qt.New(t)
+	src := memBackingWithKeys(migrateKeys[:1])
+	dst := insertErrorBacking{make(memBacking)}
+	_, err := dbrootkeystore.CopyKeys(context.Background(), dst, src, epoch)
+	c.Assert(err, qt.ErrorMatches, `cannot copy keys: cannot insert key "id0": no insert for you`)
+}
+
+func TestExportImport(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Patch(dbrootkeystore.ExportScryptN, 2)
+	src := memBackingWithKeys(migrateKeys)
+	var buf bytes.Buffer
+	n, err := dbrootkeystore.ExportKeys(context.Background(), &buf, src, epoch, []byte("passphrase"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("key0")), qt.Equals, false)
+
+	dst := make(memBacking)
+	n, err = dbrootkeystore.ImportKeys(context.Background(), dst, bytes.NewReader(buf.Bytes()), epoch, []byte("passphrase"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+	c.Assert(dst, qt.HasLen, 2)
+	for _, k := range migrateKeys[:2] {
+		got := dst[string(k.Id)]
+		c.Assert(got.Created.Equal(k.Created), qt.Equals, true)
+		c.Assert(got.Expires.Equal(k.Expires), qt.Equals, true)
+		c.Assert(got.RootKey, qt.DeepEquals, k.RootKey)
+	}
+
+	// Keys that have expired by the time of the import are
+	// skipped.
+	dst = make(memBacking)
+	n, err = dbrootkeystore.ImportKeys(context.Background(), dst, bytes.NewReader(buf.Bytes()), epoch.Add(90*time.Minute), []byte("passphrase"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 1)
+	c.Assert(dst["id1"].IsValid(), qt.Equals, true)
+}
+
+var importErrorTests = []struct {
+	about      string
+	modify     func([]byte) []byte
+	passphrase string
+	expectErr  string
+}{{
+	about:      "wrong passphrase",
+	passphrase: "wrong",
+	expectErr:  `cannot decrypt root key export file \(wrong passphrase\?\)`,
+}, {
+	about: "not an export file",
+	modify: func([]byte) []byte {
+		return []byte("something else entirely")
+	},
+	expectErr: `not a root key export file`,
+}, {
+	about: "truncated",
+	modify: func(data []byte) []byte {
+		return data[:len(data)-1]
+	},
+	expectErr: `root key export file is truncated`,
+}, {
+	about: "final record removed",
+	modify: func(data []byte) []byte {
+		// The final record holds just the secretbox overhead.
+		return data[:len(data)-4-16]
+	},
+	expectErr: `root key export file is truncated`,
+}, {
+	about: "corrupted",
+	modify: func(data []byte) []byte {
+		data[len(data)-1] ^= 1
+		return data
+	},
+	expectErr: `cannot decrypt root key export file \(wrong passphrase\?\)`,
+}}
+
+func TestImportErrors(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Patch(dbrootkeystore.ExportScryptN, 2)
+	var buf bytes.Buffer
+	_, err := dbrootkeystore.ExportKeys(context.Background(), &buf, memBackingWithKeys(migrateKeys), epoch, []byte("passphrase"))
+	c.Assert(err, qt.Equals, nil)
+	for _, test := range importErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			data := append([]byte(nil), buf.Bytes()...)
+			if test.modify != nil {
+				data = test.modify(data)
+			}
+			passphrase := test.passphrase
+			if passphrase == "" {
+				passphrase = "passphrase"
+			}
+			_, err := dbrootkeystore.ImportKeys(context.Background(), make(memBacking), bytes.NewReader(data), epoch, []byte(passphrase))
+			c.Assert(err, qt.ErrorMatches, test.expectErr)
+		})
+	}
+}
+
+type insertErrorBacking struct {
+	memBacking
+}
+
+func (insertErrorBacking) InsertKey(key dbrootkeystore.RootKey) error {
+	return errgo.New("no insert for you")
+}
+
+// hideRevokedBacking is like memBacking except that, like the
+// SQL and bolt backings, it reports revoked keys as not found.
+type hideRevokedBacking struct {
+	memBacking
+}
+
+func (b hideRevokedBacking) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
+	key, err := b.memBacking.GetKey(id)
+	if err == nil && !key.IsValid() {
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	}
+	return key, err
+}
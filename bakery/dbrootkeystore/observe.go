@@ -0,0 +1,159 @@
+package dbrootkeystore
+
+import (
+	"context"
+	"time"
+)
+
+// Observer is notified of events in a RootKeys instance. Each method
+// is passed the duration of the operation that caused the event, as
+// measured by the RootKeys clock. The methods may be called
+// concurrently and should return quickly.
+type Observer interface {
+	// CacheHit is called when the key with the given id
+	// was found in the cache.
+	CacheHit(ctx context.Context, id []byte, d time.Duration)
+
+	// CacheMiss is called when the key with the given id was
+	// fetched from the backing store because it was not in the
+	// cache; d holds the time taken to fetch it.
+	CacheMiss(ctx context.Context, id []byte, d time.Duration)
+
+	// KeyGenerated is called when a new root key has been
+	// created and inserted into the backing store; d holds the time
+	// taken to do so. The RootKey field of the key is nil.
+	KeyGenerated(ctx context.Context, key RootKey, d time.Duration)
+
+	// KeyExpired is called when a lookup finds that the key with
+	// the given id has expired; d holds the time taken by the
+	// lookup. Later lookups of the key that are answered from
+	// the cache do not call it again.
+	KeyExpired(ctx context.Context, id []byte, d time.Duration)
+
+	// BackingError is called when an operation on the backing
+	// store fails with an error other than one with a
+	// bakery.ErrNotFound cause. The op argument holds the name of
+	// the operation, such as "GetKey" or "InsertKey"; d holds the
+	// time taken by the operation.
+	BackingError(ctx context.Context, op string, err error, d time.Duration)
+}
+
+// SetObserver sets the observer that is notified of events in the
+// RootKeys instance. If o is nil, events are ignored (the default).
+func (s *RootKeys) SetObserver(o Observer) {
+	if o == nil {
+		o = nopObserver{}
+	}
+	s.obs.Store(observerHolder{o})
+}
+
+// observer returns the current observer.
+func (s *RootKeys) observer() Observer {
+	if h, ok := s.obs.Load().(observerHolder); ok {
+		return h.o
+	}
+	return nopObserver{}
+}
+
+// since returns the time elapsed since t according to the RootKeys
+// clock.
+func (s *RootKeys) since(t time.Time) time.Duration {
+	return s.clock.Now().Sub(t)
+}
+
+// observerHolder is stored in RootKeys.obs. An atomic.Value requires
+// values of a consistent concrete type, so we can't store the
+// observer directly.
+type observerHolder struct {
+	o Observer
+}
+
+type nopObserver struct{}
+
+func (nopObserver) CacheHit(context.Context, []byte, time.Duration)            {}
+func (nopObserver) CacheMiss(context.Context, []byte, time.Duration)           {}
+func (nopObserver) KeyGenerated(context.Context, RootKey, time.Duration)       {}
+func (nopObserver) KeyExpired(context.Context, []byte, time.Duration)          {}
+func (nopObserver) BackingError(context.Context, string, error, time.Duration) {}
+
+// Metrics is the interface used by NewMetricsObserver to report
+// events. It is small enough to be implemented easily on top of most
+// metrics systems.
+type Metrics interface {
+	// Counter returns the counter with the given name.
+	Counter(name string) Counter
+
+	// Histogram returns the histogram with the given name.
+	Histogram(name string) Histogram
+}
+
+// Counter is a monotonically increasing count.
+type Counter interface {
+	// Inc increments the counter.
+	Inc()
+}
+
+// Histogram records a distribution of values.
+type Histogram interface {
+	// Observe adds the given value to the histogram.
+	Observe(v float64)
+}
+
+// Names of the metrics reported by the observer returned from
+// NewMetricsObserver. Histograms record durations in seconds.
+const (
+	MetricCacheHits        = "rootkeys_cache_hits_total"
+	MetricCacheMisses      = "rootkeys_cache_misses_total"
+	MetricKeysGenerated    = "rootkeys_keys_generated_total"
+	MetricKeysExpired      = "rootkeys_keys_expired_total"
+	MetricBackingErrors    = "rootkeys_backing_errors_total"
+	MetricFetchDuration    = "rootkeys_fetch_duration_seconds"
+	MetricGenerateDuration = "rootkeys_generate_duration_seconds"
+)
+
+// NewMetricsObserver returns an Observer that reports events as
+// counters and histograms using m. Key churn can be monitored
+// through the rate of MetricKeysGenerated.
+func NewMetricsObserver(m Metrics) Observer {
+	return &metricsObserver{
+		hits:             m.Counter(MetricCacheHits),
+		misses:           m.Counter(MetricCacheMisses),
+		generated:        m.Counter(MetricKeysGenerated),
+		expired:          m.Counter(MetricKeysExpired),
+		backingErrors:    m.Counter(MetricBackingErrors),
+		fetchDuration:    m.Histogram(MetricFetchDuration),
+		generateDuration: m.Histogram(MetricGenerateDuration),
+	}
+}
+
+type metricsObserver struct {
+	hits             Counter
+	misses           Counter
+	generated        Counter
+	expired          Counter
+	backingErrors    Counter
+	fetchDuration    Histogram
+	generateDuration Histogram
+}
+
+func (o *metricsObserver) CacheHit(context.Context, []byte, time.Duration) {
+	o.hits.Inc()
+}
+
+func (o *metricsObserver) CacheMiss(_ context.Context, _ []byte, d time.Duration) {
+	o.misses.Inc()
+	o.fetchDuration.Observe(d.Seconds())
+}
+
+func (o *metricsObserver) KeyGenerated(_ context.Context, _ RootKey, d time.Duration) {
+	o.generated.Inc()
+	o.generateDuration.Observe(d.Seconds())
+}
+
+func (o *metricsObserver) KeyExpired(context.Context, []byte, time.Duration) {
+	o.expired.Inc()
+}
+
+func (o *metricsObserver) BackingError(context.Context, string, error, time.Duration) {
+	o.backingErrors.Inc()
+}
@@ -0,0 +1,263 @@
+package dbrootkeystore_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+func TestObserver(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	mb := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("old"),
+		Created: epoch.Add(-time.Hour),
+		Expires: epoch.Add(time.Minute),
+		RootKey: []byte("old key"),
+	}})
+	b := &funcBacking{
+		Backing: mb,
+		getKey: func(id []byte) (dbrootkeystore.RootKey, error) {
+			if string(id) == "bad" {
+				return dbrootkeystore.RootKey{}, errgo.New("database unavailable")
+			}
+			return mb.GetKey(id)
+		},
+	}
+	keys := dbrootkeystore.NewRootKeys(10, clockVal(&now))
+	obs := new(recordingObserver)
+	keys.SetObserver(obs)
+	store := keys.NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(obs.events, qt.DeepEquals, []string{"generated " + string(id) + " key []"})
+	obs.events = nil
+
+	_, err = store.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	_, err = store.Get(ctx, []byte("missing"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, err = store.Get(ctx, []byte("missing"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, err = store.Get(ctx, []byte("bad"))
+	c.Assert(err, qt.ErrorMatches, "database unavailable")
+
+	now = epoch.Add(2 * time.Minute)
+	_, err = store.Get(ctx, []byte("old"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	c.Assert(obs.events, qt.DeepEquals, []string{
+		"hit " + string(id),
+		"miss missing",
+		"hit missing",
+		"error GetKey database unavailable",
+		"miss old",
+		"expired old",
+	})
+}
+
+func TestObserverKeyExpiredReportedOnce(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	keys := dbrootkeystore.NewRootKeys(10, clockVal(&now))
+	obs := new(recordingObserver)
+	keys.SetObserver(obs)
+	store := keys.NewStore(make(memBacking), dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	obs.events = nil
+
+	// The key is cached, so each lookup after it
+	// expires is a cache hit, but the expiry is
+	// only reported the first time.
+	now = epoch.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err = store.Get(ctx, id)
+		c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	}
+	c.Assert(obs.events, qt.DeepEquals, []string{
+		"hit " + string(id),
+		"expired " + string(id),
+		"hit " + string(id),
+		"hit " + string(id),
+	})
+}
+
+func TestObserverReusedKeyNotGenerated(t *testing.T) {
+	c := qt.New(t)
+	b := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("id"),
+		Created: epoch,
+		Expires: epoch.Add(5 * time.Minute),
+		RootKey: []byte("key"),
+	}})
+	keys := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch))
+	obs := new(recordingObserver)
+	keys.SetObserver(obs)
+	store := keys.NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	_, id, err := store.RootKey(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(id), qt.Equals, "id")
+	c.Assert(obs.events, qt.HasLen, 0)
+}
+
+func TestObserverBackingErrors(t *testing.T) {
+	c := qt.New(t)
+	keys := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch))
+	obs := new(recordingObserver)
+	keys.SetObserver(obs)
+	store := keys.NewStore(errorBacking{}, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	_, _, err := store.RootKey(ctx)
+	c.Assert(err, qt.ErrorMatches, "cannot query existing keys: no find for you")
+	err = keys.DeleteExpired(ctx, errorBacking{}, epoch)
+	c.Assert(err, qt.ErrorMatches, "cannot delete expired keys: no delete for you")
+	c.Assert(obs.events, qt.DeepEquals, []string{
+		"error FindLatestKey no find for you",
+		"error DeleteExpiredKeys no delete for you",
+	})
+
+	// Setting a nil observer turns off notifications.
+	obs.events = nil
+	keys.SetObserver(nil)
+	_, _, err = store.RootKey(ctx)
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(obs.events, qt.HasLen, 0)
+}
+
+func TestMetricsObserver(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	b := make(memBacking)
+	keys := dbrootkeystore.NewRootKeys(10, clockFunc(func() time.Time {
+		// Each operation appears to take a second.
+		now = now.Add(time.Second)
+		return now
+	}))
+	m := newFakeMetrics()
+	keys.SetObserver(dbrootkeystore.NewMetricsObserver(m))
+	store := keys.NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: time.Hour,
+	})
+	ctx := context.Background()
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	_, err = store.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	_, err = store.Get(ctx, []byte("missing"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+
+	c.Assert(m.counters, qt.DeepEquals, map[string]int{
+		dbrootkeystore.MetricCacheHits:     1,
+		dbrootkeystore.MetricCacheMisses:   1,
+		dbrootkeystore.MetricKeysGenerated: 1,
+		dbrootkeystore.MetricKeysExpired:   0,
+		dbrootkeystore.MetricBackingErrors: 0,
+	})
+	c.Assert(m.histograms[dbrootkeystore.MetricFetchDuration], qt.HasLen, 1)
+	c.Assert(m.histograms[dbrootkeystore.MetricGenerateDuration], qt.HasLen, 1)
+	for _, v := range m.histograms[dbrootkeystore.MetricGenerateDuration] {
+		c.Assert(v > 0, qt.Equals, true)
+	}
+}
+
+// recordingObserver records the events it is notified of.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(f string, a ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(f, a...))
+}
+
+func (o *recordingObserver) CacheHit(_ context.Context, id []byte, d time.Duration) {
+	o.record("hit %s", id)
+}
+
+func (o *recordingObserver) CacheMiss(_ context.Context, id []byte, d time.Duration) {
+	o.record("miss %s", id)
+}
+
+func (o *recordingObserver) KeyGenerated(_ context.Context, key dbrootkeystore.RootKey, d time.Duration) {
+	o.record("generated %s key %v", key.Id, key.RootKey)
+}
+
+func (o *recordingObserver) KeyExpired(_ context.Context, id []byte, d time.Duration) {
+	o.record("expired %s", id)
+}
+
+func (o *recordingObserver) BackingError(_ context.Context, op string, err error, d time.Duration) {
+	o.record("error %s %v", op, err)
+}
+
+type errorBacking struct {
+	memBacking
+}
+
+func (errorBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	return dbrootkeystore.RootKey{}, errgo.New("no find for you")
+}
+
+func (errorBacking) DeleteExpiredKeys(_ context.Context, before time.Time) error {
+	return errgo.New("no delete for you")
+}
+
+type fakeMetrics struct {
+	counters   map[string]int
+	histograms map[string][]float64
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		counters:   make(map[string]int),
+		histograms: make(map[string][]float64),
+	}
+}
+
+func (m *fakeMetrics) Counter(name string) dbrootkeystore.Counter {
+	m.counters[name] = 0
+	return fakeCounter{m, name}
+}
+
+func (m *fakeMetrics) Histogram(name string) dbrootkeystore.Histogram {
+	return fakeHistogram{m, name}
+}
+
+type fakeCounter struct {
+	m    *fakeMetrics
+	name string
+}
+
+func (c fakeCounter) Inc() {
+	c.m.counters[c.name]++
+}
+
+type fakeHistogram struct {
+	m    *fakeMetrics
+	name string
+}
+
+func (h fakeHistogram) Observe(v float64) {
+	h.m.histograms[h.name] = append(h.m.histograms[h.name], v)
+}
@@ -0,0 +1,41 @@
+package dbrootkeystore
+
+import (
+	"context"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// Revoke revokes the key with the given id in the given backing
+// store, which must implement RevocationBacking, so that no
+// macaroon minted with the key will verify any longer. The key is
+// removed from the cache immediately; other RootKeys instances
+// using the same database will stop using the key within their
+// revalidate interval (see SetRevalidateInterval).
+//
+// If the key is not found, Revoke returns an error with a
+// bakery.ErrNotFound cause.
+func (s *RootKeys) Revoke(ctx context.Context, b Backing, id []byte) error {
+	rb, ok := b.(RevocationBacking)
+	if !ok {
+		return errgo.Newf("backing does not support revoking keys")
+	}
+	start := s.clock.Now()
+	if err := rb.RevokeKey(ctx, id); err != nil {
+		if errgo.Cause(err) != bakery.ErrNotFound {
+			s.observer().BackingError(ctx, "RevokeKey", err, s.since(start))
+		}
+		return errgo.NoteMask(err, "cannot revoke key", errgo.Is(bakery.ErrNotFound))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Add a negative entry rather than just removing the key
+	// so that a concurrent Get that fetched the key before it
+	// was revoked cannot resurrect it.
+	s.add(id, cacheEntry{
+		fetched: s.clock.Now(),
+	}, s.cache.nextSeq())
+	return nil
+}
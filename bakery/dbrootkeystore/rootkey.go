@@ -4,10 +4,12 @@
 package dbrootkeystore
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/errgo.v1"
@@ -15,6 +17,11 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery"
 )
 
+// ErrKeyExists is used as the cause of the error returned by
+// InsertKey implementations when a key with the same id is already
+// in the backing store, even if that key has been revoked.
+var ErrKeyExists = errgo.New("key already exists")
+
 // maxPolicyCache holds the maximum number of store policies that can
 // hold cached keys in a given RootKeys instance.
 //
@@ -23,20 +30,58 @@ import (
 // macaroon collection.
 const maxPolicyCache = 100
 
+// maxRecentKeys holds the maximum number of recently used keys
+// that are considered when looking for a current key for a store
+// policy without consulting the backing store.
+const maxRecentKeys = 32
+
 // RootKeys represents a cache of macaroon root keys.
 type RootKeys struct {
-	maxCacheSize int
-	clock        Clock
+	// revalidateInterval and negativeTTL are accessed atomically.
+	// They're first in the struct so that they're 64-bit aligned.
+
+	// revalidateInterval holds the maximum length of time
+	// that a cached key will be used for before it is fetched
+	// again from the backing store. If it is zero, cached keys
+	// are not revalidated.
+	revalidateInterval int64
+
+	// negativeTTL holds the maximum length of time that
+	// a key that was not found will be remembered as such.
+	// If it is zero, only revalidateInterval applies.
+	negativeTTL int64
 
-	// TODO (rogpeppe) use RWMutex instead of Mutex here so that
-	// it's faster in the probably-common case that we
-	// have many contended readers.
-	mu       sync.Mutex
-	oldCache map[string]RootKey
-	cache    map[string]RootKey
+	clock Clock
+	cache *keyCache
+
+	// obs holds the observerHolder for the Observer that is
+	// notified of events. It is set by SetObserver.
+	obs atomic.Value
+
+	// mu guards the fields below it. Lookups of keys by id
+	// do not need it.
+	mu sync.RWMutex
 
 	// current holds the current root key for each store policy.
-	current map[Policy]RootKey
+	current map[Policy]cacheEntry
+
+	// recent holds recently used valid keys, most recently
+	// created first. It is used to find a current key for a
+	// store policy without scanning the whole cache.
+	recent []cacheEntry
+
+	// generating holds the calls to obtain a new current key
+	// that are in progress for each store policy.
+	generating map[Policy]*generateCall
+}
+
+// generateCall represents a call to obtain a new current key
+// for a store policy.
+type generateCall struct {
+	// done is closed when the call has completed.
+	done chan struct{}
+	key  RootKey
+	err  error
 }
 
 // Clock can be used to provide a mockable time
@@ -65,7 +110,8 @@ type Backing interface {
 	FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error)
 
 	// InsertKey inserts the given root key into the backing store.
-	// It may return an error if the id or key already exist.
+	// It may return an error if the id or key already exist; if the
+	// id exists, the error should have an ErrKeyExists cause.
 	InsertKey(key RootKey) error
 }
 
@@ -90,10 +136,65 @@ type ContextBacking interface {
 	FindLatestKeyContext(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error)
 
 	// InsertKeyContext inserts the given root key into the backing
-	// store. It may return an error if the id or key already exist.
+	// store. It may return an error if the id or key already exist;
+	// if the id exists, the error should have an ErrKeyExists cause.
 	InsertKeyContext(ctx context.Context, key RootKey) error
 }
 
+// An ExpiryBacking may be implemented by a Backing to allow expired
+// keys to be removed from the backing store by RootKeys.DeleteExpired.
+type ExpiryBacking interface {
+	// DeleteExpiredKeys deletes all keys from the backing store
+	// that expired before the given time.
+	DeleteExpiredKeys(ctx context.Context, before time.Time) error
+}
+
+// A RevocationBacking may be implemented by a Backing to allow keys to
+// be revoked by RootKeys.Revoke.
+type RevocationBacking interface {
+	// RevokeKey marks the key with the given id as revoked. After
+	// it has returned, GetKey must return either an error with a
+	// bakery.ErrNotFound cause or a RootKey with a nil RootKey
+	// field for that id, and FindLatestKey must never return the
+	// key. If the key is not found, it should return an error
+	// with a bakery.ErrNotFound cause.
+	RevokeKey(ctx context.Context, id []byte) error
+}
+
+// An IterBacking may be implemented by a Backing to allow the keys in
+// the backing store to be enumerated.
+type IterBacking interface {
+	// ForEachKey calls f for each key in the backing store that
+	// has not been revoked. Keys that have expired may or may not
+	// be included. If f returns an error, ForEachKey stops and
+	// returns that error. The f function must not modify the
+	// backing store.
+	ForEachKey(ctx context.Context, f func(RootKey) error) error
+}
+
+// An UpdateBacking may be implemented by a Backing to allow the secrets
+// of existing keys to be replaced.
+type UpdateBacking interface {
+	// UpdateKey replaces the root key secret of the existing
+	// key with the same id as key with key.RootKey; the creation
+	// and expiry times of the existing key are left unchanged.
+	// If the key is not found or has been revoked, it should return an
+	// error with a bakery.ErrNotFound cause.
+	UpdateKey(ctx context.Context, key RootKey) error
+}
+
+// A WindowInsertBacking may be implemented by a Backing to allow
+// RootKeys instances sharing the same database to avoid creating
+// more than one new key for each store policy window.
+type WindowInsertBacking interface {
+	// InsertKeyIfNoneInWindow atomically checks whether the backing
+	// store holds a key that FindLatestKey would return for the
+	// given arguments. If it does, it returns the most recently
+	// created such key and does not insert anything; otherwise it
+	// inserts the given key and returns it.
+	InsertKeyIfNoneInWindow(ctx context.Context, key RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error)
+}
+
 // A backingWrapper is used to convert a Backing into a ContextBacking by
 // accepting and ignoring the contexts.
 type backingWrapper struct {
@@ -159,13 +260,37 @@ func NewRootKeys(maxCacheSize int, clock Clock) *RootKeys {
 		clock = wallClock{}
 	}
 	return &RootKeys{
-		maxCacheSize: maxCacheSize,
-		cache:        make(map[string]RootKey),
-		current:      make(map[Policy]RootKey),
-		clock:        clock,
+		cache:   newKeyCache(maxCacheSize),
+		current: make(map[Policy]cacheEntry),
+		clock:   clock,
 	}
 }
 
+// SetRevalidateInterval sets the maximum length of time that a key
+// will be served from the cache before it is fetched again from the
+// backing store. This bounds the time it takes for a key revoked by
+// another RootKeys instance sharing the same database to stop being
+// used by this one. If d is zero (the default), cached keys are never
+// revalidated.
+func (s *RootKeys) SetRevalidateInterval(d time.Duration) {
+	atomic.StoreInt64(&s.revalidateInterval, int64(d))
+}
+
+// SetNegativeTTL sets the maximum length of time that a lookup of a
+// key that was not found will be answered from the cache. This
+// bounds the time it takes for a key inserted by another RootKeys
+// instance to become visible to this one after an unsuccessful
+// lookup. If d is zero (the default), only the revalidate interval
+// applies to such entries.
+func (s *RootKeys) SetNegativeTTL(d time.Duration) {
+	atomic.StoreInt64(&s.negativeTTL, int64(d))
+}
+
+// CacheStats returns statistics about the key cache.
+func (s *RootKeys) CacheStats() CacheStats {
+	return s.cache.stats()
+}
+
 // Policy holds a store policy for root keys.
 type Policy struct {
 	// GenerateInterval holds the maximum length of time
@@ -194,14 +319,13 @@ func (s *RootKeys) NewStore(b Backing, policy Policy) bakery.RootKeyStore {
 	if policy.GenerateInterval == 0 {
 		policy.GenerateInterval = policy.ExpiryDuration
 	}
-	cb, ok := b.(ContextBacking)
-	if !ok {
-		cb = backingWrapper{b: b}
-	}
+	cb := contextBacking(b)
+	wb, _ := b.(WindowInsertBacking)
 	return &store{
-		keys:    s,
-		backing: cb,
-		policy:  policy,
+		keys:         s,
+		backing:      cb,
+		windowInsert: wb,
+		policy:       policy,
 	}
 }
 
@@ -210,56 +334,189 @@ func (s *RootKeys) NewStore(b Backing, policy Policy) bakery.RootKeyStore {
 //
 // If the key does not exist or has expired, it returns
 // bakery.ErrNotFound.
-//
-// Called with s.mu locked.
 func (s *RootKeys) get(ctx context.Context, id []byte, b ContextBacking) (RootKey, error) {
-	key, cached, err := s.get0(ctx, id, b)
+	start := s.clock.Now()
+	if e, ok := s.cache.get(string(id)); ok && s.isFresh(e) {
+		atomic.AddUint64(&s.cache.hits, 1)
+		s.observer().CacheHit(ctx, id, s.since(start))
+		if !e.key.IsValid() {
+			return RootKey{}, bakery.ErrNotFound
+		}
+		if s.clock.Now().After(e.key.Expires) {
+			// Replace the entry so that the expiry is only
+			// reported once.
+			s.mu.Lock()
+			expired := s.cache.expire(string(id), e)
+			if expired {
+				s.forget(id)
+			}
+			s.mu.Unlock()
+			if expired {
+				s.observer().KeyExpired(ctx, id, s.since(start))
+			}
+			return RootKey{}, bakery.ErrNotFound
+		}
+		return e.key, nil
+	}
+	atomic.AddUint64(&s.cache.misses, 1)
+	// Obtain the sequence number before fetching the key so
+	// that if the key is revoked while we're fetching it, the
+	// revocation takes precedence.
+	seq := s.cache.nextSeq()
+	now := s.clock.Now()
+	key, err := b.GetKeyContext(ctx, id)
+	if err == nil && !key.IsValid() {
+		// The key has been revoked.
+		err = bakery.ErrNotFound
+	}
 	if err != nil && err != bakery.ErrNotFound {
+		s.observer().BackingError(ctx, "GetKey", err, s.since(start))
 		return RootKey{}, errgo.Mask(err)
 	}
+	s.observer().CacheMiss(ctx, id, s.since(start))
 	if err == nil && s.clock.Now().After(key.Expires) {
-		key = RootKey{}
+		s.observer().KeyExpired(ctx, id, s.since(start))
 		err = bakery.ErrNotFound
 	}
-	if !cached {
-		s.addCache(id, key)
+	if err != nil {
+		key = RootKey{}
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(id, cacheEntry{
+		key:     key,
+		fetched: now,
+	}, seq)
 	return key, err
 }
 
-// get0 is the inner version of RootKeys.get. It returns an item and reports
-// whether it was found in the cache, but doesn't check whether the
-// item has expired or move the returned item to s.cache.
-func (s *RootKeys) get0(ctx context.Context, id []byte, b ContextBacking) (key RootKey, inCache bool, err error) {
-	if k, ok := s.cache[string(id)]; ok {
-		if !k.IsValid() {
-			return RootKey{}, true, bakery.ErrNotFound
-		}
-		return k, true, nil
+// isFresh reports whether the given cache entry may be used
+// without fetching the key from the backing store again.
+func (s *RootKeys) isFresh(e cacheEntry) bool {
+	age := s.clock.Now().Sub(e.fetched)
+	if d := time.Duration(atomic.LoadInt64(&s.revalidateInterval)); d != 0 && age >= d {
+		return false
+	}
+	if d := time.Duration(atomic.LoadInt64(&s.negativeTTL)); d != 0 && !e.key.IsValid() && age >= d {
+		return false
+	}
+	return true
+}
+
+// add adds the given entry to the cache, unless the cache holds a
+// more recent entry for the same id, and reports whether it did so.
+// If the entry holds a valid key, it is added to s.recent;
+// otherwise the key is removed from s.recent and s.current.
+//
+// Called with s.mu locked.
+func (s *RootKeys) add(id []byte, e cacheEntry, seq uint64) bool {
+	if !s.cache.add(string(id), e, seq) {
+		return false
 	}
-	if k, ok := s.oldCache[string(id)]; ok {
-		if !k.IsValid() {
-			return RootKey{}, false, bakery.ErrNotFound
+	if !e.key.IsValid() {
+		s.forget(id)
+		return true
+	}
+	now := s.clock.Now()
+	recent := s.recent[:0]
+	added := false
+	for _, r := range s.recent {
+		if bytes.Equal(r.key.Id, id) || now.After(r.key.Expires) {
+			continue
+		}
+		if !added && e.key.Created.After(r.key.Created) {
+			recent = append(recent, e)
+			added = true
 		}
-		return k, false, nil
+		recent = append(recent, r)
+	}
+	if !added {
+		recent = append(recent, e)
 	}
-	k, err := b.GetKeyContext(ctx, id)
-	return k, false, err
+	if len(recent) > maxRecentKeys {
+		recent = recent[:maxRecentKeys]
+	}
+	s.recent = recent
+	return true
 }
 
-// addCache adds the given key to the cache.
+// forget removes the key with the given id from s.recent
+// and s.current.
+//
 // Called with s.mu locked.
-func (s *RootKeys) addCache(id []byte, k RootKey) {
-	if len(s.cache) >= s.maxCacheSize {
-		s.oldCache = s.cache
-		s.cache = make(map[string]RootKey)
+func (s *RootKeys) forget(id []byte) {
+	recent := s.recent[:0]
+	for _, r := range s.recent {
+		if !bytes.Equal(r.key.Id, id) {
+			recent = append(recent, r)
+		}
 	}
-	s.cache[string(id)] = k
+	s.recent = recent
+	for p, e := range s.current {
+		if bytes.Equal(e.key.Id, id) {
+			delete(s.current, p)
+		}
+	}
+}
+
+// generateOnce calls f to obtain a new current key for the given
+// store policy, unless a call for the same policy is already in
+// progress, in which case it waits for that call to complete and
+// returns its result instead. This avoids creating many keys when
+// many callers find that there is no current key at the same time.
+//
+// If the call in progress fails only because the context of its
+// caller was cancelled, the waiters try again rather than failing
+// with an error that is not theirs.
+func (s *RootKeys) generateOnce(ctx context.Context, policy Policy, f func(context.Context) (RootKey, error)) (RootKey, error) {
+	for {
+		s.mu.Lock()
+		call, ok := s.generating[policy]
+		if !ok {
+			break
+		}
+		s.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return RootKey{}, errgo.Mask(ctx.Err(), errgo.Any)
+		}
+		if !isContextError(call.err) {
+			return call.key, call.err
+		}
+	}
+	call := &generateCall{
+		done: make(chan struct{}),
+	}
+	if s.generating == nil {
+		s.generating = make(map[Policy]*generateCall)
+	}
+	s.generating[policy] = call
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.generating, policy)
+		s.mu.Unlock()
+		close(call.done)
+	}()
+	call.key, call.err = f(ctx)
+	return call.key, call.err
+}
+
+// isContextError reports whether err was caused by
+// a context being cancelled or timing out.
+func isContextError(err error) bool {
+	switch errgo.Cause(err) {
+	case context.Canceled, context.DeadlineExceeded:
+		return true
+	}
+	return false
 }
 
 // setCurrent sets the current key for the given store policy.
 // Called with s.mu locked.
-func (s *RootKeys) setCurrent(policy Policy, key RootKey) {
+func (s *RootKeys) setCurrent(policy Policy, e cacheEntry) {
 	if len(s.current) > maxPolicyCache {
 		// Sanity check to avoid possibly memory leak:
 		// if some client is using arbitrarily many store
@@ -268,22 +525,23 @@ func (s *RootKeys) setCurrent(policy Policy, key RootKey) {
 		// This will result in worse performance but it shouldn't
 		// happen in practice and it's better than using endless
 		// space.
-		s.current = make(map[Policy]RootKey)
+		s.current = make(map[Policy]cacheEntry)
 	}
-	s.current[policy] = key
+	s.current[policy] = e
 }
 
 type store struct {
 	keys    *RootKeys
 	policy  Policy
 	backing ContextBacking
+
+	// windowInsert holds the backing as a WindowInsertBacking
+	// if it implements that interface.
+	windowInsert WindowInsertBacking
 }
 
 // Get implements bakery.RootKeyStore.Get.
 func (s *store) Get(ctx context.Context, id []byte) ([]byte, error) {
-	s.keys.mu.Lock()
-	defer s.keys.mu.Unlock()
-
 	key, err := s.keys.get(ctx, id, s.backing)
 	if err != nil {
 		return nil, err
@@ -291,6 +549,15 @@ func (s *store) Get(ctx context.Context, id []byte) ([]byte, error) {
 	return key.RootKey, nil
 }
 
+// RootKeyExpiry implements bakery.RootKeyExpirer.RootKeyExpiry.
+func (s *store) RootKeyExpiry(ctx context.Context, id []byte) (time.Time, error) {
+	key, err := s.keys.get(ctx, id, s.backing)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return key.Expires, nil
+}
+
 // RootKey implements bakery.RootKeyStore.RootKey by
 // returning an existing key from the cache when compatible
 // with the current policy.
@@ -298,8 +565,22 @@ func (s *store) RootKey(ctx context.Context) ([]byte, []byte, error) {
 	if key := s.rootKeyFromCache(); key.IsValid() {
 		return key.RootKey, key.Id, nil
 	}
+	key, err := s.keys.generateOnce(ctx, s.policy, s.newRootKey)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	return key.RootKey, key.Id, nil
+}
+
+// newRootKey finds the best root key in the backing store, or
+// creates a new one if there is none, and makes it the current key
+// for s.policy.
+func (s *store) newRootKey(ctx context.Context) (RootKey, error) {
+	seq := s.keys.cache.nextSeq()
+	start := s.keys.clock.Now()
 	// Try to find a root key from the collection.
-	// It doesn't matter much if two concurrent mongo
+	// If the backing does not implement WindowInsertBacking,
+	// it doesn't matter much if two concurrent mongo
 	// clients are doing this at the same time because
 	// we don't mind if there are more keys than necessary.
 	//
@@ -307,56 +588,98 @@ func (s *store) RootKey(ctx context.Context) ([]byte, []byte, error) {
 	// store.rootKeyFromCache.
 	key, err := s.findBestRootKey(ctx)
 	if err != nil {
-		return nil, nil, errgo.Notef(err, "cannot query existing keys")
+		s.keys.observer().BackingError(ctx, "FindLatestKey", err, s.keys.since(start))
+		return RootKey{}, errgo.NoteMask(err, "cannot query existing keys", isContextError)
 	}
 	if !key.IsValid() {
 		// No keys found anywhere, so let's create one.
-		var err error
-		key, err = s.generateKey()
+		newKey, err := s.generateKey()
 		if err != nil {
-			return nil, nil, errgo.Notef(err, "cannot generate key")
+			return RootKey{}, errgo.Notef(err, "cannot generate key")
 		}
-		if err := s.backing.InsertKeyContext(ctx, key); err != nil {
-			return nil, nil, errgo.Notef(err, "cannot create root key")
+		key, err = s.insertKey(ctx, newKey)
+		if err != nil {
+			s.keys.observer().BackingError(ctx, "InsertKey", err, s.keys.since(start))
+			return RootKey{}, errgo.NoteMask(err, "cannot create root key", isContextError)
+		}
+		if bytes.Equal(key.Id, newKey.Id) {
+			// Our key was used rather than one inserted
+			// concurrently by another client.
+			generated := key
+			generated.RootKey = nil
+			s.keys.observer().KeyGenerated(ctx, generated, s.keys.since(start))
 		}
 	}
 	s.keys.mu.Lock()
 	defer s.keys.mu.Unlock()
-	s.keys.addCache(key.Id, key)
-	s.keys.setCurrent(s.policy, key)
-	return key.RootKey, key.Id, nil
+	e := cacheEntry{
+		key:     key,
+		fetched: s.keys.clock.Now(),
+	}
+	if s.keys.add(key.Id, e, seq) {
+		s.keys.setCurrent(s.policy, e)
+	}
+	return key, nil
+}
+
+// insertKey inserts the given newly generated key into the backing
+// store and returns the key that should be used, which may be a
+// different key inserted concurrently by some other client if the
+// backing implements WindowInsertBacking.
+func (s *store) insertKey(ctx context.Context, key RootKey) (RootKey, error) {
+	if s.windowInsert == nil {
+		if err := s.backing.InsertKeyContext(ctx, key); err != nil {
+			return RootKey{}, errgo.Mask(err, isContextError)
+		}
+		return key, nil
+	}
+	createdAfter, expiresAfter, expiresBefore := s.window(key.Created)
+	key, err := s.windowInsert.InsertKeyIfNoneInWindow(ctx, key, createdAfter, expiresAfter, expiresBefore)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err, isContextError)
+	}
+	if !key.IsValid() {
+		return RootKey{}, errgo.Newf("backing returned invalid key")
+	}
+	return key, nil
 }
 
 func (s *store) findBestRootKey(ctx context.Context) (RootKey, error) {
-	now := s.keys.clock.Now()
-	createdAfter := now.Add(-s.policy.GenerateInterval)
-	expiresAfter := now.Add(s.policy.ExpiryDuration)
-	expiresBefore := now.Add(s.policy.ExpiryDuration + s.policy.GenerateInterval)
+	createdAfter, expiresAfter, expiresBefore := s.window(s.keys.clock.Now())
 	return s.backing.FindLatestKeyContext(ctx, createdAfter, expiresAfter, expiresBefore)
 }
 
+// window returns the bounds on the creation and expiry times of keys
+// that are valid to use at the given time with s.policy.
+func (s *store) window(now time.Time) (createdAfter, expiresAfter, expiresBefore time.Time) {
+	createdAfter = now.Add(-s.policy.GenerateInterval)
+	expiresAfter = now.Add(s.policy.ExpiryDuration)
+	expiresBefore = now.Add(s.policy.ExpiryDuration + s.policy.GenerateInterval)
+	return createdAfter, expiresAfter, expiresBefore
+}
+
 // rootKeyFromCache returns a root key from the cached keys.
 // If no keys are found that are valid for s.policy, it returns
 // the zero key.
 func (s *store) rootKeyFromCache() RootKey {
-	s.keys.mu.Lock()
-	defer s.keys.mu.Unlock()
-	if k, ok := s.keys.current[s.policy]; ok && k.IsValidWithPolicy(s.policy, s.keys.clock.Now()) {
-		return k
+	now := s.keys.clock.Now()
+	s.keys.mu.RLock()
+	e, ok := s.keys.current[s.policy]
+	s.keys.mu.RUnlock()
+	if ok && s.keys.isFresh(e) && e.key.IsValidWithPolicy(s.policy, now) {
+		return e.key
 	}
 
 	// Find the most recently created key that's consistent with the
 	// store policy.
-	var current RootKey
-	for _, k := range s.keys.cache {
-		if k.IsValidWithPolicy(s.policy, s.keys.clock.Now()) && k.Created.After(current.Created) {
-			current = k
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+	for _, e := range s.keys.recent {
+		if s.keys.isFresh(e) && e.key.IsValidWithPolicy(s.policy, now) {
+			s.keys.setCurrent(s.policy, e)
+			return e.key
 		}
 	}
-	if current.IsValid() {
-		s.keys.current[s.policy] = current
-		return current
-	}
 	return RootKey{}
 }
 
@@ -2,6 +2,7 @@ package dbrootkeystore_test
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -320,16 +321,12 @@ func TestGet(t *testing.T) {
 	}
 	// Check that the keys are cached.
 	//
-	// Since the cache size is 5, the most recent 5 items will be in
-	// the primary cache; the 5 items before that will be in the old
-	// cache and nothing else will be cached.
+	// Since the cache size is 5, only the 5 most recently used
+	// items will be cached. We fetch the keys most recent first,
+	// so each fetch of an uncached key evicts the least recently
+	// used key, which is never one that we go on to fetch.
 	//
-	// The first time we fetch an item from the old cache, a new
-	// primary cache will be allocated, all existing items in the
-	// old cache except that item will be evicted, and all items in
-	// the current primary cache moved to the old cache.
-	//
-	// The upshot of that is that all but the first 6 calls to Get
+	// The upshot of that is that all but the first 5 calls to Get
 	// should result in a database fetch.
 
 	var fetched []string
@@ -346,9 +343,9 @@ func TestGet(t *testing.T) {
 		c.Assert(err, qt.Equals, nil, qt.Commentf("key %d (%s)", i, k.id))
 		c.Assert(key, qt.DeepEquals, k.key, qt.Commentf("key %d (%s)", i, k.id))
 	}
-	c.Assert(len(fetched), qt.Equals, len(keys)-6)
+	c.Assert(len(fetched), qt.Equals, len(keys)-5)
 	for i, id := range fetched {
-		c.Assert(id, qt.Equals, keys[len(keys)-6-i-1].id)
+		c.Assert(id, qt.Equals, keys[len(keys)-5-i-1].id)
 	}
 }
 
@@ -422,6 +419,498 @@ func TestContextBackingTakesPrecedence(t *testing.T) {
 	c.Assert(key1, qt.DeepEquals, key2)
 }
 
+func TestDeleteExpired(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	mb := make(memBacking)
+	keys := dbrootkeystore.NewRootKeys(10, clockVal(&now))
+	store := keys.NewStore(mb, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	_, id1, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	now = epoch.Add(15 * time.Minute)
+	_, id2, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(id2), qt.Not(qt.Equals), string(id1))
+
+	err = keys.DeleteExpired(ctx, mb, now)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(mb, qt.HasLen, 1)
+	c.Assert(mb[string(id2)].IsValid(), qt.Equals, true)
+
+	// Put a key with the same id back into the backing store
+	// to check that the expired key has been removed from
+	// the cache too.
+	err = mb.InsertKey(dbrootkeystore.RootKey{
+		Id:      id1,
+		Created: now,
+		Expires: now.Add(time.Hour),
+		RootKey: []byte("newkey"),
+	})
+	c.Assert(err, qt.Equals, nil)
+	key, err := store.Get(ctx, id1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key), qt.Equals, "newkey")
+}
+
+func TestDeleteExpiredWithUnsupportedBacking(t *testing.T) {
+	c := qt.New(t)
+	b := &funcBacking{Backing: make(memBacking)}
+	err := dbrootkeystore.NewRootKeys(10, nil).DeleteExpired(context.Background(), b, epoch)
+	c.Assert(err, qt.ErrorMatches, `backing does not support deleting expired keys`)
+}
+
+func TestCollector(t *testing.T) {
+	c := qt.New(t)
+	b := deleteBacking{
+		Backing: make(memBacking),
+		deleted: make(chan time.Time),
+	}
+	keys := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch))
+	stop, err := keys.StartCollector(b, time.Millisecond, nil)
+	c.Assert(err, qt.IsNil)
+	defer stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case before := <-b.deleted:
+			c.Assert(before, qt.DeepEquals, epoch)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("collector did not delete expired keys")
+		}
+	}
+}
+
+func TestCollectorInvalidParams(t *testing.T) {
+	c := qt.New(t)
+	keys := dbrootkeystore.NewRootKeys(10, nil)
+	b := deleteBacking{
+		Backing: make(memBacking),
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		_, err := keys.StartCollector(b, interval, nil)
+		c.Assert(err, qt.ErrorMatches, `non-positive collection interval .*`)
+	}
+	_, err := keys.StartCollector(&funcBacking{Backing: make(memBacking)}, time.Second, nil)
+	c.Assert(err, qt.ErrorMatches, `backing does not support deleting expired keys`)
+}
+
+type deleteBacking struct {
+	dbrootkeystore.Backing
+	deleted chan time.Time
+}
+
+func (b deleteBacking) DeleteExpiredKeys(ctx context.Context, before time.Time) error {
+	select {
+	case b.deleted <- before:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func TestRevoke(t *testing.T) {
+	c := qt.New(t)
+	mb := make(memBacking)
+	keys := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch))
+	store := keys.NewStore(mb, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	err = keys.Revoke(ctx, mb, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(mb[string(id)].RootKey, qt.IsNil)
+
+	key, err := store.Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	c.Assert(key, qt.IsNil)
+
+	// A new key should be generated even though the
+	// revoked key is still within the generate interval.
+	_, id1, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(id1), qt.Not(qt.Equals), string(id))
+}
+
+func TestRevokeNotFound(t *testing.T) {
+	c := qt.New(t)
+	err := dbrootkeystore.NewRootKeys(10, nil).Revoke(context.Background(), make(memBacking), []byte("foo"))
+	c.Assert(err, qt.ErrorMatches, `cannot revoke key: not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+}
+
+func TestRevokeWithUnsupportedBacking(t *testing.T) {
+	c := qt.New(t)
+	b := &funcBacking{Backing: make(memBacking)}
+	err := dbrootkeystore.NewRootKeys(10, nil).Revoke(context.Background(), b, []byte("foo"))
+	c.Assert(err, qt.ErrorMatches, `backing does not support revoking keys`)
+}
+
+func TestRevokePropagatesAfterRevalidateInterval(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	clock := clockVal(&now)
+	mb := make(memBacking)
+	policy := dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	}
+	keys1 := dbrootkeystore.NewRootKeys(10, clock)
+	keys1.SetRevalidateInterval(time.Minute)
+	store1 := keys1.NewStore(mb, policy)
+	keys2 := dbrootkeystore.NewRootKeys(10, clock)
+	ctx := context.Background()
+
+	_, id, err := store1.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	_, err = store1.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+
+	// Revoke the key through the other instance.
+	err = keys2.Revoke(ctx, mb, id)
+	c.Assert(err, qt.Equals, nil)
+
+	// Within the revalidate interval, the first instance
+	// still uses its cached key.
+	now = epoch.Add(30 * time.Second)
+	_, err = store1.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	_, id1, err := store1.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(id1), qt.Equals, string(id))
+
+	// After that, it notices the revocation.
+	now = epoch.Add(time.Minute)
+	_, err = store1.Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, id1, err = store1.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(id1), qt.Not(qt.Equals), string(id))
+}
+
+func TestCacheStats(t *testing.T) {
+	c := qt.New(t)
+	keys := dbrootkeystore.NewRootKeys(2, stoppedClock(epoch))
+	store := keys.NewStore(make(memBacking), dbrootkeystore.Policy{
+		GenerateInterval: time.Minute,
+		ExpiryDuration:   5 * time.Minute,
+	})
+	ctx := context.Background()
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys.CacheStats(), qt.DeepEquals, dbrootkeystore.CacheStats{
+		Size: 1,
+	})
+
+	_, err = store.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	_, err = store.Get(ctx, []byte("foo"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, err = store.Get(ctx, []byte("bar"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	c.Assert(keys.CacheStats(), qt.DeepEquals, dbrootkeystore.CacheStats{
+		Hits:      1,
+		Misses:    2,
+		Evictions: 1,
+		Size:      2,
+	})
+}
+
+func TestGetEvictsLeastRecentlyUsed(t *testing.T) {
+	c := qt.New(t)
+	var fetched []string
+	mb := make(memBacking)
+	b := &funcBacking{
+		Backing: mb,
+		getKey: func(id []byte) (dbrootkeystore.RootKey, error) {
+			fetched = append(fetched, string(id))
+			return mb.GetKey(id)
+		},
+	}
+	store := dbrootkeystore.NewRootKeys(2, stoppedClock(epoch)).NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "a", "c", "a", "b"} {
+		_, err := store.Get(ctx, []byte(id))
+		c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	}
+	// Fetching "c" evicts "b" rather than "a" because
+	// "a" was used more recently.
+	c.Assert(fetched, qt.DeepEquals, []string{"a", "b", "c", "b"})
+}
+
+func TestNegativeTTL(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	clock := clockVal(&now)
+	var fetched []string
+	mb := make(memBacking)
+	b := &funcBacking{
+		Backing: mb,
+		getKey: func(id []byte) (dbrootkeystore.RootKey, error) {
+			fetched = append(fetched, string(id))
+			return mb.GetKey(id)
+		},
+	}
+	keys := dbrootkeystore.NewRootKeys(10, clock)
+	keys.SetNegativeTTL(time.Minute)
+	store := keys.NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	_, err := store.Get(ctx, []byte("foo"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	c.Assert(fetched, qt.DeepEquals, []string{"foo"})
+
+	// The key is inserted by some other means.
+	mb["foo"] = dbrootkeystore.RootKey{
+		Id:      []byte("foo"),
+		Created: epoch,
+		Expires: epoch.Add(5 * time.Minute),
+		RootKey: []byte("key"),
+	}
+
+	// Within the negative TTL, the miss is still cached.
+	now = epoch.Add(30 * time.Second)
+	_, err = store.Get(ctx, []byte("foo"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	c.Assert(fetched, qt.DeepEquals, []string{"foo"})
+
+	// After that, the key is fetched again.
+	now = epoch.Add(time.Minute)
+	key, err := store.Get(ctx, []byte("foo"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key), qt.Equals, "key")
+	c.Assert(fetched, qt.DeepEquals, []string{"foo", "foo"})
+
+	// Positive entries are not subject to the negative TTL.
+	now = epoch.Add(3 * time.Minute)
+	_, err = store.Get(ctx, []byte("foo"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(fetched, qt.DeepEquals, []string{"foo", "foo"})
+}
+
+func TestRootKeyGeneratesOnce(t *testing.T) {
+	c := qt.New(t)
+	b := &countingBacking{
+		memBacking: make(memBacking),
+		release:    make(chan struct{}),
+	}
+	store := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	const n = 10
+	ids := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, id, err := store.RootKey(context.Background())
+			c.Check(err, qt.Equals, nil)
+			ids <- string(id)
+		}()
+	}
+	close(b.release)
+	wg.Wait()
+	close(ids)
+	first := <-ids
+	for id := range ids {
+		c.Assert(id, qt.Equals, first)
+	}
+	c.Assert(b.inserts, qt.Equals, 1)
+}
+
+func TestRootKeyGenerateOnceWaiterCancelled(t *testing.T) {
+	c := qt.New(t)
+	b := &countingBacking{
+		memBacking: make(memBacking),
+		release:    make(chan struct{}),
+		finding:    make(chan struct{}),
+	}
+	store := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, err := store.RootKey(context.Background())
+		c.Check(err, qt.Equals, nil)
+	}()
+	<-b.finding
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := store.RootKey(ctx)
+	c.Assert(errgo.Cause(err), qt.Equals, context.Canceled)
+
+	close(b.release)
+	<-done
+	c.Assert(b.inserts, qt.Equals, 1)
+}
+
+func TestRootKeyGenerateOnceLeaderCancelled(t *testing.T) {
+	c := qt.New(t)
+	b := &cancelBacking{
+		memBacking: make(memBacking),
+		finding:    make(chan struct{}),
+	}
+	store := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leaderDone := make(chan error)
+	go func() {
+		_, _, err := store.RootKey(ctx)
+		leaderDone <- err
+	}()
+	<-b.finding
+
+	waiterDone := make(chan error)
+	go func() {
+		_, _, err := store.RootKey(context.Background())
+		waiterDone <- err
+	}()
+	// Give the waiter time to start waiting for the leader.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	c.Assert(errgo.Cause(<-leaderDone), qt.Equals, context.Canceled)
+
+	// The waiter is not affected by the leader's cancellation.
+	c.Assert(<-waiterDone, qt.Equals, nil)
+	c.Assert(b.memBacking, qt.HasLen, 1)
+}
+
+func TestRootKeyUsesWindowInsert(t *testing.T) {
+	c := qt.New(t)
+	mb := make(memBacking)
+	policy := dbrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	}
+	ctx := context.Background()
+	_, id1, err := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(windowBacking{mb}, policy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	// Simulate a second instance that queried the database
+	// before the first key was inserted.
+	b := staleBacking{windowBacking{mb}}
+	_, id2, err := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, policy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(id2), qt.Equals, string(id1))
+	c.Assert(mb, qt.HasLen, 1)
+}
+
+// countingBacking counts the keys inserted into a memBacking. If
+// release is non-nil, FindLatestKey waits for it to be closed; if
+// finding is non-nil, it is closed when FindLatestKey is first
+// called.
+type countingBacking struct {
+	memBacking
+	release chan struct{}
+	finding chan struct{}
+
+	findOnce sync.Once
+
+	mu      sync.Mutex
+	inserts int
+}
+
+func (b *countingBacking) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.memBacking.GetKey(id)
+}
+
+func (b *countingBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	if b.finding != nil {
+		b.findOnce.Do(func() {
+			close(b.finding)
+		})
+	}
+	if b.release != nil {
+		<-b.release
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.memBacking.FindLatestKey(createdAfter, expiresAfter, expiresBefore)
+}
+
+func (b *countingBacking) InsertKey(key dbrootkeystore.RootKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inserts++
+	return b.memBacking.InsertKey(key)
+}
+
+// cancelBacking is a ContextBacking on a memBacking whose first
+// FindLatestKeyContext call closes finding and then waits for its
+// context to be cancelled.
+type cancelBacking struct {
+	memBacking
+	finding chan struct{}
+
+	mu      sync.Mutex
+	started bool
+}
+
+func (b *cancelBacking) GetKeyContext(_ context.Context, id []byte) (dbrootkeystore.RootKey, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.memBacking.GetKey(id)
+}
+
+func (b *cancelBacking) FindLatestKeyContext(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	b.mu.Lock()
+	first := !b.started
+	b.started = true
+	b.mu.Unlock()
+	if first {
+		close(b.finding)
+		<-ctx.Done()
+		return dbrootkeystore.RootKey{}, ctx.Err()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.memBacking.FindLatestKey(createdAfter, expiresAfter, expiresBefore)
+}
+
+func (b *cancelBacking) InsertKeyContext(_ context.Context, key dbrootkeystore.RootKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.memBacking.InsertKey(key)
+}
+
+// windowBacking implements dbrootkeystore.WindowInsertBacking
+// on a memBacking.
+type windowBacking struct {
+	memBacking
+}
+
+func (b windowBacking) InsertKeyIfNoneInWindow(_ context.Context, key dbrootkeystore.RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	existing, _ := b.memBacking.FindLatestKey(createdAfter, expiresAfter, expiresBefore)
+	if existing.IsValid() {
+		return existing, nil
+	}
+	if err := b.memBacking.InsertKey(key); err != nil {
+		return dbrootkeystore.RootKey{}, err
+	}
+	return key, nil
+}
+
+// staleBacking never finds any keys with FindLatestKey.
+type staleBacking struct {
+	windowBacking
+}
+
+func (staleBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	return dbrootkeystore.RootKey{}, nil
+}
+
 type contextBacking struct {
 	b dbrootkeystore.Backing
 }
@@ -486,7 +975,8 @@ func (b memBacking) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
 func (b memBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
 	var best dbrootkeystore.RootKey
 	for _, k := range b {
-		if afterEq(k.Created, createdAfter) &&
+		if k.IsValid() &&
+			afterEq(k.Created, createdAfter) &&
 			afterEq(k.Expires, expiresAfter) &&
 			beforeEq(k.Expires, expiresBefore) &&
 			k.Created.After(best.Created) {
@@ -498,12 +988,53 @@ func (b memBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time
 
 func (b memBacking) InsertKey(key dbrootkeystore.RootKey) error {
 	if _, ok := b[string(key.Id)]; ok {
-		return errgo.Newf("duplicate key")
+		return errgo.WithCausef(nil, dbrootkeystore.ErrKeyExists, "duplicate key")
 	}
 	b[string(key.Id)] = key
 	return nil
 }
 
+func (b memBacking) DeleteExpiredKeys(_ context.Context, before time.Time) error {
+	for id, k := range b {
+		if k.Expires.Before(before) {
+			delete(b, id)
+		}
+	}
+	return nil
+}
+
+func (b memBacking) RevokeKey(_ context.Context, id []byte) error {
+	key, ok := b[string(id)]
+	if !ok {
+		return bakery.ErrNotFound
+	}
+	key.RootKey = nil
+	b[string(id)] = key
+	return nil
+}
+
+func (b memBacking) ForEachKey(_ context.Context, f func(dbrootkeystore.RootKey) error) error {
+	for _, k := range b {
+		if !k.IsValid() {
+			continue
+		}
+		if err := f(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b memBacking) UpdateKey(_ context.Context, key dbrootkeystore.RootKey) error {
+	k, ok := b[string(key.Id)]
+	if !ok || !k.IsValid() {
+		return bakery.ErrNotFound
+	}
+	k.RootKey = key.RootKey
+	b[string(key.Id)] = k
+	return nil
+}
+
 func clockVal(t *time.Time) dbrootkeystore.Clock {
 	return clockFunc(func() time.Time {
 		return *t
@@ -531,3 +1062,23 @@ func stoppedClock(t time.Time) dbrootkeystore.Clock {
 		return t
 	})
 }
+
+func TestRootKeyExpiry(t *testing.T) {
+	c := qt.New(t)
+	b := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("id"),
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		RootKey: []byte("key"),
+	}})
+	store := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, dbrootkeystore.Policy{
+		ExpiryDuration: time.Hour,
+	})
+	expirer, ok := store.(bakery.RootKeyExpirer)
+	c.Assert(ok, qt.Equals, true)
+	expires, err := expirer.RootKeyExpiry(context.Background(), []byte("id"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expires, qt.DeepEquals, epoch.Add(time.Hour))
+	_, err = expirer.RootKeyExpiry(context.Background(), []byte("missing"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
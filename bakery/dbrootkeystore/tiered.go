@@ -0,0 +1,345 @@
+package dbrootkeystore
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// MintPolicy specifies which tiers of a TieredBacking may provide
+// keys used to mint new macaroons when the primary is unavailable.
+type MintPolicy int
+
+const (
+	// MintPrimary specifies that keys used for minting must
+	// come from the primary. When the primary is unavailable,
+	// existing macaroons can still be verified but new ones
+	// cannot be minted.
+	MintPrimary MintPolicy = iota
+
+	// MintExisting specifies that when the primary is
+	// unavailable, existing keys found in the other tiers may be
+	// used for minting, but new keys are only ever inserted into
+	// the primary.
+	MintExisting
+
+	// MintAny specifies that when the primary is unavailable,
+	// existing keys found in the other tiers may be used for
+	// minting and new keys may be inserted into the first other
+	// tier that accepts them. Such keys are copied into the
+	// primary when they are next looked up after it recovers, but
+	// until then they will not be visible to clients that do not
+	// use that tier.
+	MintAny
+)
+
+// TieredParams holds the parameters for NewTieredBacking.
+type TieredParams struct {
+	// Primary holds the backing that keys are read from
+	// and inserted into by preference.
+	Primary Backing
+
+	// Secondaries holds backings that are consulted in order
+	// when the primary returns an error other than one with a
+	// bakery.ErrNotFound cause (or any error when Mint is
+	// MintAny), for example replicas of the primary database.
+	Secondaries []Backing
+
+	// Cache optionally holds a backing that acts as a persistent
+	// cache. All keys read from or inserted into the primary are
+	// also inserted into it, and it is consulted after the
+	// secondaries. It should implement RevocationBacking so that
+	// keys revoked in the primary are also revoked in the cache,
+	// and its InsertKey should return an ErrKeyExists error for
+	// keys that it already holds.
+	Cache Backing
+
+	// Mint holds the policy that determines which tiers may
+	// provide keys used to mint new macaroons.
+	Mint MintPolicy
+
+	// Logger is used to log errors from tiers other than the
+	// primary that do not cause the operation to fail. If it is
+	// nil, bakery.DefaultLogger("bakery.dbrootkeystore") is used.
+	Logger bakery.Logger
+}
+
+// TieredBacking is a Backing that reads keys from a primary backing,
+// falling back to other tiers when the primary is unavailable, so
+// that existing macaroons can still be verified during a database
+// failover.
+//
+// A TieredBacking also implements ContextBacking, RevocationBacking,
+// ExpiryBacking and WindowInsertBacking. Revocation and expiry are
+// applied to the primary and to the cache, and the primary must
+// support them.
+type TieredBacking struct {
+	primary ContextBacking
+	p       TieredParams
+	// fallbacks holds the secondaries followed by the cache.
+	fallbacks []ContextBacking
+	cache     ContextBacking
+	logger    bakery.Logger
+}
+
+var _ Backing = (*TieredBacking)(nil)
+var _ ContextBacking = (*TieredBacking)(nil)
+var _ RevocationBacking = (*TieredBacking)(nil)
+var _ ExpiryBacking = (*TieredBacking)(nil)
+var _ WindowInsertBacking = (*TieredBacking)(nil)
+
+// NewTieredBacking returns a Backing that combines the backings in p.
+func NewTieredBacking(p TieredParams) (*TieredBacking, error) {
+	if p.Primary == nil {
+		return nil, errgo.Newf("no primary backing provided")
+	}
+	b := &TieredBacking{
+		primary: contextBacking(p.Primary),
+		p:       p,
+		logger:  p.Logger,
+	}
+	if b.logger == nil {
+		b.logger = bakery.DefaultLogger("bakery.dbrootkeystore")
+	}
+	for _, sb := range p.Secondaries {
+		b.fallbacks = append(b.fallbacks, contextBacking(sb))
+	}
+	if p.Cache != nil {
+		b.cache = contextBacking(p.Cache)
+		b.fallbacks = append(b.fallbacks, b.cache)
+	}
+	return b, nil
+}
+
+// GetKey implements Backing.GetKey.
+func (b *TieredBacking) GetKey(id []byte) (RootKey, error) {
+	return b.GetKeyContext(context.Background(), id)
+}
+
+// GetKeyContext implements ContextBacking.GetKeyContext.
+func (b *TieredBacking) GetKeyContext(ctx context.Context, id []byte) (RootKey, error) {
+	key, err := b.primary.GetKeyContext(ctx, id)
+	if err == nil {
+		if key.IsValid() {
+			b.fillCache(ctx, key)
+		} else {
+			b.revokeCached(ctx, id)
+		}
+		return key, nil
+	}
+	if errgo.Cause(err) == bakery.ErrNotFound && b.p.Mint == MintAny {
+		return b.restoreKey(ctx, id, err)
+	}
+	if !b.shouldFallBack(ctx, err) {
+		return RootKey{}, errgo.Mask(err, errgo.Is(bakery.ErrNotFound))
+	}
+	primaryErr := err
+	for _, fb := range b.fallbacks {
+		key, err := fb.GetKeyContext(ctx, id)
+		if err == nil {
+			return key, nil
+		}
+		if errgo.Cause(err) != bakery.ErrNotFound {
+			b.logger.Infof(ctx, "cannot get root key from fallback backing: %v", err)
+		}
+	}
+	return RootKey{}, errgo.Notef(primaryErr, "cannot get key from primary backing")
+}
+
+// restoreKey looks in the other tiers for the key with the given id,
+// which the primary reported as not found, as it may have been
+// inserted into one of them while the primary was unavailable. If a
+// valid key is found, it is copied into the primary and returned.
+// The notFoundErr argument holds the error returned by the primary.
+func (b *TieredBacking) restoreKey(ctx context.Context, id []byte, notFoundErr error) (RootKey, error) {
+	for _, fb := range b.fallbacks {
+		key, err := fb.GetKeyContext(ctx, id)
+		if err != nil {
+			if errgo.Cause(err) != bakery.ErrNotFound {
+				b.logger.Infof(ctx, "cannot get root key from fallback backing: %v", err)
+			}
+			continue
+		}
+		if !key.IsValid() {
+			continue
+		}
+		err = b.primary.InsertKeyContext(ctx, key)
+		if err == nil {
+			b.fillCache(ctx, key)
+			return key, nil
+		}
+		if errgo.Cause(err) == ErrKeyExists {
+			// The primary holds the key but reported it
+			// as not found, which means that it has been
+			// revoked.
+			b.revokeCached(ctx, id)
+			break
+		}
+		return RootKey{}, errgo.Notef(err, "cannot restore key to primary backing")
+	}
+	return RootKey{}, errgo.Mask(notFoundErr, errgo.Is(bakery.ErrNotFound))
+}
+
+// FindLatestKey implements Backing.FindLatestKey.
+func (b *TieredBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error) {
+	return b.FindLatestKeyContext(context.Background(), createdAfter, expiresAfter, expiresBefore)
+}
+
+// FindLatestKeyContext implements ContextBacking.FindLatestKeyContext.
+// If the primary is unavailable and the mint policy is not
+// MintPrimary, the first valid key found in the other tiers
+// is returned.
+func (b *TieredBacking) FindLatestKeyContext(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error) {
+	key, err := b.primary.FindLatestKeyContext(ctx, createdAfter, expiresAfter, expiresBefore)
+	if err == nil {
+		if key.IsValid() {
+			b.fillCache(ctx, key)
+		}
+		return key, nil
+	}
+	if b.p.Mint == MintPrimary || !b.shouldFallBack(ctx, err) {
+		return RootKey{}, errgo.Mask(err)
+	}
+	primaryErr := err
+	for _, fb := range b.fallbacks {
+		key, err := fb.FindLatestKeyContext(ctx, createdAfter, expiresAfter, expiresBefore)
+		if err != nil {
+			b.logger.Infof(ctx, "cannot find root key in fallback backing: %v", err)
+			continue
+		}
+		if key.IsValid() {
+			return key, nil
+		}
+	}
+	if b.p.Mint == MintAny {
+		// Allow a new key to be created in another tier.
+		return RootKey{}, nil
+	}
+	return RootKey{}, errgo.Notef(primaryErr, "cannot query primary backing")
+}
+
+// InsertKey implements Backing.InsertKey.
+func (b *TieredBacking) InsertKey(key RootKey) error {
+	return b.InsertKeyContext(context.Background(), key)
+}
+
+// InsertKeyContext implements ContextBacking.InsertKeyContext.
+// If the primary is unavailable and the mint policy is MintAny,
+// the key is inserted into the first other tier that accepts it.
+func (b *TieredBacking) InsertKeyContext(ctx context.Context, key RootKey) error {
+	err := b.primary.InsertKeyContext(ctx, key)
+	if err == nil {
+		b.fillCache(ctx, key)
+		return nil
+	}
+	return b.insertFallback(ctx, key, err)
+}
+
+// InsertKeyIfNoneInWindow implements
+// WindowInsertBacking.InsertKeyIfNoneInWindow. If the primary does not
+// implement WindowInsertBacking, the key is inserted unconditionally.
+func (b *TieredBacking) InsertKeyIfNoneInWindow(ctx context.Context, key RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error) {
+	wb, ok := b.p.Primary.(WindowInsertBacking)
+	if !ok {
+		if err := b.InsertKeyContext(ctx, key); err != nil {
+			return RootKey{}, errgo.Mask(err)
+		}
+		return key, nil
+	}
+	got, err := wb.InsertKeyIfNoneInWindow(ctx, key, createdAfter, expiresAfter, expiresBefore)
+	if err == nil {
+		b.fillCache(ctx, got)
+		return got, nil
+	}
+	if err := b.insertFallback(ctx, key, err); err != nil {
+		return RootKey{}, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// insertFallback inserts the given key into the first fallback tier
+// that accepts it if the mint policy allows it. The primaryErr
+// argument holds the error returned when inserting into the primary.
+func (b *TieredBacking) insertFallback(ctx context.Context, key RootKey, primaryErr error) error {
+	if b.p.Mint != MintAny || !b.shouldFallBack(ctx, primaryErr) {
+		return errgo.Mask(primaryErr, errgo.Is(ErrKeyExists))
+	}
+	for _, fb := range b.fallbacks {
+		err := fb.InsertKeyContext(ctx, key)
+		if err == nil {
+			return nil
+		}
+		b.logger.Infof(ctx, "cannot insert root key into fallback backing: %v", err)
+	}
+	return errgo.Notef(primaryErr, "cannot insert key into primary backing")
+}
+
+// RevokeKey implements RevocationBacking.RevokeKey.
+func (b *TieredBacking) RevokeKey(ctx context.Context, id []byte) error {
+	rb, ok := b.p.Primary.(RevocationBacking)
+	if !ok {
+		return errgo.Newf("backing does not support revoking keys")
+	}
+	if err := rb.RevokeKey(ctx, id); err != nil {
+		return errgo.Mask(err, errgo.Is(bakery.ErrNotFound))
+	}
+	b.revokeCached(ctx, id)
+	return nil
+}
+
+// DeleteExpiredKeys implements ExpiryBacking.DeleteExpiredKeys.
+func (b *TieredBacking) DeleteExpiredKeys(ctx context.Context, before time.Time) error {
+	eb, ok := b.p.Primary.(ExpiryBacking)
+	if !ok {
+		return errgo.Newf("backing does not support deleting expired keys")
+	}
+	if err := eb.DeleteExpiredKeys(ctx, before); err != nil {
+		return errgo.Mask(err)
+	}
+	if eb, ok := b.p.Cache.(ExpiryBacking); ok {
+		if err := eb.DeleteExpiredKeys(ctx, before); err != nil {
+			b.logger.Infof(ctx, "cannot delete expired root keys from cache backing: %v", err)
+		}
+	}
+	return nil
+}
+
+// shouldFallBack reports whether the other tiers should be consulted
+// after the primary returned the given error.
+func (b *TieredBacking) shouldFallBack(ctx context.Context, err error) bool {
+	switch errgo.Cause(err) {
+	case bakery.ErrNotFound, ErrKeyExists:
+		return false
+	}
+	return ctx.Err() == nil
+}
+
+// fillCache writes the given key through to the cache tier, if any.
+// A key that is already in the cache is left alone: key ids are
+// never reused, so the cached copy can only differ by having been
+// revoked.
+func (b *TieredBacking) fillCache(ctx context.Context, key RootKey) {
+	if b.cache == nil {
+		return
+	}
+	err := b.cache.InsertKeyContext(ctx, key)
+	if err != nil && errgo.Cause(err) != ErrKeyExists {
+		b.logger.Infof(ctx, "cannot add root key to cache backing: %v", err)
+	}
+}
+
+// revokeCached revokes the key with the given id in the cache tier,
+// if any, so that the cache cannot serve a key that has been revoked
+// in the primary.
+func (b *TieredBacking) revokeCached(ctx context.Context, id []byte) {
+	rb, ok := b.p.Cache.(RevocationBacking)
+	if !ok {
+		return
+	}
+	if err := rb.RevokeKey(ctx, id); err != nil && errgo.Cause(err) != bakery.ErrNotFound {
+		b.logger.Infof(ctx, "cannot revoke root key in cache backing: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package dbrootkeystore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+var tieredPolicy = dbrootkeystore.Policy{
+	ExpiryDuration: 5 * time.Minute,
+}
+
+func TestTieredGetFallsBack(t *testing.T) {
+	c := qt.New(t)
+	primary := &downBacking{memBacking: make(memBacking)}
+	secondary := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("replicated"),
+		Created: epoch,
+		Expires: epoch.Add(5 * time.Minute),
+		RootKey: []byte("replicated key"),
+	}})
+	cache := make(memBacking)
+	b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+		Primary:     primary,
+		Secondaries: []dbrootkeystore.Backing{secondary},
+		Cache:       cache,
+	})
+	c.Assert(err, qt.Equals, nil)
+	ctx := context.Background()
+	key, id, err := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, tieredPolicy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(primary.memBacking, qt.HasLen, 1)
+	c.Assert(cache[string(id)].RootKey, qt.DeepEquals, key)
+
+	// With the primary down, keys can still be
+	// obtained from the other tiers.
+	primary.down = true
+	store := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, tieredPolicy)
+	got, err := store.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.DeepEquals, key)
+	got, err = store.Get(ctx, []byte("replicated"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(got), qt.Equals, "replicated key")
+
+	_, err = store.Get(ctx, []byte("unknown"))
+	c.Assert(err, qt.ErrorMatches, `cannot get key from primary backing: database unavailable`)
+}
+
+func TestTieredGetNotFoundInPrimary(t *testing.T) {
+	c := qt.New(t)
+	secondary := memBackingWithKeys([]dbrootkeystore.RootKey{{
+		Id:      []byte("id"),
+		Created: epoch,
+		Expires: epoch.Add(5 * time.Minute),
+		RootKey: []byte("key"),
+	}})
+	b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+		Primary:     make(memBacking),
+		Secondaries: []dbrootkeystore.Backing{secondary},
+	})
+	c.Assert(err, qt.Equals, nil)
+	// The primary is authoritative when it is available.
+	_, err = b.GetKey([]byte("id"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+}
+
+var tieredMintTests = []struct {
+	about        string
+	mint         dbrootkeystore.MintPolicy
+	cacheKeys    []dbrootkeystore.RootKey
+	expectId     string
+	expectError  string
+	expectInsert bool
+}{{
+	about:       "primary only",
+	mint:        dbrootkeystore.MintPrimary,
+	cacheKeys:   []dbrootkeystore.RootKey{validTieredKey},
+	expectError: `cannot query existing keys: database unavailable`,
+}, {
+	about:     "existing key",
+	mint:      dbrootkeystore.MintExisting,
+	cacheKeys: []dbrootkeystore.RootKey{validTieredKey},
+	expectId:  "cached",
+}, {
+	about:       "no existing key",
+	mint:        dbrootkeystore.MintExisting,
+	expectError: `cannot query existing keys: cannot query primary backing: database unavailable`,
+}, {
+	about:        "any tier",
+	mint:         dbrootkeystore.MintAny,
+	expectInsert: true,
+}}
+
+var validTieredKey = dbrootkeystore.RootKey{
+	Id:      []byte("cached"),
+	Created: epoch,
+	Expires: epoch.Add(5 * time.Minute),
+	RootKey: []byte("cached key"),
+}
+
+func TestTieredMintPolicy(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range tieredMintTests {
+		c.Run(test.about, func(c *qt.C) {
+			cache := memBackingWithKeys(test.cacheKeys)
+			b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+				Primary: &downBacking{
+					memBacking: make(memBacking),
+					down:       true,
+				},
+				Cache: cache,
+				Mint:  test.mint,
+			})
+			c.Assert(err, qt.Equals, nil)
+			_, id, err := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, tieredPolicy).RootKey(context.Background())
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			if test.expectInsert {
+				c.Assert(cache, qt.HasLen, 1)
+				c.Assert(cache[string(id)].IsValid(), qt.Equals, true)
+			} else {
+				c.Assert(string(id), qt.Equals, test.expectId)
+			}
+		})
+	}
+}
+
+func TestTieredRevokeRevokesCache(t *testing.T) {
+	c := qt.New(t)
+	primary := make(memBacking)
+	cache := make(memBacking)
+	b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+		Primary: primary,
+		Cache:   cache,
+	})
+	c.Assert(err, qt.Equals, nil)
+	keys := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch))
+	ctx := context.Background()
+	_, id, err := keys.NewStore(b, tieredPolicy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, true)
+
+	err = keys.Revoke(ctx, b, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(primary[string(id)].IsValid(), qt.Equals, false)
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, false)
+}
+
+func TestTieredGetRevokedInPrimary(t *testing.T) {
+	c := qt.New(t)
+	primary := make(memBacking)
+	cache := make(memBacking)
+	b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+		Primary: primary,
+		Cache:   cache,
+	})
+	c.Assert(err, qt.Equals, nil)
+	ctx := context.Background()
+	_, id, err := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, tieredPolicy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, true)
+
+	// Revoke the key in the primary without going through the
+	// TieredBacking, as another instance would.
+	err = primary.RevokeKey(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	key, err := b.GetKey(id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key.IsValid(), qt.Equals, false)
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, false)
+}
+
+func TestTieredGetMintedDuringOutage(t *testing.T) {
+	c := qt.New(t)
+	primary := &downBacking{
+		memBacking: make(memBacking),
+		down:       true,
+	}
+	cache := make(memBacking)
+	b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+		Primary: primary,
+		Cache:   cache,
+		Mint:    dbrootkeystore.MintAny,
+	})
+	c.Assert(err, qt.Equals, nil)
+	ctx := context.Background()
+	key, id, err := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, tieredPolicy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(primary.memBacking, qt.HasLen, 0)
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, true)
+
+	// Once the primary has recovered, the key minted
+	// during the outage can still be verified and is
+	// copied into the primary.
+	primary.down = false
+	store := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, tieredPolicy)
+	got, err := store.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.DeepEquals, key)
+	c.Assert(primary.memBacking[string(id)], qt.DeepEquals, cache[string(id)])
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, true)
+}
+
+func TestTieredGetDoesNotRestoreRevokedKey(t *testing.T) {
+	c := qt.New(t)
+	primary := hideRevokedBacking{make(memBacking)}
+	cache := make(memBacking)
+	b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+		Primary: primary,
+		Cache:   cache,
+		Mint:    dbrootkeystore.MintAny,
+	})
+	c.Assert(err, qt.Equals, nil)
+	ctx := context.Background()
+	_, id, err := dbrootkeystore.NewRootKeys(10, stoppedClock(epoch)).NewStore(b, tieredPolicy).RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, true)
+
+	// The primary reports the revoked key as not found, but
+	// still holds it, so the cached copy is not restored.
+	err = primary.RevokeKey(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	_, err = b.GetKey(id)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+	c.Assert(primary.memBacking[string(id)].IsValid(), qt.Equals, false)
+	c.Assert(cache[string(id)].IsValid(), qt.Equals, false)
+}
+
+func TestTieredGetWritesThroughToCache(t *testing.T) {
+	c := qt.New(t)
+	key := dbrootkeystore.RootKey{
+		Id:      []byte("id"),
+		Created: epoch,
+		Expires: epoch.Add(5 * time.Minute),
+		RootKey: []byte("key"),
+	}
+	cache := make(memBacking)
+	b, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{
+		Primary: memBackingWithKeys([]dbrootkeystore.RootKey{key}),
+		Cache: &funcBacking{
+			Backing: cache,
+			getKey: func(id []byte) (dbrootkeystore.RootKey, error) {
+				c.Errorf("unexpected cache read of %q", id)
+				return cache.GetKey(id)
+			},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	for i := 0; i < 2; i++ {
+		got, err := b.GetKey(key.Id)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(got, qt.DeepEquals, key)
+		c.Assert(cache["id"], qt.DeepEquals, key)
+	}
+}
+
+func TestNewTieredBackingWithoutPrimary(t *testing.T) {
+	c := qt.New(t)
+	_, err := dbrootkeystore.NewTieredBacking(dbrootkeystore.TieredParams{})
+	c.Assert(err, qt.ErrorMatches, `no primary backing provided`)
+}
+
+// downBacking is a memBacking that returns an error from
+// all operations when down is true.
+type downBacking struct {
+	memBacking
+	down bool
+}
+
+var errDown = errgo.New("database unavailable")
+
+func (b *downBacking) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
+	if b.down {
+		return dbrootkeystore.RootKey{}, errDown
+	}
+	return b.memBacking.GetKey(id)
+}
+
+func (b *downBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	if b.down {
+		return dbrootkeystore.RootKey{}, errDown
+	}
+	return b.memBacking.FindLatestKey(createdAfter, expiresAfter, expiresBefore)
+}
+
+func (b *downBacking) InsertKey(key dbrootkeystore.RootKey) error {
+	if b.down {
+		return errDown
+	}
+	return b.memBacking.InsertKey(key)
+}
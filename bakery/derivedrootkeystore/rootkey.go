@@ -0,0 +1,208 @@
+// Package derivedrootkeystore provides an implementation of
+// bakery.RootKeyStore that needs no persistent storage. Root keys are
+// derived from a master secret and an id that encodes the time period
+// in which the key was created, so any service instance that shares
+// the master secret can recompute the key for a given id.
+package derivedrootkeystore
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+// keyLen holds the length of the derived root keys.
+const keyLen = 24
+
+// minSecretLen holds the minimum length of a master secret.
+const minSecretLen = 32
+
+// hkdfInfo is used as a prefix for the HKDF info parameter so that
+// keys derived here are distinct from any other use of the same
+// master secret.
+const hkdfInfo = "macaroon-bakery derived root key "
+
+// Secret holds a master secret used to derive root keys.
+type Secret struct {
+	// Version identifies the secret. It is encoded in the ids of
+	// the root keys derived from it so that the right secret can
+	// be found when the key is looked up. Versions must be unique.
+	Version uint32
+
+	// Secret holds the secret itself. It must be at least
+	// 32 bytes long.
+	Secret []byte
+}
+
+// Params holds the parameters for New.
+type Params struct {
+	// Secrets holds the master secrets. The first is used to derive
+	// new root keys; all of them can be used to look up existing
+	// ones. When rotating secrets, the old secret should be kept
+	// after the new one for at least GenerateInterval +
+	// ExpiryDuration so that existing macaroons remain valid.
+	Secrets []Secret
+
+	// GenerateInterval holds the length of each time period.
+	// All calls to RootKey within the same period return the
+	// same key. If this is zero, it defaults to ExpiryDuration.
+	GenerateInterval time.Duration
+
+	// ExpiryDuration holds the minimum length of time that
+	// root keys will be valid for after they are returned from
+	// RootKey. The maximum length of time that they
+	// will be valid for is ExpiryDuration + GenerateInterval.
+	ExpiryDuration time.Duration
+
+	// Clock is used to find the current time. If it is nil,
+	// time.Now will be used.
+	Clock dbrootkeystore.Clock
+}
+
+// New returns a new RootKeyStore that derives its root keys
+// from the master secrets in p.
+func New(p Params) (bakery.RootKeyStore, error) {
+	if len(p.Secrets) == 0 {
+		return nil, errgo.Newf("no master secrets provided")
+	}
+	if p.ExpiryDuration <= 0 {
+		return nil, errgo.Newf("expiry duration must be positive")
+	}
+	if p.GenerateInterval < 0 {
+		return nil, errgo.Newf("generate interval must not be negative")
+	}
+	if p.GenerateInterval == 0 {
+		p.GenerateInterval = p.ExpiryDuration
+	}
+	if p.Clock == nil {
+		p.Clock = wallClock{}
+	}
+	s := &store{
+		p:       p,
+		secrets: make(map[uint32][]byte),
+	}
+	for _, secret := range p.Secrets {
+		if _, ok := s.secrets[secret.Version]; ok {
+			return nil, errgo.Newf("duplicate master secret version %d", secret.Version)
+		}
+		if len(secret.Secret) < minSecretLen {
+			return nil, errgo.Newf("master secret version %d too short (got %d bytes, need at least %d)", secret.Version, len(secret.Secret), minSecretLen)
+		}
+		s.secrets[secret.Version] = secret.Secret
+	}
+	return s, nil
+}
+
+type store struct {
+	p       Params
+	secrets map[uint32][]byte
+}
+
+// Get implements bakery.RootKeyStore.Get by deriving the
+// key for the given id. It returns bakery.ErrNotFound if the
+// id is malformed, refers to an unknown secret or to a time
+// period that is outside the validity window.
+func (s *store) Get(_ context.Context, id []byte) ([]byte, error) {
+	version, epoch, ok := parseId(id)
+	if !ok {
+		return nil, bakery.ErrNotFound
+	}
+	secret, ok := s.secrets[version]
+	if !ok {
+		return nil, bakery.ErrNotFound
+	}
+	now := s.p.Clock.Now()
+	if epoch > s.epoch(now) {
+		// The key would not have been created yet.
+		return nil, bakery.ErrNotFound
+	}
+	if now.After(s.expiryTime(epoch)) {
+		return nil, bakery.ErrNotFound
+	}
+	return deriveKey(secret, id)
+}
+
+// RootKey implements bakery.RootKeyStore.RootKey by deriving
+// the key for the current time period from the first secret.
+func (s *store) RootKey(context.Context) ([]byte, []byte, error) {
+	secret := s.p.Secrets[0]
+	id := makeId(secret.Version, s.epoch(s.p.Clock.Now()))
+	key, err := deriveKey(secret.Secret, id)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return key, id, nil
+}
+
+// epoch returns the number of the time period containing t.
+func (s *store) epoch(t time.Time) int64 {
+	n := t.UnixNano()
+	e := n / int64(s.p.GenerateInterval)
+	if n < 0 && n%int64(s.p.GenerateInterval) != 0 {
+		// Round towards negative infinity.
+		e--
+	}
+	return e
+}
+
+// expiryTime returns the time that keys created in the
+// given time period expire.
+func (s *store) expiryTime(epoch int64) time.Time {
+	return time.Unix(0, (epoch+1)*int64(s.p.GenerateInterval)).Add(s.p.ExpiryDuration)
+}
+
+// makeId returns the root key id for the given secret version and
+// time period. It's textual so that it can be used in macaroon ids
+// that must be valid UTF-8.
+func makeId(version uint32, epoch int64) []byte {
+	return []byte(fmt.Sprintf("%d-%d", version, epoch))
+}
+
+// parseId parses an id created by makeId.
+func parseId(id []byte) (version uint32, epoch int64, ok bool) {
+	i := strings.IndexByte(string(id), '-')
+	if i == -1 {
+		return 0, 0, false
+	}
+	v, err := strconv.ParseUint(string(id[:i]), 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	e, err := strconv.ParseInt(string(id[i+1:]), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if string(makeId(uint32(v), e)) != string(id) {
+		// Reject non-canonical forms such as leading zeros
+		// so that each key has exactly one id.
+		return 0, 0, false
+	}
+	return uint32(v), e, true
+}
+
+// deriveKey derives the root key with the given id from
+// the given master secret.
+func deriveKey(secret, id []byte) ([]byte, error) {
+	r := hkdf.New(sha256.New, secret, nil, append([]byte(hkdfInfo), id...))
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, errgo.Notef(err, "cannot derive root key")
+	}
+	return key, nil
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,216 @@
+package derivedrootkeystore_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+	"gopkg.in/macaroon-bakery.v2/bakery/derivedrootkeystore"
+)
+
+var epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	secret1 = derivedrootkeystore.Secret{
+		Version: 1,
+		Secret:  bytes.Repeat([]byte{1}, 32),
+	}
+	secret2 = derivedrootkeystore.Secret{
+		Version: 2,
+		Secret:  bytes.Repeat([]byte{2}, 32),
+	}
+)
+
+var newErrorTests = []struct {
+	about       string
+	params      derivedrootkeystore.Params
+	expectError string
+}{{
+	about: "no secrets",
+	params: derivedrootkeystore.Params{
+		ExpiryDuration: time.Minute,
+	},
+	expectError: `no master secrets provided`,
+}, {
+	about: "no expiry duration",
+	params: derivedrootkeystore.Params{
+		Secrets: []derivedrootkeystore.Secret{secret1},
+	},
+	expectError: `expiry duration must be positive`,
+}, {
+	about: "negative generate interval",
+	params: derivedrootkeystore.Params{
+		Secrets:          []derivedrootkeystore.Secret{secret1},
+		ExpiryDuration:   time.Minute,
+		GenerateInterval: -time.Minute,
+	},
+	expectError: `generate interval must not be negative`,
+}, {
+	about: "duplicate secret",
+	params: derivedrootkeystore.Params{
+		Secrets:        []derivedrootkeystore.Secret{secret1, secret1},
+		ExpiryDuration: time.Minute,
+	},
+	expectError: `duplicate master secret version 1`,
+}, {
+	about: "short secret",
+	params: derivedrootkeystore.Params{
+		Secrets: []derivedrootkeystore.Secret{{
+			Version: 3,
+			Secret:  []byte("short"),
+		}},
+		ExpiryDuration: time.Minute,
+	},
+	expectError: `master secret version 3 too short \(got 5 bytes, need at least 32\)`,
+}}
+
+func TestNewError(t *testing.T) {
+	c := qt.New(t)
+	for i, test := range newErrorTests {
+		c.Logf("test %d: %v", i, test.about)
+		store, err := derivedrootkeystore.New(test.params)
+		c.Assert(err, qt.ErrorMatches, test.expectError)
+		c.Assert(store, qt.IsNil)
+	}
+}
+
+func TestRootKey(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	store := newStore(c, &now, secret1)
+	ctx := context.Background()
+
+	key, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key, qt.HasLen, 24)
+
+	// Within the generate interval, the same key is returned.
+	now = epoch.Add(time.Minute + 59*time.Second)
+	key1, id1, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.DeepEquals, key)
+	c.Assert(id1, qt.DeepEquals, id)
+
+	// A different instance with the same secret derives
+	// the same key.
+	key1, id1, err = newStore(c, &now, secret1).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.DeepEquals, key)
+	c.Assert(id1, qt.DeepEquals, id)
+
+	// After the generate interval, a new key is returned.
+	now = epoch.Add(2 * time.Minute)
+	key1, id1, err = store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.Not(qt.DeepEquals), key)
+	c.Assert(id1, qt.Not(qt.DeepEquals), id)
+
+	// A different secret derives a different key.
+	key2, _, err := newStore(c, &now, secret2).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key2, qt.Not(qt.DeepEquals), key1)
+}
+
+func TestGet(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	store := newStore(c, &now, secret1)
+	ctx := context.Background()
+
+	key, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	// The key is valid until the end of the generate
+	// interval plus the expiry duration.
+	now = epoch.Add(7 * time.Minute)
+	key1, err := store.Get(ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.DeepEquals, key)
+
+	now = epoch.Add(7*time.Minute + time.Nanosecond)
+	key1, err = store.Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	c.Assert(key1, qt.IsNil)
+}
+
+func TestGetFutureKey(t *testing.T) {
+	c := qt.New(t)
+	now := epoch.Add(time.Hour)
+	_, id, err := newStore(c, &now, secret1).RootKey(context.Background())
+	c.Assert(err, qt.IsNil)
+
+	now = epoch
+	_, err = newStore(c, &now, secret1).Get(context.Background(), id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func TestGetInvalidId(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	store := newStore(c, &now, secret1)
+	_, id, err := store.RootKey(context.Background())
+	c.Assert(err, qt.IsNil)
+	for _, badId := range []string{
+		"",
+		"foo",
+		"1-",
+		"-1",
+		"1-x",
+		"01-" + string(id[2:]),
+		"3-" + string(id[2:]),
+	} {
+		_, err := store.Get(context.Background(), []byte(badId))
+		c.Assert(err, qt.Equals, bakery.ErrNotFound, qt.Commentf("id %q", badId))
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	c := qt.New(t)
+	now := epoch
+	ctx := context.Background()
+	oldKey, oldId, err := newStore(c, &now, secret1).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	store := newStore(c, &now, secret2, secret1)
+	key, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(id), qt.Not(qt.Equals), string(oldId))
+	c.Assert(key, qt.Not(qt.DeepEquals), oldKey)
+
+	// Keys derived from the old secret can still be used.
+	key1, err := store.Get(ctx, oldId)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.DeepEquals, oldKey)
+
+	// But not once the old secret has been removed.
+	_, err = newStore(c, &now, secret2).Get(ctx, oldId)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func newStore(c *qt.C, now *time.Time, secrets ...derivedrootkeystore.Secret) bakery.RootKeyStore {
+	store, err := derivedrootkeystore.New(derivedrootkeystore.Params{
+		Secrets:          secrets,
+		GenerateInterval: 2 * time.Minute,
+		ExpiryDuration:   5 * time.Minute,
+		Clock:            clockVal(now),
+	})
+	c.Assert(err, qt.IsNil)
+	return store
+}
+
+func clockVal(t *time.Time) dbrootkeystore.Clock {
+	return clockFunc(func() time.Time {
+		return *t
+	})
+}
+
+type clockFunc func() time.Time
+
+func (f clockFunc) Now() time.Time {
+	return f()
+}
@@ -84,6 +84,12 @@ type DischargeParams struct {
 	// third party caveats returned by the caveat checker.
 	Key *KeyPair
 
+	// KeyRing, if non-nil, is used instead of Key. The caveat is
+	// decrypted with whichever key in the ring it was encrypted
+	// for, and the current key is used to encrypt any additional
+	// third party caveats.
+	KeyRing *KeyRing
+
 	// Checker is used to check the third party caveat,
 	// and may also return further caveats to be added to
 	// the discharge macaroon.
@@ -92,6 +98,11 @@ type DischargeParams struct {
 	// Locator is used to information on third parties
 	// referred to by third party caveats returned by the Checker.
 	Locator ThirdPartyLocator
+
+	// Location, if non-empty, holds the location of the discharger.
+	// Caveats encoded with Version4 or later that were addressed
+	// to a different location will be rejected.
+	Location string
 }
 
 // Discharge creates a macaroon to discharges a third party caveat.
@@ -113,10 +124,18 @@ func Discharge(ctx context.Context, p DischargeParams) (*Macaroon, error) {
 		// for any more ids.
 		caveatIdPrefix = p.Id
 	}
-	cavInfo, err := decodeCaveat(p.Key, p.Caveat)
+	keys := []*KeyPair{p.Key}
+	if p.KeyRing != nil {
+		keys = p.KeyRing.decryptionKeys()
+		p.Key = p.KeyRing.Current()
+	}
+	cavInfo, err := decodeCaveat(keys, p.Caveat)
 	if err != nil {
 		return nil, errgo.Notef(err, "discharger cannot decode caveat id")
 	}
+	if p.Location != "" && cavInfo.Version >= Version4 && cavInfo.Location != p.Location {
+		return nil, errgo.Newf("caveat addressed to %q, not %q", cavInfo.Location, p.Location)
+	}
 	cavInfo.Id = p.Id
 	// Note that we don't check the error - we allow the
 	// third party checker to see even caveats that we can't
@@ -243,6 +262,11 @@ type ThirdPartyCaveatInfo struct {
 	// that created the macaroon, as encoded by the party
 	// that added the third party caveat.
 	Namespace *checkers.Namespace
+
+	// Location holds the location of the third party that
+	// the caveat was addressed to. It is only recorded by
+	// caveats encoded with Version4 or later.
+	Location string
 }
 
 // ThirdPartyCaveatChecker holds a function that checks third party caveats
@@ -427,3 +427,32 @@ func TestThirdPartyDischargeMacaroonIdsAreSmall(t *testing.T) {
 		}
 	}
 }
+
+func TestDischargeChecksLocation(t *testing.T) {
+	c := qt.New(t)
+	locator := bakery.NewThirdPartyStore()
+	as := newBakery("as-loc", locator)
+	ts := newBakery("ts-loc", locator)
+
+	m, err := ts.Oven.NewMacaroon(testContext, bakery.LatestVersion, []checkers.Caveat{{
+		Location:  "as-loc",
+		Condition: "something",
+	}}, basicOp)
+	c.Assert(err, qt.IsNil)
+
+	dischargeAt := func(loc string) error {
+		_, err := bakery.DischargeAll(testContext, m, func(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+			return bakery.Discharge(ctx, bakery.DischargeParams{
+				Key:      as.Oven.Key(),
+				Id:       cav.Id,
+				Caveat:   payload,
+				Checker:  thirdPartyStrcmpChecker("something"),
+				Location: loc,
+			})
+		})
+		return err
+	}
+	c.Assert(dischargeAt("as-loc"), qt.IsNil)
+	c.Assert(dischargeAt(""), qt.IsNil)
+	c.Assert(dischargeAt("other-loc"), qt.ErrorMatches, `cannot get discharge from "as-loc": caveat addressed to "as-loc", not "other-loc"`)
+}
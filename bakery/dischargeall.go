@@ -48,6 +48,18 @@ func DischargeAllWithKey(
 	return discharges.Bind(), nil
 }
 
+// DischargeAllWithParams is like DischargeAllWithKey except that the
+// parameters are taken from p, which allows independent third party
+// caveats to be discharged concurrently (see
+// DischargeAllParams.Concurrency).
+func DischargeAllWithParams(ctx context.Context, m *Macaroon, p DischargeAllParams) (macaroon.Slice, error) {
+	discharges, err := Slice{m}.DischargeAllWithParams(ctx, p)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return discharges.Bind(), nil
+}
+
 var localDischargeChecker = ThirdPartyCaveatCheckerFunc(func(_ context.Context, info *ThirdPartyCaveatInfo) ([]checkers.Caveat, error) {
 	if string(info.Condition) != "true" {
 		return nil, checkers.ErrCaveatNotRecognized
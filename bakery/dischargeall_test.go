@@ -3,7 +3,10 @@ package bakery_test
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"gopkg.in/errgo.v1"
@@ -164,3 +167,221 @@ func TestDischargeAllLocalDischargeVersion1(t *testing.T) {
 	_, err = oc.Checker.Auth(ms).Allow(testContext, basicOp)
 	c.Assert(err, qt.IsNil)
 }
+
+// newDischargeTree returns a macaroon with three third party caveats
+// and a getDischarge function that returns discharge macaroons that
+// each hold two more third party caveats, to the given depth. The
+// discharge of any caveat with an id in failIds fails.
+func newDischargeTree(c *qt.C, depth int, failIds map[string]bool) (*bakery.Macaroon, func(context.Context, macaroon.Caveat, []byte) (*bakery.Macaroon, error)) {
+	addCaveats := func(m *bakery.Macaroon, prefix string, n int) {
+		for i := 0; i < n; i++ {
+			cid := fmt.Sprintf("%s%d", prefix, i)
+			err := m.M().AddThirdPartyCaveat([]byte("root key "+cid), []byte(cid), "loc"+cid)
+			c.Assert(err, qt.IsNil)
+		}
+	}
+	m0, err := bakery.NewMacaroon([]byte("root key"), []byte("root"), "loc0", bakery.LatestVersion, nil)
+	c.Assert(err, qt.IsNil)
+	addCaveats(m0, "id", 3)
+	getDischarge := func(_ context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+		if failIds[string(cav.Id)] {
+			return nil, errgo.Newf("discharge failure on %q", cav.Id)
+		}
+		m, err := bakery.NewMacaroon([]byte("root key "+string(cav.Id)), cav.Id, "", bakery.LatestVersion, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(cav.Id) < len("id")+depth {
+			addCaveats(m, string(cav.Id), 2)
+		}
+		return m, nil
+	}
+	return m0, getDischarge
+}
+
+func macaroonIds(ms macaroon.Slice) []string {
+	ids := make([]string, len(ms))
+	for i, m := range ms {
+		ids[i] = string(m.Id())
+	}
+	return ids
+}
+
+func TestDischargeAllConcurrent(t *testing.T) {
+	c := qt.New(t)
+	m, getDischarge := newDischargeTree(c, 3, nil)
+	ms, err := bakery.DischargeAll(testContext, m, getDischarge)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms, qt.HasLen, 1+3+6+12)
+	expectIds := macaroonIds(ms)
+	c.Assert(expectIds[:6], qt.DeepEquals, []string{"root", "id0", "id1", "id2", "id00", "id01"})
+
+	const concurrency = 3
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	// allStarted is closed when the three top level
+	// caveats are all being discharged at once.
+	allStarted := make(chan struct{})
+	concurrentGetDischarge := func(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+			if maxInFlight == concurrency {
+				close(allStarted)
+			}
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		if len(cav.Id) == len("id0") {
+			select {
+			case <-allStarted:
+			case <-time.After(5 * time.Second):
+				c.Errorf("caveats not discharged concurrently")
+			}
+		}
+		return getDischarge(ctx, cav, payload)
+	}
+	ms, err = bakery.DischargeAllWithParams(testContext, m, bakery.DischargeAllParams{
+		GetDischarge: concurrentGetDischarge,
+		Concurrency:  concurrency,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(macaroonIds(ms), qt.DeepEquals, expectIds)
+	c.Assert(maxInFlight, qt.Equals, concurrency)
+
+	err = ms[0].Verify([]byte("root key"), alwaysOK, ms[1:])
+	c.Assert(err, qt.IsNil)
+}
+
+func TestDischargeAllConcurrentErrors(t *testing.T) {
+	c := qt.New(t)
+	failIds := map[string]bool{
+		"id010": true,
+		"id1":   true,
+		"id21":  true,
+	}
+	m, getDischarge := newDischargeTree(c, 3, failIds)
+	ms0, err0 := bakery.Slice{m}.DischargeAll(testContext, getDischarge, nil)
+	c.Assert(err0, qt.ErrorMatches, `cannot get discharge from "locid1": discharge failure on "id1"; `+
+		`cannot get discharge from "locid21": discharge failure on "id21"; `+
+		`cannot get discharge from "locid010": discharge failure on "id010"`)
+	for i := 0; i < 10; i++ {
+		ms, err := bakery.Slice{m}.DischargeAllWithParams(testContext, bakery.DischargeAllParams{
+			GetDischarge: getDischarge,
+			Concurrency:  4,
+		})
+		// Discharging stops at the first failure, so some
+		// of the discharges and errors may be missing, but
+		// the others are in the same order.
+		c.Assert(err, qt.Not(qt.IsNil))
+		c.Assert(isSubsequence(strings.Split(err.Error(), "; "), strings.Split(err0.Error(), "; ")), qt.Equals, true)
+		c.Assert(isSubsequence(macaroonIds(ms.Bind()), macaroonIds(ms0.Bind())), qt.Equals, true)
+	}
+}
+
+func TestDischargeAllConcurrentErrorOrder(t *testing.T) {
+	c := qt.New(t)
+	m, getDischarge := newDischargeTree(c, 1, map[string]bool{
+		"id0": true,
+		"id1": true,
+	})
+	// Whichever of the two failing discharges completes
+	// first, the errors are reported in caveat order.
+	for _, first := range []string{"id0", "id1"} {
+		c.Run(first+" fails first", func(c *qt.C) {
+			failed := make(chan struct{})
+			ms, err := bakery.Slice{m}.DischargeAllWithParams(testContext, bakery.DischargeAllParams{
+				GetDischarge: func(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+					switch string(cav.Id) {
+					case first:
+						defer close(failed)
+					case "id0", "id1":
+						// Fail after the other discharge
+						// has failed, but not because
+						// this one was cancelled.
+						<-failed
+					}
+					return getDischarge(ctx, cav, payload)
+				},
+				Concurrency: 3,
+			})
+			c.Assert(err, qt.ErrorMatches, `cannot get discharge from "locid0": discharge failure on "id0"; `+
+				`cannot get discharge from "locid1": discharge failure on "id1"`)
+			c.Assert(macaroonIds(ms.Bind())[0], qt.Equals, "root")
+		})
+	}
+}
+
+func TestDischargeAllConcurrentCancelsOnFailure(t *testing.T) {
+	c := qt.New(t)
+	m, getDischarge := newDischargeTree(c, 2, map[string]bool{
+		"id2": true,
+	})
+	var mu sync.Mutex
+	started := make(map[string]bool)
+	ms, err := bakery.Slice{m}.DischargeAllWithParams(testContext, bakery.DischargeAllParams{
+		GetDischarge: func(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+			mu.Lock()
+			started[string(cav.Id)] = true
+			mu.Unlock()
+			if string(cav.Id) == "id0" {
+				// Wait until the discharge is cancelled
+				// because another one has failed.
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(5 * time.Second):
+					c.Errorf("discharge not cancelled")
+				}
+			}
+			return getDischarge(ctx, cav, payload)
+		},
+		Concurrency: 2,
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot get discharge from "locid2": discharge failure on "id2"`)
+	c.Assert(macaroonIds(ms.Bind()), qt.DeepEquals, []string{"root", "id1"})
+	// The caveats in the discharge of id1 are not
+	// discharged after the failure.
+	c.Assert(started, qt.DeepEquals, map[string]bool{
+		"id0": true,
+		"id1": true,
+		"id2": true,
+	})
+}
+
+// isSubsequence reports whether all the elements of a
+// are in b in the same order.
+func isSubsequence(a, b []string) bool {
+	for _, s := range b {
+		if len(a) > 0 && a[0] == s {
+			a = a[1:]
+		}
+	}
+	return len(a) == 0
+}
+
+func TestDischargeAllConcurrentLocalDischarge(t *testing.T) {
+	c := qt.New(t)
+	oc := newBakery("ts", nil)
+	clientKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	m, err := oc.Oven.NewMacaroon(testContext, bakery.LatestVersion, []checkers.Caveat{
+		bakery.LocalThirdPartyCaveat(&clientKey.Public, bakery.LatestVersion),
+		bakery.LocalThirdPartyCaveat(&clientKey.Public, bakery.LatestVersion),
+	}, basicOp)
+	c.Assert(err, qt.IsNil)
+	ms, err := bakery.DischargeAllWithParams(testContext, m, bakery.DischargeAllParams{
+		GetDischarge: noDischarge(c),
+		LocalKey:     clientKey,
+		Concurrency:  2,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms, qt.HasLen, 3)
+	_, err = oc.Checker.Auth(ms).Allow(testContext, basicOp)
+	c.Assert(err, qt.IsNil)
+}
@@ -16,6 +16,18 @@ var (
 	// ErrPermissionDenied is returned from AuthChecker when
 	// permission has been denied.
 	ErrPermissionDenied = errgo.New("permission denied")
+
+	// ErrPublicKeyChanged is returned by
+	// FileThirdPartyStore.AddInfo when trust-on-first-use is
+	// enabled and the public key of a third party differs from
+	// the one previously recorded.
+	ErrPublicKeyChanged = errgo.New("public key changed")
+
+	// ErrVersionDowngraded is returned by
+	// FileThirdPartyStore.AddInfo when trust-on-first-use is
+	// enabled and the bakery version of a third party is
+	// earlier than the one previously recorded.
+	ErrVersionDowngraded = errgo.New("version downgraded")
 )
 
 // DischargeRequiredError is returned when authorization has failed and a
@@ -11,3 +11,10 @@ func MacaroonCaveatData(m *Macaroon) map[string][]byte {
 var LegacyNamespace = legacyNamespace
 
 type MacaroonJSON macaroonJSON
+
+func VerificationCacheLen(o *Oven) int {
+	if o.verifyCache == nil {
+		return 0
+	}
+	return o.verifyCache.len()
+}
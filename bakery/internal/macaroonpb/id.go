@@ -17,3 +17,8 @@ func (id *MacaroonId) MarshalBinary() ([]byte, error) {
 func (id *MacaroonId) UnmarshalBinary(data []byte) error {
 	return proto.Unmarshal(data, id)
 }
+
+// Size returns the size of the binary encoding of the id.
+func (id *MacaroonId) Size() int {
+	return proto.Size(id)
+}
@@ -11,6 +11,7 @@ It is generated from these files:
 It has these top-level messages:
 	MacaroonId
 	Op
+	CompactOp
 */
 package macaroonpb
 
@@ -30,9 +31,15 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type MacaroonId struct {
-	Nonce     []byte `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
-	StorageId []byte `protobuf:"bytes,2,opt,name=storageId,proto3" json:"storageId,omitempty"`
-	Ops       []*Op  `protobuf:"bytes,3,rep,name=ops" json:"ops,omitempty"`
+	Nonce       []byte            `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	StorageId   []byte            `protobuf:"bytes,2,opt,name=storageId,proto3" json:"storageId,omitempty"`
+	Ops         []*Op             `protobuf:"bytes,3,rep,name=ops" json:"ops,omitempty"`
+	IssuedAt    int64             `protobuf:"varint,4,opt,name=issuedAt" json:"issuedAt,omitempty"`
+	Issuer      string            `protobuf:"bytes,5,opt,name=issuer" json:"issuer,omitempty"`
+	Labels      map[string]string `protobuf:"bytes,6,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	ActionDict  []string          `protobuf:"bytes,7,rep,name=actionDict" json:"actionDict,omitempty"`
+	CompactOps  []*CompactOp      `protobuf:"bytes,8,rep,name=compactOps" json:"compactOps,omitempty"`
+	OpSetDigest []byte            `protobuf:"bytes,9,opt,name=opSetDigest,proto3" json:"opSetDigest,omitempty"`
 }
 
 func (m *MacaroonId) Reset()                    { *m = MacaroonId{} }
@@ -47,6 +54,20 @@ func (m *MacaroonId) GetOps() []*Op {
 	return nil
 }
 
+func (m *MacaroonId) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *MacaroonId) GetCompactOps() []*CompactOp {
+	if m != nil {
+		return m.CompactOps
+	}
+	return nil
+}
+
 type Op struct {
 	Entity  string   `protobuf:"bytes,1,opt,name=entity" json:"entity,omitempty"`
 	Actions []string `protobuf:"bytes,2,rep,name=actions" json:"actions,omitempty"`
@@ -57,24 +78,48 @@ func (m *Op) String() string            { return proto.CompactTextString(m) }
 func (*Op) ProtoMessage()               {}
 func (*Op) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
 
+type CompactOp struct {
+	PrefixLen    uint32   `protobuf:"varint,1,opt,name=prefixLen" json:"prefixLen,omitempty"`
+	EntitySuffix string   `protobuf:"bytes,2,opt,name=entitySuffix" json:"entitySuffix,omitempty"`
+	Actions      []uint32 `protobuf:"varint,3,rep,packed,name=actions" json:"actions,omitempty"`
+}
+
+func (m *CompactOp) Reset()                    { *m = CompactOp{} }
+func (m *CompactOp) String() string            { return proto.CompactTextString(m) }
+func (*CompactOp) ProtoMessage()               {}
+func (*CompactOp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
 func init() {
 	proto.RegisterType((*MacaroonId)(nil), "MacaroonId")
 	proto.RegisterType((*Op)(nil), "Op")
+	proto.RegisterType((*CompactOp)(nil), "CompactOp")
+	proto.RegisterMapType((map[string]string)(nil), "MacaroonId.LabelsEntry")
 }
 
 func init() { proto.RegisterFile("id.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 161 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0xc8, 0x4c, 0xd1, 0x2b,
-	0x28, 0xca, 0x2f, 0xc9, 0x57, 0x0a, 0xe7, 0xe2, 0xf2, 0x4d, 0x4c, 0x4e, 0x2c, 0xca, 0xcf, 0xcf,
-	0xf3, 0x4c, 0x11, 0x12, 0xe1, 0x62, 0xcd, 0xcb, 0xcf, 0x4b, 0x4e, 0x95, 0x60, 0x54, 0x60, 0xd4,
-	0xe0, 0x09, 0x82, 0x70, 0x84, 0x64, 0xb8, 0x38, 0x8b, 0x4b, 0xf2, 0x8b, 0x12, 0xd3, 0x53, 0x3d,
-	0x53, 0x24, 0x98, 0xc0, 0x32, 0x08, 0x01, 0x21, 0x51, 0x2e, 0xe6, 0xfc, 0x82, 0x62, 0x09, 0x66,
-	0x05, 0x66, 0x0d, 0x6e, 0x23, 0x66, 0x3d, 0xff, 0x82, 0x20, 0x10, 0x5f, 0xc9, 0x8c, 0x8b, 0xc9,
-	0xbf, 0x40, 0x48, 0x8c, 0x8b, 0x2d, 0x35, 0xaf, 0x24, 0xb3, 0xa4, 0x12, 0x6c, 0x22, 0x67, 0x10,
-	0x94, 0x27, 0x24, 0xc1, 0xc5, 0x9e, 0x98, 0x5c, 0x92, 0x99, 0x9f, 0x57, 0x2c, 0xc1, 0xa4, 0xc0,
-	0xac, 0xc1, 0x19, 0x04, 0xe3, 0x3a, 0xf1, 0x44, 0x71, 0xe5, 0x42, 0x1d, 0x54, 0x90, 0x94, 0xc4,
-	0x06, 0x76, 0xa5, 0x31, 0x20, 0x00, 0x00, 0xff, 0xff, 0x18, 0x25, 0xab, 0x17, 0xb1, 0x00, 0x00,
-	0x00,
+	// 343 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x52, 0x5f, 0x6b, 0xfa, 0x30,
+	0x14, 0xa5, 0xcd, 0xcf, 0x6a, 0xae, 0x0a, 0x3f, 0xc2, 0xfe, 0x04, 0x19, 0xa3, 0xf4, 0xa9, 0xec,
+	0xa1, 0x83, 0x0d, 0xc6, 0xb6, 0xb7, 0x6d, 0xee, 0x41, 0x70, 0x08, 0xf1, 0x6d, 0x6f, 0xb1, 0x8d,
+	0x12, 0xa6, 0x49, 0x68, 0xe2, 0xd0, 0x0f, 0xbc, 0xef, 0x31, 0x9a, 0x56, 0xed, 0xde, 0xee, 0x39,
+	0xb7, 0x3d, 0xf7, 0xdc, 0x73, 0x03, 0x3d, 0x59, 0x64, 0xa6, 0xd4, 0x4e, 0x27, 0x3f, 0x21, 0xc0,
+	0x07, 0xcf, 0x79, 0xa9, 0xb5, 0x9a, 0x14, 0xe4, 0x0c, 0x3a, 0x4a, 0xab, 0x5c, 0xd0, 0x20, 0x0e,
+	0xd2, 0x01, 0xab, 0x01, 0xb9, 0x02, 0x6c, 0x9d, 0x2e, 0xf9, 0x4a, 0x4c, 0x0a, 0x1a, 0xfa, 0xce,
+	0x89, 0x20, 0xe7, 0x80, 0xb4, 0xb1, 0x14, 0xc5, 0x28, 0xed, 0xdf, 0xa1, 0x6c, 0x66, 0x58, 0x85,
+	0xc9, 0x08, 0x7a, 0xd2, 0xda, 0xad, 0x28, 0x5e, 0x1c, 0xfd, 0x17, 0x07, 0x29, 0x62, 0x47, 0x4c,
+	0x2e, 0x20, 0xf2, 0x75, 0x49, 0x3b, 0x71, 0x90, 0x62, 0xd6, 0x20, 0x72, 0x0b, 0xd1, 0x9a, 0x2f,
+	0xc4, 0xda, 0xd2, 0xc8, 0xab, 0x5d, 0x66, 0x27, 0x6f, 0xd9, 0xd4, 0x77, 0xde, 0x95, 0x2b, 0xf7,
+	0xac, 0xf9, 0x8c, 0x5c, 0x03, 0xf0, 0xdc, 0x49, 0xad, 0xc6, 0x32, 0x77, 0xb4, 0x1b, 0xa3, 0x14,
+	0xb3, 0x16, 0x43, 0x6e, 0x00, 0x72, 0xbd, 0x31, 0x3c, 0x77, 0x33, 0x63, 0x69, 0xcf, 0x8b, 0x42,
+	0xf6, 0x76, 0xa0, 0x58, 0xab, 0x4b, 0x62, 0xe8, 0x6b, 0x33, 0x17, 0x6e, 0x2c, 0x57, 0xc2, 0x3a,
+	0x8a, 0xfd, 0x9e, 0x6d, 0x6a, 0xf4, 0x04, 0xfd, 0x96, 0x09, 0xf2, 0x1f, 0xd0, 0x97, 0xd8, 0xfb,
+	0xa8, 0x30, 0xab, 0xca, 0x2a, 0xbe, 0x6f, 0xbe, 0xde, 0x0a, 0x1f, 0x12, 0x66, 0x35, 0x78, 0x0e,
+	0x1f, 0x83, 0xe4, 0x01, 0xc2, 0x99, 0xa9, 0xf6, 0x16, 0xca, 0x49, 0x77, 0xf8, 0xa9, 0x41, 0x84,
+	0x42, 0xb7, 0x36, 0x6d, 0x69, 0xe8, 0x77, 0x38, 0xc0, 0x64, 0x05, 0xf8, 0xe8, 0xb6, 0xba, 0x83,
+	0x29, 0xc5, 0x52, 0xee, 0xa6, 0x42, 0x79, 0x85, 0x21, 0x3b, 0x11, 0x24, 0x81, 0x41, 0x2d, 0x37,
+	0xdf, 0x2e, 0x97, 0x72, 0xd7, 0x78, 0xf8, 0xc3, 0xb5, 0x07, 0x55, 0xf7, 0x1a, 0x1e, 0x07, 0xbd,
+	0x0e, 0x3e, 0x61, 0xd3, 0x64, 0x6d, 0x16, 0x8b, 0xc8, 0xbf, 0x8e, 0xfb, 0xdf, 0x01, 0x00, 0xe5,
+	0x25, 0xd5, 0xcd, 0x29, 0x02, 0x00, 0x00,
 }
@@ -0,0 +1,121 @@
+package bakery
+
+import (
+	"sync"
+	"time"
+)
+
+// KeyRing holds the key pairs of a third party discharger. One key
+// pair is current: it is the key advertised to other services, so new
+// third party caveats will be encrypted with it. Older key pairs are
+// still used to decrypt caveats until they expire, so that a
+// discharger can rotate its key without invalidating caveats that
+// were encrypted with an earlier key.
+//
+// A KeyRing is safe to use concurrently.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current *KeyPair
+	old     []oldKeyPair
+}
+
+type oldKeyPair struct {
+	key     *KeyPair
+	expires time.Time
+}
+
+// NewKeyRing returns a new key ring with the given current key
+// pair.
+func NewKeyRing(current *KeyPair) *KeyRing {
+	return &KeyRing{
+		current: current,
+	}
+}
+
+// Current returns the current key pair.
+func (r *KeyRing) Current() *KeyPair {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// Rotate makes key the current key pair. The previously current key
+// pair will still be used to decrypt caveats until the given expiry
+// time. If expires is zero, it will be used indefinitely.
+func (r *KeyRing) Rotate(key *KeyPair, expires time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != nil && r.current.Public != key.Public {
+		r.addOld(r.current, expires)
+	}
+	r.current = key
+	r.removeOld(key.Public)
+}
+
+// Add adds a key pair that is no longer current but will still be
+// used to decrypt caveats until the given expiry time. If expires is
+// zero, it will be used indefinitely. This can be used to restore
+// older keys when a discharger restarts. Adding the current key
+// has no effect.
+func (r *KeyRing) Add(key *KeyPair, expires time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != nil && r.current.Public == key.Public {
+		return
+	}
+	r.addOld(key, expires)
+}
+
+// Remove removes the non-current key pair with the given public key
+// from the ring, so that it will no longer be used to decrypt caveats.
+func (r *KeyRing) Remove(pub PublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeOld(pub)
+}
+
+// decryptionKeys returns all the key pairs in the ring that can be
+// used to decrypt caveats, starting with the current key pair.
+func (r *KeyRing) decryptionKeys() []*KeyPair {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	keys := make([]*KeyPair, 0, len(r.old)+1)
+	if r.current != nil {
+		keys = append(keys, r.current)
+	}
+	for _, k := range r.old {
+		if k.expires.IsZero() || now.Before(k.expires) {
+			keys = append(keys, k.key)
+		}
+	}
+	return keys
+}
+
+// addOld adds or updates a non-current key pair, removing any
+// that have expired. It must be called with r.mu held.
+func (r *KeyRing) addOld(key *KeyPair, expires time.Time) {
+	r.removeOld(key.Public)
+	now := time.Now()
+	old := r.old[:0]
+	for _, k := range r.old {
+		if k.expires.IsZero() || now.Before(k.expires) {
+			old = append(old, k)
+		}
+	}
+	r.old = append(old, oldKeyPair{
+		key:     key,
+		expires: expires,
+	})
+}
+
+// removeOld removes the non-current key pair with the given public
+// key. It must be called with r.mu held.
+func (r *KeyRing) removeOld(pub PublicKey) {
+	for i, k := range r.old {
+		if k.key.Public == pub {
+			r.old = append(r.old[:i], r.old[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package bakery_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon.v2"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+)
+
+// newKeyRingCaveatMacaroon returns a macaroon with a third party
+// caveat addressed to "as-loc" encrypted for the given public key
+// with the given bakery version.
+func newKeyRingCaveatMacaroon(c *qt.C, pub bakery.PublicKey, version bakery.Version) *bakery.Macaroon {
+	locator := bakery.NewThirdPartyStore()
+	locator.AddInfo("as-loc", bakery.ThirdPartyInfo{
+		PublicKey: pub,
+		Version:   version,
+	})
+	ts := newBakery("ts-loc", locator)
+	m, err := ts.Oven.NewMacaroon(testContext, version, []checkers.Caveat{{
+		Location:  "as-loc",
+		Condition: "something",
+	}}, basicOp)
+	c.Assert(err, qt.IsNil)
+	return m
+}
+
+func dischargeWithKeyRing(m *bakery.Macaroon, ring *bakery.KeyRing) error {
+	_, err := bakery.DischargeAll(testContext, m, func(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+		return bakery.Discharge(ctx, bakery.DischargeParams{
+			KeyRing: ring,
+			Id:      cav.Id,
+			Caveat:  payload,
+			Checker: thirdPartyStrcmpChecker("something"),
+		})
+	})
+	return err
+}
+
+func TestKeyRingRotate(t *testing.T) {
+	c := qt.New(t)
+	oldKey := mustGenerateKey()
+	newKey := mustGenerateKey()
+	ring := bakery.NewKeyRing(oldKey)
+	c.Assert(ring.Current(), qt.Equals, oldKey)
+
+	ring.Rotate(newKey, time.Now().Add(time.Hour))
+	c.Assert(ring.Current(), qt.Equals, newKey)
+
+	for _, version := range []bakery.Version{
+		bakery.Version1,
+		bakery.Version2,
+		bakery.Version3,
+		bakery.Version4,
+	} {
+		c.Run(fmt.Sprintf("version%d", version), func(c *qt.C) {
+			for _, key := range []*bakery.KeyPair{oldKey, newKey} {
+				m := newKeyRingCaveatMacaroon(c, key.Public, version)
+				c.Assert(dischargeWithKeyRing(m, ring), qt.IsNil)
+			}
+		})
+	}
+}
+
+func TestKeyRingExpiredKey(t *testing.T) {
+	c := qt.New(t)
+	oldKey := mustGenerateKey()
+	ring := bakery.NewKeyRing(oldKey)
+	ring.Rotate(mustGenerateKey(), time.Now().Add(-time.Second))
+
+	m := newKeyRingCaveatMacaroon(c, oldKey.Public, bakery.LatestVersion)
+	err := dischargeWithKeyRing(m, ring)
+	c.Assert(err, qt.ErrorMatches, `cannot get discharge from "as-loc": discharger cannot decode caveat id: public key mismatch`)
+}
+
+func TestKeyRingAddRemove(t *testing.T) {
+	c := qt.New(t)
+	oldKey := mustGenerateKey()
+	ring := bakery.NewKeyRing(mustGenerateKey())
+
+	m := newKeyRingCaveatMacaroon(c, oldKey.Public, bakery.LatestVersion)
+	err := dischargeWithKeyRing(m, ring)
+	c.Assert(err, qt.ErrorMatches, `cannot get discharge from "as-loc": discharger cannot decode caveat id: public key mismatch`)
+
+	// A zero expiry time means that the key does not expire.
+	ring.Add(oldKey, time.Time{})
+	c.Assert(dischargeWithKeyRing(m, ring), qt.IsNil)
+
+	ring.Remove(oldKey.Public)
+	err = dischargeWithKeyRing(m, ring)
+	c.Assert(err, qt.ErrorMatches, `cannot get discharge from "as-loc": discharger cannot decode caveat id: public key mismatch`)
+}
+
+func TestKeyRingAddCurrent(t *testing.T) {
+	c := qt.New(t)
+	key := mustGenerateKey()
+	ring := bakery.NewKeyRing(key)
+
+	// Adding the current key with an expiry time in the past
+	// does not stop it from being used.
+	ring.Add(key, time.Now().Add(-time.Second))
+	c.Assert(ring.Current(), qt.Equals, key)
+	m := newKeyRingCaveatMacaroon(c, key.Public, bakery.LatestVersion)
+	c.Assert(dischargeWithKeyRing(m, ring), qt.IsNil)
+
+	// Removing the current key has no effect either.
+	ring.Remove(key.Public)
+	c.Assert(dischargeWithKeyRing(m, ring), qt.IsNil)
+}
@@ -0,0 +1,134 @@
+package bakery_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon.v2"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+)
+
+// The test vectors in this file are taken from the examples in the
+// libmacaroons README. They check that the signatures, discharge
+// binding and JSON encoding of plain macaroons match those produced
+// by libmacaroons. They do not cover third party caveats added by
+// an Oven, whose ids use the bakery's own encoding (see the TODO
+// file).
+
+func TestLibmacaroonsFirstPartySignatures(t *testing.T) {
+	c := qt.New(t)
+	// secret = 'this is our super secret key; only we should know it'
+	// public = 'we used our secret key'
+	// location = 'http://mybank/'
+	// M = macaroons.create(location, secret, public)
+	m, err := bakery.NewMacaroon(
+		[]byte("this is our super secret key; only we should know it"),
+		[]byte("we used our secret key"),
+		"http://mybank/",
+		bakery.Version1,
+		nil,
+	)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fmt.Sprintf("%x", m.M().Signature()), qt.Equals, "e3d9e02908526c4c0039ae15114115d97fdd68bf2ba379b342aaf0f617d0552f")
+
+	for _, test := range []struct {
+		condition string
+		expectSig string
+	}{{
+		condition: "account = 3735928559",
+		expectSig: "1efe4763f290dbce0c1d08477367e11f4eee456a64933cf662d79772dbb82128",
+	}, {
+		condition: "time < 2020-01-01T00:00",
+		expectSig: "b5f06c8c8ef92f6c82c6ff282cd1f8bd1849301d09a2db634ba182536a611c49",
+	}, {
+		condition: "email = alice@example.org",
+		expectSig: "ddf553e46083e55b8d71ab822be3d8fcf21d6bf19c40d617bb9fb438934474b6",
+	}} {
+		err := m.AddCaveat(testContext, checkers.Caveat{Condition: test.condition}, nil, nil)
+		c.Assert(err, qt.IsNil)
+		c.Assert(fmt.Sprintf("%x", m.M().Signature()), qt.Equals, test.expectSig, qt.Commentf("after %q", test.condition))
+	}
+}
+
+// libmacaroonsThirdPartyJSON holds the JSON serialization of the
+// second macaroon in the libmacaroons README, as produced by
+// libmacaroons:
+//
+//	secret = 'this is a different super-secret key; never use the same secret twice'
+//	public = 'we used our other secret key'
+//	location = 'http://mybank/'
+//	M = macaroons.create(location, secret, public)
+//	M = M.add_first_party_caveat('account = 3735928559')
+//	caveat_key = '4; guaranteed random by a fair toss of the dice'
+//	identifier = 'this was how we remind auth of key/pred'
+//	M = M.add_third_party_caveat('http://auth.mybank/', caveat_key, identifier)
+//	M.serialize_json()
+const libmacaroonsThirdPartyJSON = `{"caveats":[{"cid":"account = 3735928559"},{"cid":"this was how we remind auth of key\/pred","vid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD_w_dedwv4Jjw7UorCREw5rXbRqIKhr","cl":"http:\/\/auth.mybank\/"}],"location":"http:\/\/mybank\/","identifier":"we used our other secret key","signature":"d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c"}`
+
+func TestLibmacaroonsJSONRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	var m bakery.Macaroon
+	err := json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Version(), qt.Equals, bakery.Version1)
+	c.Assert(fmt.Sprintf("%x", m.M().Signature()), qt.Equals, "d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c")
+
+	data, err := json.Marshal(&m)
+	c.Assert(err, qt.IsNil)
+	var got, want interface{}
+	err = json.Unmarshal(data, &got)
+	c.Assert(err, qt.IsNil)
+	err = json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &want)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, want)
+}
+
+func TestLibmacaroonsDischargeBinding(t *testing.T) {
+	c := qt.New(t)
+	var m bakery.Macaroon
+	err := json.Unmarshal([]byte(libmacaroonsThirdPartyJSON), &m)
+	c.Assert(err, qt.IsNil)
+
+	newDischarge := func(caveatKey string) *bakery.Macaroon {
+		// D = macaroons.create('http://auth.mybank/', caveat_key, identifier)
+		// D = D.add_first_party_caveat('time < 2020-01-01T00:00')
+		d, err := bakery.NewMacaroon(
+			[]byte(caveatKey),
+			[]byte("this was how we remind auth of key/pred"),
+			"http://auth.mybank/",
+			bakery.Version1,
+			nil,
+		)
+		c.Assert(err, qt.IsNil)
+		err = d.AddCaveat(testContext, checkers.Caveat{Condition: "time < 2020-01-01T00:00"}, nil, nil)
+		c.Assert(err, qt.IsNil)
+		return d
+	}
+	secret := []byte("this is a different super-secret key; never use the same secret twice")
+
+	// The verification id was encrypted by libmacaroons, so
+	// successful verification shows that the caveat key is
+	// recovered in the same way, and that the discharge is
+	// bound as by prepare_for_request.
+	ms := bakery.Slice{&m, newDischarge("4; guaranteed random by a fair toss of the dice")}.Bind()
+	conds, err := ms[0].VerifySignature(secret, ms[1:])
+	c.Assert(err, qt.IsNil)
+	c.Assert(conds, qt.DeepEquals, []string{
+		"account = 3735928559",
+		"time < 2020-01-01T00:00",
+	})
+
+	// An unbound discharge is rejected.
+	d := newDischarge("4; guaranteed random by a fair toss of the dice")
+	_, err = m.M().VerifySignature(secret, macaroon.Slice{d.M()})
+	c.Assert(err, qt.ErrorMatches, `signature mismatch after caveat verification`)
+
+	// So is a discharge made with the wrong caveat key.
+	ms = bakery.Slice{&m, newDischarge("some other key")}.Bind()
+	_, err = ms[0].VerifySignature(secret, ms[1:])
+	c.Assert(err, qt.ErrorMatches, `signature mismatch after caveat verification`)
+}
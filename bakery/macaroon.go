@@ -128,7 +128,7 @@ func (m *Macaroon) UnmarshalJSON(data []byte) error {
 	}
 	// We've got macaroon field - it's the new format.
 	if m1.Version < Version3 || m1.Version > LatestVersion {
-		return errgo.Newf("unexpected bakery macaroon version; got %d want %d", m1.Version, Version3)
+		return errgo.Newf("unexpected bakery macaroon version; got %d want %d to %d", m1.Version, Version3, LatestVersion)
 	}
 	if got, want := m1.Macaroon.Version(), MacaroonVersion(m1.Version); got != want {
 		return errgo.Newf("underlying macaroon has inconsistent version; got %d want %d", got, want)
@@ -285,7 +285,7 @@ func (m *Macaroon) AddCaveat(ctx context.Context, cav checkers.Caveat, key *KeyP
 	if m.version < info.Version {
 		info.Version = m.version
 	}
-	caveatInfo, err := encodeCaveat(cav.Condition, rootKey, info, key, m.namespace)
+	caveatInfo, err := encodeCaveat(cav.Condition, rootKey, info, key, m.namespace, cav.Location)
 	if err != nil {
 		return errgo.Notef(err, "cannot create third party caveat at %q", cav.Location)
 	}
@@ -0,0 +1,173 @@
+package bakery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery/internal/macaroonpb"
+)
+
+// MacaroonIdInfo holds the information encoded in the id of a
+// macaroon minted by an Oven.
+type MacaroonIdInfo struct {
+	// Version holds the bakery version that the id was created
+	// with. Ids created by versions of the bakery prior to
+	// Version2 are reported as Version1.
+	Version Version
+
+	// Nonce holds the random nonce that makes the id unique.
+	// It is empty for ids created prior to Version2.
+	Nonce []byte
+
+	// StorageId holds the id of the root key in the root key
+	// store.
+	StorageId []byte
+
+	// Ops holds the operations associated with the macaroon.
+	// It is empty for ids created prior to Version3, because the
+	// associated operations are not held in the id itself (see
+	// OvenParams.LegacyMacaroonOp).
+	//
+	// ParseMacaroonId leaves it empty when the operations are
+	// held in an OpSetStore (see OpSetDigest);
+	// Oven.VerifyMacaroonIdInfo fills it in from the oven's store.
+	Ops []Op
+
+	// OpSetDigest holds the digest that identifies the macaroon's
+	// operations in an OpSetStore (see OvenParams.OpSetStore),
+	// or nil if the operations are held in the id itself.
+	OpSetDigest []byte
+
+	// IssuedAt holds the time that the macaroon was minted,
+	// if it was recorded (see OvenParams.RecordIssueTime).
+	// Otherwise it is the zero time.
+	IssuedAt time.Time
+
+	// Issuer holds the name of the service instance that minted
+	// the macaroon (see OvenParams.Issuer), if any.
+	Issuer string
+
+	// Labels holds the labels recorded in the id (see
+	// OvenParams.Labels), if any.
+	Labels map[string]string
+}
+
+// ParseMacaroonId parses the given macaroon id, as returned by
+// macaroon.Macaroon.Id, of a macaroon minted by an Oven. It
+// understands all the id formats used by the bakery, including the
+// base64 encoding used for Version3 ids in macaroons with a version
+// prior to macaroon.V2.
+//
+// Parsing an id does not require access to the root key and does not
+// check that the macaroon is valid, so the result must not be used to
+// make authorization decisions.
+func ParseMacaroonId(id []byte) (*MacaroonIdInfo, error) {
+	info, err := parseMacaroonId(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if info.StorageId == nil {
+		return nil, errgo.Newf("unrecognized macaroon id format")
+	}
+	return info, nil
+}
+
+// parseMacaroonId is like ParseMacaroonId except that it treats ids
+// in an unrecognized format as old-style ids with no storage id, so
+// that looking up their root key fails with a not-found error.
+func parseMacaroonId(id []byte) (*MacaroonIdInfo, error) {
+	if len(id) == 0 {
+		return nil, errgo.Newf("empty macaroon id")
+	}
+	base64Decoded := false
+	if id[0] == 'A' {
+		// The first byte is not a version number and it's 'A', which is the
+		// base64 encoding of the top 6 bits (all zero) of the version number 2 or 3,
+		// so we assume that it's the base64 encoding of a new-style
+		// macaroon id, so we base64 decode it.
+		//
+		// Note that old-style ids always start with an ASCII character >= 4
+		// (> 32 in fact) so this logic won't be triggered for those.
+		dec := make([]byte, base64.RawURLEncoding.DecodedLen(len(id)))
+		n, err := base64.RawURLEncoding.Decode(dec, id)
+		if err == nil && n > 0 {
+			// Set the id only on success - if it's a bad encoding, we'll get a not-found error
+			// which is fine because "not found" is a correct description of the issue - we
+			// can't find the root key for the given id.
+			id = dec[0:n]
+			base64Decoded = true
+		}
+	}
+	// Trim any extraneous information from the id before retrieving
+	// it from storage, including the UUID that's added when
+	// creating macaroons to make all macaroons unique even if
+	// they're using the same root key.
+	switch id[0] {
+	case byte(Version2):
+		if len(id) < 1+16 {
+			return nil, errgo.Newf("macaroon id too short")
+		}
+		// Skip the UUID at the start of the id.
+		return &MacaroonIdInfo{
+			Version:   Version2,
+			Nonce:     id[1 : 1+16],
+			StorageId: id[1+16:],
+		}, nil
+	case byte(Version3):
+		var id1 macaroonpb.MacaroonId
+		if err := id1.UnmarshalBinary(id[1:]); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal macaroon id")
+		}
+		var ops []Op
+		switch {
+		case len(id1.OpSetDigest) > 0:
+			// The operations are held in an OpSetStore.
+		case len(id1.CompactOps) > 0:
+			var err error
+			ops, err = expandCompactIdOps(id1.ActionDict, id1.CompactOps)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		default:
+			ops = make([]Op, 0, len(id1.Ops))
+			for _, op := range id1.Ops {
+				for _, action := range op.Actions {
+					ops = append(ops, Op{
+						Entity: op.Entity,
+						Action: action,
+					})
+				}
+			}
+		}
+		if len(ops) == 0 && len(id1.OpSetDigest) == 0 {
+			return nil, errgo.Newf("no operations found in macaroon")
+		}
+		info := &MacaroonIdInfo{
+			Version:     Version3,
+			Nonce:       id1.Nonce,
+			StorageId:   id1.StorageId,
+			Ops:         ops,
+			OpSetDigest: id1.OpSetDigest,
+			Issuer:      id1.Issuer,
+			Labels:      id1.Labels,
+		}
+		if id1.IssuedAt != 0 {
+			info.IssuedAt = time.Unix(id1.IssuedAt, 0).UTC()
+		}
+		return info, nil
+	}
+	info := &MacaroonIdInfo{
+		Version: Version1,
+	}
+	if !base64Decoded && isLowerCaseHexChar(id[0]) {
+		// It's an old-style id, probably with a hyphenated UUID.
+		// so trim that off.
+		if i := bytes.LastIndexByte(id, '-'); i >= 0 {
+			info.StorageId = id[0:i]
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,81 @@
+package bakery_test
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+func TestParseMacaroonIdFromOven(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{})
+	ops := []bakery.Op{{"one", "read"}, {"one", "write"}, {"two", "read"}}
+	for _, version := range []bakery.Version{bakery.Version1, bakery.LatestVersion} {
+		m, err := oven.NewMacaroon(testContext, version, nil, ops...)
+		c.Assert(err, qt.IsNil)
+		info, err := bakery.ParseMacaroonId(m.M().Id())
+		c.Assert(err, qt.IsNil)
+		c.Assert(info.Version, qt.Equals, bakery.Version3)
+		c.Assert(info.Nonce, qt.HasLen, 16)
+		// The default root key store always uses the id "0".
+		c.Assert(string(info.StorageId), qt.Equals, "0")
+		c.Assert(info.Ops, qt.DeepEquals, ops)
+	}
+}
+
+var parseMacaroonIdTests = []struct {
+	about       string
+	id          []byte
+	expect      *bakery.MacaroonIdInfo
+	expectError string
+}{{
+	about: "version 2",
+	id:    append(append([]byte{2}, bytes.Repeat([]byte("n"), 16)...), "storage"...),
+	expect: &bakery.MacaroonIdInfo{
+		Version:   bakery.Version2,
+		Nonce:     bytes.Repeat([]byte("n"), 16),
+		StorageId: []byte("storage"),
+	},
+}, {
+	about: "legacy hex id",
+	id:    []byte("0123abcd-44f9-4a7c-9c3c-4b7b0f3c8b0e"),
+	expect: &bakery.MacaroonIdInfo{
+		Version:   bakery.Version1,
+		StorageId: []byte("0123abcd-44f9-4a7c-9c3c"),
+	},
+}, {
+	about:       "empty id",
+	id:          []byte{},
+	expectError: `empty macaroon id`,
+}, {
+	about:       "version 2 id too short",
+	id:          []byte{2, 'x'},
+	expectError: `macaroon id too short`,
+}, {
+	about:       "bad version 3 id",
+	id:          []byte{3, 0xff},
+	expectError: `cannot unmarshal macaroon id: .*`,
+}, {
+	about:       "unrecognized id",
+	id:          []byte("something else"),
+	expectError: `unrecognized macaroon id format`,
+}}
+
+func TestParseMacaroonId(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseMacaroonIdTests {
+		c.Run(test.about, func(c *qt.C) {
+			info, err := bakery.ParseMacaroonId(test.id)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(info, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(info, qt.DeepEquals, test.expect)
+		})
+	}
+}
@@ -0,0 +1,3 @@
+package memrootkeystore
+
+var Clock = &clock
@@ -0,0 +1,372 @@
+// Package memrootkeystore provides an implementation of
+// bakery.RootKeyStore that holds root keys in memory, rotating them
+// according to a store policy. The keys can optionally be saved to
+// and restored from a file.
+package memrootkeystore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+// Variables defined so they can be overidden for testing.
+var clock dbrootkeystore.Clock
+
+// Policy holds a store policy for root keys.
+type Policy dbrootkeystore.Policy
+
+// RootKeys represents a cache of macaroon root keys
+// held in memory.
+type RootKeys struct {
+	keys *dbrootkeystore.RootKeys
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// rootKeys holds all the keys, indexed by id.
+	rootKeys map[string]dbrootkeystore.RootKey
+}
+
+// NewRootKeys returns a new in-memory root-keys store with a cache
+// that is limited in size to approximately the given size.
+//
+// Use the NewStore method to obtain a RootKeyStore
+// implementation suitable for particular root key
+// lifetimes.
+func NewRootKeys(maxCacheSize int) *RootKeys {
+	return &RootKeys{
+		keys:     dbrootkeystore.NewRootKeys(maxCacheSize, clock),
+		rootKeys: make(map[string]dbrootkeystore.RootKey),
+	}
+}
+
+// NewStore returns a new RootKeyStore implementation that
+// stores and obtains root keys in memory.
+//
+// Root keys will be generated and stored following the
+// given store policy.
+func (s *RootKeys) NewStore(policy Policy) bakery.RootKeyStore {
+	return s.keys.NewStore(backing{s}, dbrootkeystore.Policy(policy))
+}
+
+// Backing returns the dbrootkeystore.Backing used by the store. It can be
+// used to copy keys between stores.
+func (s *RootKeys) Backing() dbrootkeystore.Backing {
+	return backing{s}
+}
+
+// DeleteExpired deletes all keys that expired before the given
+// time from the store and from the cache.
+func (s *RootKeys) DeleteExpired(ctx context.Context, before time.Time) error {
+	return s.keys.DeleteExpired(ctx, backing{s}, before)
+}
+
+// StartCollector starts a goroutine that periodically deletes expired
+// keys from memory, which is otherwise only done when a new key is
+// created. See dbrootkeystore.RootKeys.StartCollector for details.
+func (s *RootKeys) StartCollector(interval time.Duration, logger bakery.Logger) (stop func(), err error) {
+	return s.keys.StartCollector(backing{s}, interval, logger)
+}
+
+// Revoke revokes the key with the given id so that no macaroon
+// minted with it will verify any longer.
+//
+// If the key is not found, Revoke returns an error with a
+// bakery.ErrNotFound cause.
+func (s *RootKeys) Revoke(ctx context.Context, id []byte) error {
+	return s.keys.Revoke(ctx, backing{s}, id)
+}
+
+// SetObserver sets the observer that is notified of cache hits,
+// cache misses, key generation, key expiry and backing store errors.
+// If o is nil, events are ignored (the default).
+func (s *RootKeys) SetObserver(o dbrootkeystore.Observer) {
+	s.keys.SetObserver(o)
+}
+
+// CacheStats returns statistics about the key cache.
+func (s *RootKeys) CacheStats() dbrootkeystore.CacheStats {
+	return s.keys.CacheStats()
+}
+
+// snapshot is the form in which keys are written
+// by WriteSnapshot.
+type snapshot struct {
+	Version int           `json:"version"`
+	Keys    []snapshotKey `json:"keys"`
+}
+
+type snapshotKey struct {
+	Id      []byte    `json:"id"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	RootKey []byte    `json:"rootkey"`
+}
+
+// snapshotVersion holds the current version of the snapshot format.
+const snapshotVersion = 1
+
+// WriteSnapshot writes all the unexpired keys in the store to w so
+// that they can be restored later with ReadSnapshot. Note that the
+// root key secrets are written in plaintext.
+func (s *RootKeys) WriteSnapshot(w io.Writer) error {
+	s.mu.Lock()
+	now := s.now()
+	snap := snapshot{
+		Version: snapshotVersion,
+		Keys:    make([]snapshotKey, 0, len(s.rootKeys)),
+	}
+	for _, k := range s.rootKeys {
+		if !k.IsValid() || now.After(k.Expires) {
+			continue
+		}
+		snap.Keys = append(snap.Keys, snapshotKey{
+			Id:      k.Id,
+			Created: k.Created,
+			Expires: k.Expires,
+			RootKey: k.RootKey,
+		})
+	}
+	s.mu.Unlock()
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return errgo.Notef(err, "cannot write snapshot")
+	}
+	return nil
+}
+
+// ReadSnapshot reads keys written by WriteSnapshot from r and adds
+// the unexpired ones to the store. Keys that already exist in the
+// store are left alone.
+func (s *RootKeys) ReadSnapshot(r io.Reader) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return errgo.Notef(err, "cannot read snapshot")
+	}
+	if snap.Version != snapshotVersion {
+		return errgo.Newf("unsupported snapshot version %d", snap.Version)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, k := range snap.Keys {
+		if len(k.Id) == 0 || len(k.RootKey) == 0 {
+			return errgo.Newf("invalid key in snapshot")
+		}
+		if now.After(k.Expires) {
+			continue
+		}
+		if _, ok := s.rootKeys[string(k.Id)]; ok {
+			continue
+		}
+		s.rootKeys[string(k.Id)] = dbrootkeystore.RootKey{
+			Id:      k.Id,
+			Created: k.Created,
+			Expires: k.Expires,
+			RootKey: k.RootKey,
+		}
+	}
+	return nil
+}
+
+// SaveFile writes a snapshot of the store to the named file,
+// replacing it atomically. The file is only readable by its owner.
+func (s *RootKeys) SaveFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if err := s.WriteSnapshot(f); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// LoadFile restores keys from a snapshot in the named file written
+// by SaveFile. If the file does not exist, the returned error will
+// satisfy os.IsNotExist.
+func (s *RootKeys) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errgo.Mask(err, os.IsNotExist)
+	}
+	defer f.Close()
+	if err := s.ReadSnapshot(f); err != nil {
+		return errgo.Notef(err, "cannot load %q", path)
+	}
+	return nil
+}
+
+func (s *RootKeys) now() time.Time {
+	if clock != nil {
+		return clock.Now()
+	}
+	return time.Now()
+}
+
+// backing implements dbrootkeystore.Backing by holding
+// keys in memory.
+type backing struct {
+	keys *RootKeys
+}
+
+var _ dbrootkeystore.Backing = backing{}
+var _ dbrootkeystore.ExpiryBacking = backing{}
+var _ dbrootkeystore.RevocationBacking = backing{}
+var _ dbrootkeystore.IterBacking = backing{}
+var _ dbrootkeystore.UpdateBacking = backing{}
+var _ dbrootkeystore.WindowInsertBacking = backing{}
+
+// GetKey implements dbrootkeystore.Backing.GetKey.
+func (b backing) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
+	b.keys.mu.Lock()
+	defer b.keys.mu.Unlock()
+	key, ok := b.keys.rootKeys[string(id)]
+	if !ok {
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	}
+	return key, nil
+}
+
+// FindLatestKey implements dbrootkeystore.Backing.FindLatestKey.
+func (b backing) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	b.keys.mu.Lock()
+	defer b.keys.mu.Unlock()
+	return b.keys.findLatestKey(createdAfter, expiresAfter, expiresBefore), nil
+}
+
+// InsertKey implements dbrootkeystore.Backing.InsertKey.
+func (b backing) InsertKey(key dbrootkeystore.RootKey) error {
+	b.keys.mu.Lock()
+	defer b.keys.mu.Unlock()
+	return b.keys.insertKey(key)
+}
+
+// InsertKeyIfNoneInWindow implements
+// dbrootkeystore.WindowInsertBacking.InsertKeyIfNoneInWindow.
+func (b backing) InsertKeyIfNoneInWindow(_ context.Context, key dbrootkeystore.RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	b.keys.mu.Lock()
+	defer b.keys.mu.Unlock()
+	if existing := b.keys.findLatestKey(createdAfter, expiresAfter, expiresBefore); existing.IsValid() {
+		return existing, nil
+	}
+	if err := b.keys.insertKey(key); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// DeleteExpiredKeys implements dbrootkeystore.ExpiryBacking.DeleteExpiredKeys.
+func (b backing) DeleteExpiredKeys(_ context.Context, before time.Time) error {
+	b.keys.mu.Lock()
+	defer b.keys.mu.Unlock()
+	b.keys.deleteExpired(before)
+	return nil
+}
+
+// RevokeKey implements dbrootkeystore.RevocationBacking.RevokeKey.
+func (b backing) RevokeKey(_ context.Context, id []byte) error {
+	b.keys.mu.Lock()
+	defer b.keys.mu.Unlock()
+	key, ok := b.keys.rootKeys[string(id)]
+	if !ok {
+		return bakery.ErrNotFound
+	}
+	key.RootKey = nil
+	b.keys.rootKeys[string(id)] = key
+	return nil
+}
+
+// ForEachKey implements dbrootkeystore.IterBacking.ForEachKey.
+func (b backing) ForEachKey(_ context.Context, f func(dbrootkeystore.RootKey) error) error {
+	// Copy the keys so that f is called without holding the
+	// lock.
+	b.keys.mu.Lock()
+	keys := make([]dbrootkeystore.RootKey, 0, len(b.keys.rootKeys))
+	for _, k := range b.keys.rootKeys {
+		if k.IsValid() {
+			keys = append(keys, k)
+		}
+	}
+	b.keys.mu.Unlock()
+	for _, k := range keys {
+		if err := f(k); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+// UpdateKey implements dbrootkeystore.UpdateBacking.UpdateKey.
+func (b backing) UpdateKey(_ context.Context, key dbrootkeystore.RootKey) error {
+	b.keys.mu.Lock()
+	defer b.keys.mu.Unlock()
+	k, ok := b.keys.rootKeys[string(key.Id)]
+	if !ok || !k.IsValid() {
+		return bakery.ErrNotFound
+	}
+	k.RootKey = key.RootKey
+	b.keys.rootKeys[string(key.Id)] = k
+	return nil
+}
+
+// findLatestKey returns the most recently created valid key that
+// satisfies the given constraints, or the zero key if there is none.
+// Called with s.mu locked.
+func (s *RootKeys) findLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) dbrootkeystore.RootKey {
+	var best dbrootkeystore.RootKey
+	for _, k := range s.rootKeys {
+		if k.IsValid() &&
+			!k.Created.Before(createdAfter) &&
+			!k.Expires.Before(expiresAfter) &&
+			!k.Expires.After(expiresBefore) &&
+			(!best.IsValid() || k.Created.After(best.Created)) {
+			best = k
+		}
+	}
+	return best
+}
+
+// insertKey inserts the given key, first removing any keys that
+// have expired so that the store does not grow without bound.
+// Called with s.mu locked.
+func (s *RootKeys) insertKey(key dbrootkeystore.RootKey) error {
+	s.deleteExpired(s.now())
+	if _, ok := s.rootKeys[string(key.Id)]; ok {
+		return errgo.WithCausef(nil, dbrootkeystore.ErrKeyExists, "duplicate key id %q", key.Id)
+	}
+	s.rootKeys[string(key.Id)] = key
+	return nil
+}
+
+// deleteExpired deletes all keys that expired before the given time.
+// Called with s.mu locked.
+func (s *RootKeys) deleteExpired(before time.Time) {
+	for id, k := range s.rootKeys {
+		if k.Expires.Before(before) {
+			delete(s.rootKeys, id)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package memrootkeystore_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+	"gopkg.in/macaroon-bakery.v2/bakery/memrootkeystore"
+)
+
+var epoch = time.Date(2200, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var testPolicy = memrootkeystore.Policy{
+	GenerateInterval: time.Minute,
+	ExpiryDuration:   5 * time.Minute,
+}
+
+func TestRootKeyRotation(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	now := epoch
+	c.Patch(memrootkeystore.Clock, clockVal(&now))
+	store := memrootkeystore.NewRootKeys(10).NewStore(testPolicy)
+	ctx := context.Background()
+
+	key0, id0, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	// Within the generate interval, the same key is returned.
+	now = epoch.Add(30 * time.Second)
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id, qt.DeepEquals, id0)
+
+	// After it, a new key is created.
+	now = epoch.Add(time.Minute + time.Second)
+	_, id1, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id1, qt.Not(qt.DeepEquals), id0)
+
+	// The old key is still available until it expires.
+	key, err := store.Get(ctx, id0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key, qt.DeepEquals, key0)
+
+	now = epoch.Add(7 * time.Minute)
+	_, err = store.Get(ctx, id0)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func TestDeleteExpired(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	now := epoch
+	c.Patch(memrootkeystore.Clock, clockVal(&now))
+	keys := memrootkeystore.NewRootKeys(10)
+	ctx := context.Background()
+	_, id, err := keys.NewStore(testPolicy).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	err = keys.DeleteExpired(ctx, epoch.Add(10*time.Minute))
+	c.Assert(err, qt.IsNil)
+	_, err = keys.Backing().GetKey(id)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+}
+
+func TestRevoke(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Patch(memrootkeystore.Clock, stoppedClock(epoch))
+	keys := memrootkeystore.NewRootKeys(10)
+	store := keys.NewStore(testPolicy)
+	ctx := context.Background()
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	err = keys.Revoke(ctx, id)
+	c.Assert(err, qt.IsNil)
+	_, err = store.Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, id1, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id1, qt.Not(qt.DeepEquals), id)
+
+	err = keys.Revoke(ctx, []byte("foo"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+}
+
+func TestSaveAndLoadFile(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	now := epoch
+	c.Patch(memrootkeystore.Clock, clockVal(&now))
+	dir, err := ioutil.TempDir("", "memrootkeystore")
+	c.Assert(err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rootkeys.json")
+
+	keys := memrootkeystore.NewRootKeys(10)
+	ctx := context.Background()
+	key0, id0, err := keys.NewStore(testPolicy).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	now = epoch.Add(2 * time.Minute)
+	key1, id1, err := keys.NewStore(testPolicy).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	err = keys.Revoke(ctx, id0)
+	c.Assert(err, qt.IsNil)
+
+	err = keys.SaveFile(path)
+	c.Assert(err, qt.IsNil)
+	info, err := os.Stat(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0600))
+
+	keys = memrootkeystore.NewRootKeys(10)
+	err = keys.LoadFile(path)
+	c.Assert(err, qt.IsNil)
+	store := keys.NewStore(testPolicy)
+
+	// The revoked key was not saved.
+	_, err = store.Get(ctx, id0)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	key, err := store.Get(ctx, id1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key, qt.DeepEquals, key1)
+
+	// The restored key is used for new macaroons.
+	key, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id, qt.DeepEquals, id1)
+	c.Assert(key, qt.DeepEquals, key1)
+	c.Assert(key0, qt.Not(qt.DeepEquals), key1)
+}
+
+func TestLoadFileNotFound(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "memrootkeystore")
+	c.Assert(err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	err = memrootkeystore.NewRootKeys(10).LoadFile(filepath.Join(dir, "nonexistent"))
+	c.Assert(os.IsNotExist(errgo.Cause(err)), qt.Equals, true)
+}
+
+var readSnapshotErrorTests = []struct {
+	about       string
+	data        string
+	expectError string
+}{{
+	about:       "invalid JSON",
+	data:        "{",
+	expectError: `cannot read snapshot: unexpected EOF`,
+}, {
+	about:       "unknown version",
+	data:        `{"version": 99}`,
+	expectError: `unsupported snapshot version 99`,
+}, {
+	about:       "invalid key",
+	data:        `{"version": 1, "keys": [{"id": "aWQ="}]}`,
+	expectError: `invalid key in snapshot`,
+}}
+
+func TestReadSnapshotErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range readSnapshotErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := memrootkeystore.NewRootKeys(10).ReadSnapshot(strings.NewReader(test.data))
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func TestCopyKeys(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Patch(memrootkeystore.Clock, stoppedClock(epoch))
+	keys := memrootkeystore.NewRootKeys(10)
+	ctx := context.Background()
+	_, id, err := keys.NewStore(testPolicy).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	keys1 := memrootkeystore.NewRootKeys(10)
+	n, err := dbrootkeystore.CopyKeys(ctx, keys1.Backing(), keys.Backing(), epoch)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+	_, err = keys1.NewStore(testPolicy).Get(ctx, id)
+	c.Assert(err, qt.IsNil)
+}
+
+func clockVal(t *time.Time) dbrootkeystore.Clock {
+	return clockFunc(func() time.Time {
+		return *t
+	})
+}
+
+func stoppedClock(t time.Time) dbrootkeystore.Clock {
+	return clockFunc(func() time.Time {
+		return t
+	})
+}
+
+type clockFunc func() time.Time
+
+func (f clockFunc) Now() time.Time {
+	return f()
+}
@@ -4,6 +4,7 @@ package mgorootkeystore
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/juju/mgo/v2"
@@ -66,16 +67,74 @@ func (s *RootKeys) NewStore(c *mgo.Collection, policy Policy) bakery.RootKeyStor
 	return s.keys.NewStore(backing{c}, dbrootkeystore.Policy(policy))
 }
 
+// Backing returns a dbrootkeystore.Backing that stores keys in the
+// given collection. It can be used to wrap the backing (for example
+// with dbrootkeystore.NewEncryptedBacking) or to copy keys between
+// stores.
+func (s *RootKeys) Backing(c *mgo.Collection) dbrootkeystore.Backing {
+	return backing{c}
+}
+
+// Revoke revokes the key with the given id in the given collection
+// so that no macaroon minted with it will verify any longer. Other
+// RootKeys instances using the same collection will stop using the
+// key within their revalidate interval (see SetRevalidateInterval).
+//
+// If the key is not found, Revoke returns an error with a
+// bakery.ErrNotFound cause.
+func (s *RootKeys) Revoke(ctx context.Context, c *mgo.Collection, id []byte) error {
+	return s.keys.Revoke(ctx, backing{c}, id)
+}
+
+// SetRevalidateInterval sets the maximum length of time that a key
+// will be served from the cache before it is fetched again from the
+// collection. This bounds the time it takes for a key revoked by
+// another RootKeys instance to stop being used by this one. If d is
+// zero (the default), cached keys are never revalidated.
+func (s *RootKeys) SetRevalidateInterval(d time.Duration) {
+	s.keys.SetRevalidateInterval(d)
+}
+
+// SetNegativeTTL sets the maximum length of time that a lookup of a
+// key that was not found in the collection will be answered from the
+// cache. If d is zero (the default), only the revalidate interval
+// applies to such lookups.
+func (s *RootKeys) SetNegativeTTL(d time.Duration) {
+	s.keys.SetNegativeTTL(d)
+}
+
+// SetObserver sets the observer that is notified of cache hits,
+// cache misses, key generation, key expiry and backing store errors.
+// If o is nil, events are ignored (the default).
+func (s *RootKeys) SetObserver(o dbrootkeystore.Observer) {
+	s.keys.SetObserver(o)
+}
+
+// CacheStats returns statistics about the key cache.
+func (s *RootKeys) CacheStats() dbrootkeystore.CacheStats {
+	return s.keys.CacheStats()
+}
+
 var indexes = []mgo.Index{{
 	Key: []string{"-created"},
 }, {
 	Key:         []string{"expires"},
 	ExpireAfter: time.Second,
+}, {
+	// The window index ensures that concurrent calls to
+	// InsertKeyIfNoneInWindow cannot insert more than one key
+	// for the same policy and generation interval. It is sparse
+	// because only keys inserted that way have a window field.
+	Key:    []string{"window"},
+	Unique: true,
+	Sparse: true,
 }}
 
 // EnsureIndex ensures that the required indexes exist on the
 // collection that will be used for root key store.
 // This should be called at least once before using NewStore.
+// Without it, stores that generate keys at the same time
+// may each create a new key.
 func (s *RootKeys) EnsureIndex(c *mgo.Collection) error {
 	for _, idx := range indexes {
 		if err := c.EnsureIndex(idx); err != nil {
@@ -91,6 +150,10 @@ type backing struct {
 
 var _ dbrootkeystore.Backing = backing{}
 var _ dbrootkeystore.ContextBacking = backing{}
+var _ dbrootkeystore.RevocationBacking = backing{}
+var _ dbrootkeystore.IterBacking = backing{}
+var _ dbrootkeystore.UpdateBacking = backing{}
+var _ dbrootkeystore.WindowInsertBacking = backing{}
 
 // GetKey implements dbrootkeystore.Backing.
 func (b backing) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
@@ -164,6 +227,8 @@ func (b backing) FindLatestKeyContext(ctx context.Context, createdAfter, expires
 func findLatestKey(coll *mgo.Collection, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
 	var key dbrootkeystore.RootKey
 	err := coll.Find(bson.D{{
+		"rootkey", bson.D{{"$ne", nil}},
+	}, {
 		"created", bson.D{{"$gte", createdAfter}},
 	}, {
 		"expires", bson.D{
@@ -199,11 +264,189 @@ func (b backing) InsertKeyContext(ctx context.Context, key dbrootkeystore.RootKe
 
 func insertKey(coll *mgo.Collection, key dbrootkeystore.RootKey) error {
 	if err := coll.Insert(key); err != nil {
+		if mgo.IsDup(err) {
+			return errgo.WithCausef(err, dbrootkeystore.ErrKeyExists, "duplicate key id %q", key.Id)
+		}
 		return errgo.Notef(err, "mongo insert failed")
 	}
 	return nil
 }
 
+// RevokeKey implements dbrootkeystore.RevocationBacking.
+func (b backing) RevokeKey(ctx context.Context, id []byte) error {
+	var err error
+
+	f := func(coll *mgo.Collection) {
+		err = revokeKey(coll, id)
+	}
+
+	if err := b.runWithContext(ctx, f); err != nil {
+		return err
+	}
+
+	return err
+}
+
+// ForEachKey implements dbrootkeystore.IterBacking.
+func (b backing) ForEachKey(ctx context.Context, f func(dbrootkeystore.RootKey) error) error {
+	var err error
+
+	g := func(coll *mgo.Collection) {
+		err = forEachKey(coll, f)
+	}
+
+	if err := b.runWithContext(ctx, g); err != nil {
+		return err
+	}
+
+	return err
+}
+
+// forEachKey calls f for each key in the collection that has not been
+// revoked, including keys stored in the legacy format.
+func forEachKey(coll *mgo.Collection, f func(dbrootkeystore.RootKey) error) error {
+	iter := coll.Find(bson.D{{"rootkey", bson.D{{"$ne", nil}}}}).Iter()
+	var key dbrootkeystore.RootKey
+	for iter.Next(&key) {
+		if err := f(key); err != nil {
+			iter.Close()
+			return errgo.Mask(err, errgo.Any)
+		}
+		key = dbrootkeystore.RootKey{}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate over keys")
+	}
+	return nil
+}
+
+// UpdateKey implements dbrootkeystore.UpdateBacking.
+func (b backing) UpdateKey(ctx context.Context, key dbrootkeystore.RootKey) error {
+	var err error
+
+	f := func(coll *mgo.Collection) {
+		err = updateKey(coll, key)
+	}
+
+	if err := b.runWithContext(ctx, f); err != nil {
+		return err
+	}
+
+	return err
+}
+
+func updateKey(coll *mgo.Collection, key dbrootkeystore.RootKey) error {
+	update := bson.D{{"$set", bson.D{{"rootkey", key.RootKey}}}}
+	err := coll.Update(bson.D{{"_id", key.Id}, {"rootkey", bson.D{{"$ne", nil}}}}, update)
+	if err == mgo.ErrNotFound {
+		// Try the legacy string id format.
+		err = coll.Update(bson.D{{"_id", string(key.Id)}, {"rootkey", bson.D{{"$ne", nil}}}}, update)
+	}
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return bakery.ErrNotFound
+		}
+		return errgo.Notef(err, "cannot update key")
+	}
+	return nil
+}
+
+// InsertKeyIfNoneInWindow implements
+// dbrootkeystore.WindowInsertBacking.
+func (b backing) InsertKeyIfNoneInWindow(ctx context.Context, key dbrootkeystore.RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	var rk dbrootkeystore.RootKey
+	var err error
+
+	f := func(coll *mgo.Collection) {
+		rk, err = insertKeyIfNoneInWindow(coll, key, createdAfter, expiresAfter, expiresBefore)
+	}
+
+	if err := b.runWithContext(ctx, f); err != nil {
+		return dbrootkeystore.RootKey{}, err
+	}
+
+	return rk, err
+}
+
+// insertKeyIfNoneInWindow uses an upsert matching the same keys as
+// findLatestKey so that the query and the insertion happen in a
+// single operation. Upserts that run at the same time can each fail
+// to find a key, so the inserted document also holds a window field
+// that identifies the generation interval it was created in. The
+// unique index on that field (see EnsureIndex) makes all but one of
+// the concurrent upserts fail, and those return the key that was
+// inserted instead.
+func insertKeyIfNoneInWindow(coll *mgo.Collection, key dbrootkeystore.RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	window := windowId(createdAfter, expiresAfter, expiresBefore)
+	var result dbrootkeystore.RootKey
+	_, err := coll.Find(bson.D{{
+		"rootkey", bson.D{{"$ne", nil}},
+	}, {
+		"created", bson.D{{"$gte", createdAfter}},
+	}, {
+		"expires", bson.D{
+			{"$gte", expiresAfter},
+			{"$lte", expiresBefore},
+		},
+	}}).Sort("-created").Apply(mgo.Change{
+		Update: bson.D{{"$setOnInsert", bson.D{
+			{"_id", key.Id},
+			{"created", key.Created},
+			{"expires", key.Expires},
+			{"rootkey", key.RootKey},
+			{"window", window},
+		}}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &result)
+	if mgo.IsDup(err) {
+		// Another key was inserted for the same window
+		// since we queried, so use that one.
+		err = coll.Find(bson.D{{"window", window}}).One(&result)
+	}
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot insert key")
+	}
+	return result, nil
+}
+
+// windowId returns an identifier for the generation interval that a
+// key inserted now with the policy implied by the given window
+// belongs to. The window is as computed by dbrootkeystore, so the
+// generation interval is expiresBefore-expiresAfter and the current
+// time is createdAfter plus that interval.
+func windowId(createdAfter, expiresAfter, expiresBefore time.Time) string {
+	interval := expiresBefore.Sub(expiresAfter)
+	now := createdAfter.Add(interval)
+	expiry := expiresAfter.Sub(now)
+	bucket := now.UnixNano()
+	if interval > 0 {
+		bucket /= int64(interval)
+	}
+	return fmt.Sprintf("%d/%d/%d", expiry, interval, bucket)
+}
+
+// revokeKey revokes the key with the given id by removing its root
+// key secret. The rest of the document is left in place until it
+// expires.
+func revokeKey(coll *mgo.Collection, id []byte) error {
+	// The window field is removed too so that a new key
+	// can be inserted for the same window.
+	update := bson.D{{"$unset", bson.D{{"rootkey", ""}, {"window", ""}}}}
+	err := coll.UpdateId(id, update)
+	if err == mgo.ErrNotFound {
+		// Try the legacy string id format.
+		err = coll.UpdateId(string(id), update)
+	}
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return bakery.ErrNotFound
+		}
+		return errgo.Notef(err, "cannot revoke key")
+	}
+	return nil
+}
+
 func (b backing) runWithContext(ctx context.Context, f func(*mgo.Collection)) error {
 	s := sessionFromContext(ctx)
 	if s == nil {
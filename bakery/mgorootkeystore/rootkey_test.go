@@ -1,6 +1,7 @@
 package mgorootkeystore_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"testing"
@@ -9,6 +10,7 @@ import (
 	qt "github.com/frankban/quicktest"
 	"github.com/juju/mgo/v2"
 	"github.com/juju/mgotest"
+	errgo "gopkg.in/errgo.v1"
 
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
@@ -350,16 +352,12 @@ func TestGet(t *testing.T) {
 	}
 	// Check that the keys are cached.
 	//
-	// Since the cache size is 5, the most recent 5 items will be in
-	// the primary cache; the 5 items before that will be in the old
-	// cache and nothing else will be cached.
+	// Since the cache size is 5, only the 5 most recently used
+	// items will be cached. We fetch the keys most recent first,
+	// so each fetch of an uncached key evicts the least recently
+	// used key, which is never one that we go on to fetch.
 	//
-	// The first time we fetch an item from the old cache, a new
-	// primary cache will be allocated, all existing items in the
-	// old cache except that item will be evicted, and all items in
-	// the current primary cache moved to the old cache.
-	//
-	// The upshot of that is that all but the first 6 calls to Get
+	// The upshot of that is that all but the first 5 calls to Get
 	// should result in a database fetch.
 
 	var fetched []string
@@ -376,9 +374,9 @@ func TestGet(t *testing.T) {
 		c.Assert(err, qt.IsNil, qt.Commentf("key %d (%s)", i, k.id))
 		c.Assert(key, qt.DeepEquals, k.key, qt.Commentf("key %d (%s)", i, k.id))
 	}
-	c.Assert(len(fetched), qt.Equals, len(keys)-6)
+	c.Assert(len(fetched), qt.Equals, len(keys)-5)
 	for i, id := range fetched {
-		c.Assert(id, qt.Equals, keys[len(keys)-6-i-1].id)
+		c.Assert(id, qt.Equals, keys[len(keys)-5-i-1].id)
 	}
 }
 
@@ -504,6 +502,221 @@ func TestLegacy(t *testing.T) {
 	c.Assert(string(rk), qt.Equals, "a key")
 }
 
+func TestRevoke(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	coll := testColl(c)
+	keys := mgorootkeystore.NewRootKeys(10)
+	store := keys.NewStore(coll, mgorootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	err = keys.Revoke(ctx, coll, id)
+	c.Assert(err, qt.IsNil)
+
+	_, err = store.Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+
+	// Another instance should not find the key either.
+	store1 := mgorootkeystore.NewRootKeys(10).NewStore(coll, mgorootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	_, err = store1.Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, id1, err := store1.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(id1), qt.Not(qt.Equals), string(id))
+
+	err = keys.Revoke(ctx, coll, []byte("foo"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+}
+
+func TestRevokeLegacy(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	coll := testColl(c)
+	err := coll.Insert(&legacyRootKey{
+		Id:      "foo",
+		RootKey: []byte("a key"),
+		Created: time.Now(),
+		Expires: time.Now().Add(10 * time.Minute),
+	})
+	c.Assert(err, qt.IsNil)
+	keys := mgorootkeystore.NewRootKeys(10)
+	err = keys.Revoke(context.Background(), coll, []byte("foo"))
+	c.Assert(err, qt.IsNil)
+	_, err = keys.NewStore(coll, mgorootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	}).Get(context.Background(), []byte("foo"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func TestEncryptedBackingRewrap(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	coll := testColl(c)
+	err := coll.Insert(&legacyRootKey{
+		Id:      "legacy",
+		RootKey: []byte("legacy key"),
+		Created: time.Now(),
+		Expires: time.Now().Add(10 * time.Minute),
+	})
+	c.Assert(err, qt.IsNil)
+	b := mgorootkeystore.NewRootKeys(10).Backing(coll)
+	err = b.InsertKey(dbrootkeystore.RootKey{
+		Created: time.Now(),
+		Expires: time.Now().Add(10 * time.Minute),
+		Id:      []byte("id0"),
+		RootKey: []byte("key0"),
+	})
+	c.Assert(err, qt.IsNil)
+	eb, err := dbrootkeystore.NewEncryptedBacking(b, dbrootkeystore.EncryptionParams{
+		KEKs: []dbrootkeystore.KEK{{
+			Version: 1,
+			Key:     bytes.Repeat([]byte{1}, 32),
+		}},
+		AllowPlaintext: true,
+	})
+	c.Assert(err, qt.IsNil)
+	n, err := eb.RewrapKeys(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	want := map[string]string{"legacy": "legacy key", "id0": "key0"}
+	for _, id := range []string{"legacy", "id0"} {
+		key, err := b.GetKey([]byte(id))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(key.RootKey), qt.Not(qt.Equals), want[id])
+		key, err = eb.GetKey([]byte(id))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(key.RootKey), qt.Equals, want[id])
+	}
+}
+
+func TestInsertKeyIfNoneInWindow(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	coll := testColl(c)
+	b := mgorootkeystore.NewRootKeys(10).Backing(coll).(dbrootkeystore.WindowInsertBacking)
+	ctx := context.Background()
+	now := time.Now().Round(time.Millisecond)
+	key0 := dbrootkeystore.RootKey{
+		Created: now,
+		Expires: now.Add(6 * time.Minute),
+		Id:      []byte("id0"),
+		RootKey: []byte("key0"),
+	}
+	key, err := b.InsertKeyIfNoneInWindow(ctx, key0, now.Add(-time.Minute), now.Add(5*time.Minute), now.Add(6*time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(key.Id), qt.Equals, "id0")
+	c.Assert(string(key.RootKey), qt.Equals, "key0")
+
+	// A second key in the same window is not inserted.
+	key1 := dbrootkeystore.RootKey{
+		Created: now.Add(time.Second),
+		Expires: now.Add(6*time.Minute + time.Second),
+		Id:      []byte("id1"),
+		RootKey: []byte("key1"),
+	}
+	key, err = b.InsertKeyIfNoneInWindow(ctx, key1, now.Add(-59*time.Second), now.Add(5*time.Minute+time.Second), now.Add(6*time.Minute+time.Second))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(key.Id), qt.Equals, "id0")
+	n, err := coll.Count()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+}
+
+func TestInsertKeyIfNoneInWindowConcurrent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	coll := testColl(c)
+	keys := mgorootkeystore.NewRootKeys(10)
+	err := keys.EnsureIndex(coll)
+	c.Assert(err, qt.IsNil)
+	b := keys.Backing(coll).(dbrootkeystore.WindowInsertBacking)
+	ctx := context.Background()
+	now := time.Now().Round(time.Millisecond)
+
+	// All the inserts use the same window, as they would if
+	// several servers generated a key at the same moment.
+	const n = 20
+	ids := make(chan string, n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			key, err := b.InsertKeyIfNoneInWindow(ctx, dbrootkeystore.RootKey{
+				Created: now,
+				Expires: now.Add(6 * time.Minute),
+				Id:      []byte(fmt.Sprint("id", i)),
+				RootKey: []byte(fmt.Sprint("key", i)),
+			}, now.Add(-time.Minute), now.Add(5*time.Minute), now.Add(6*time.Minute))
+			if err != nil {
+				c.Errorf("insert %d: %v", i, err)
+			}
+			ids <- string(key.Id)
+		}()
+	}
+	id := <-ids
+	for i := 1; i < n; i++ {
+		c.Check(<-ids, qt.Equals, id)
+	}
+	count, err := coll.Count()
+	c.Assert(err, qt.IsNil)
+	c.Assert(count, qt.Equals, 1)
+
+	// Once the key is revoked, another can be inserted
+	// in the same window.
+	err = keys.Revoke(ctx, coll, []byte(id))
+	c.Assert(err, qt.IsNil)
+	key, err := b.InsertKeyIfNoneInWindow(ctx, dbrootkeystore.RootKey{
+		Created: now,
+		Expires: now.Add(6 * time.Minute),
+		Id:      []byte("new"),
+		RootKey: []byte("newkey"),
+	}, now.Add(-time.Minute), now.Add(5*time.Minute), now.Add(6*time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(key.Id), qt.Equals, "new")
+}
+
+func TestCopyKeys(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	coll := testColl(c)
+	now := time.Now()
+	err := coll.Insert(&legacyRootKey{
+		Id:      "legacy",
+		RootKey: []byte("legacy key"),
+		Created: now,
+		Expires: now.Add(10 * time.Minute),
+	})
+	c.Assert(err, qt.IsNil)
+	keys := mgorootkeystore.NewRootKeys(10)
+	err = keys.Backing(coll).InsertKey(dbrootkeystore.RootKey{
+		Created: now,
+		Expires: now.Add(10 * time.Minute),
+		Id:      []byte("id0"),
+		RootKey: []byte("key0"),
+	})
+	c.Assert(err, qt.IsNil)
+
+	dst := coll.Database.C("rootkeyitems-copy")
+	n, err := dbrootkeystore.CopyKeys(context.Background(), keys.Backing(dst), keys.Backing(coll), now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	store := mgorootkeystore.NewRootKeys(10).NewStore(dst, mgorootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+	for id, want := range map[string]string{"legacy": "legacy key", "id0": "key0"} {
+		key, err := store.Get(context.Background(), []byte(id))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(key), qt.Equals, want)
+	}
+}
+
 func TestUsesSessionFromContext(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
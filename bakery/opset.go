@@ -0,0 +1,230 @@
+package bakery
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery/internal/macaroonpb"
+)
+
+// OpSetStore holds sets of operations on behalf of an Oven so that
+// macaroons associated with many operations need only hold a digest
+// of the operations in their id.
+//
+// See OvenParams.OpSetStore.
+type OpSetStore interface {
+	// Put stores the given operations under the given digest.
+	// The operations are in canonical order (see CanonicalOps).
+	// Putting the same set more than once should succeed.
+	Put(ctx context.Context, digest []byte, ops []Op) error
+
+	// Get returns the operations stored under the given digest.
+	// If they are not found, it returns an error with an
+	// ErrNotFound cause.
+	Get(ctx context.Context, digest []byte) ([]Op, error)
+}
+
+// NewMemOpSetStore returns an implementation of OpSetStore
+// that holds operation sets in memory.
+func NewMemOpSetStore() OpSetStore {
+	return &memOpSetStore{
+		sets: make(map[string][]Op),
+	}
+}
+
+type memOpSetStore struct {
+	mu   sync.Mutex
+	sets map[string][]Op
+}
+
+// Put implements OpSetStore.Put.
+func (s *memOpSetStore) Put(_ context.Context, digest []byte, ops []Op) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sets[string(digest)] = append([]Op(nil), ops...)
+	return nil
+}
+
+// Get implements OpSetStore.Get.
+func (s *memOpSetStore) Get(_ context.Context, digest []byte) ([]Op, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops, ok := s.sets[string(digest)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]Op(nil), ops...), nil
+}
+
+// defaultOpSetStoreMinOps holds the default value of
+// OvenParams.OpSetStoreMinOps.
+const defaultOpSetStoreMinOps = 32
+
+// opSetDigest returns the digest used to identify the given
+// canonical operations in an OpSetStore.
+func opSetDigest(ops []Op) []byte {
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	writeString := func(s string) {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+		h.Write([]byte(s))
+	}
+	for _, op := range ops {
+		writeString(op.Entity)
+		writeString(op.Action)
+	}
+	return h.Sum(nil)
+}
+
+// resolveOpSet returns the operations held in o.p.OpSetStore
+// under the given digest.
+func (o *Oven) resolveOpSet(ctx context.Context, digest []byte) ([]Op, error) {
+	if o.p.OpSetStore == nil {
+		return nil, errgo.Newf("macaroon operations are held in an op set store but none is configured")
+	}
+	ops, err := o.p.OpSetStore.Get(ctx, digest)
+	if err != nil {
+		if errgo.Cause(err) == ErrNotFound {
+			return nil, &VerificationError{
+				Reason: errgo.Newf("macaroon operations not found in op set store"),
+			}
+		}
+		return nil, errgo.Notef(err, "cannot get macaroon operations")
+	}
+	// Check that the store has returned the operations that
+	// the digest was made from.
+	if len(ops) == 0 || !bytes.Equal(opSetDigest(CanonicalOps(ops)), digest) {
+		return nil, errgo.Newf("op set store returned operations that do not match digest")
+	}
+	return CanonicalOps(ops), nil
+}
+
+// setIdOps sets the operations in the given id using the most
+// compact encoding allowed by the oven's parameters. It assumes
+// that ops has been canonicalized and that there's at least
+// one operation.
+func (o *Oven) setIdOps(ctx context.Context, id *macaroonpb.MacaroonId, ops []Op) error {
+	minOps := o.p.OpSetStoreMinOps
+	if minOps <= 0 {
+		minOps = defaultOpSetStoreMinOps
+	}
+	if o.p.OpSetStore != nil && len(ops) >= minOps {
+		digest := opSetDigest(ops)
+		if err := o.p.OpSetStore.Put(ctx, digest, ops); err != nil {
+			return errgo.Notef(err, "cannot store macaroon operations")
+		}
+		id.OpSetDigest = digest
+		return nil
+	}
+	id.Ops = macaroonIdOps(ops)
+	if !o.p.CompactOps {
+		return nil
+	}
+	literalSize := id.Size()
+	literalOps := id.Ops
+	id.Ops = nil
+	id.ActionDict, id.CompactOps = compactIdOps(ops)
+	if id.Size() >= literalSize {
+		id.Ops, id.ActionDict, id.CompactOps = literalOps, nil, nil
+	}
+	return nil
+}
+
+// compactIdOps returns the compact encoding of the given operations,
+// which must have been canonicalized. Each distinct action is held
+// once in the returned dictionary, and each entity is stored as
+// a suffix of the entity before it.
+func compactIdOps(ops []Op) ([]string, []*macaroonpb.CompactOp) {
+	actionIndex := make(map[string]uint32)
+	for _, op := range ops {
+		actionIndex[op.Action] = 0
+	}
+	dict := make([]string, 0, len(actionIndex))
+	for action := range actionIndex {
+		dict = append(dict, action)
+	}
+	sort.Strings(dict)
+	for i, action := range dict {
+		actionIndex[action] = uint32(i)
+	}
+	var cops []*macaroonpb.CompactOp
+	prevEntity := ""
+	for i, op := range ops {
+		if i > 0 && op.Entity == ops[i-1].Entity {
+			cop := cops[len(cops)-1]
+			cop.Actions = append(cop.Actions, actionIndex[op.Action])
+			continue
+		}
+		n := commonPrefixLen(prevEntity, op.Entity)
+		cops = append(cops, &macaroonpb.CompactOp{
+			PrefixLen:    uint32(n),
+			EntitySuffix: op.Entity[n:],
+			Actions:      []uint32{actionIndex[op.Action]},
+		})
+		prevEntity = op.Entity
+	}
+	return dict, cops
+}
+
+// commonPrefixLen returns the length of the longest common prefix of
+// s0 and s1 that does not split a UTF-8 sequence in s1, so that the
+// remainder of s1 is valid UTF-8 if s1 is.
+func commonPrefixLen(s0, s1 string) int {
+	n := 0
+	for n < len(s0) && n < len(s1) && s0[n] == s1[n] {
+		n++
+	}
+	for n > 0 && n < len(s1) && !utf8.RuneStart(s1[n]) {
+		n--
+	}
+	return n
+}
+
+// Limits on the size of the operations that expandCompactIdOps will
+// produce. Because each entity can reuse all of the entity before it,
+// the expanded size can grow quadratically with the size of the id,
+// and ids are expanded before their signature can be checked (the
+// operations are needed to find the root key), so without these
+// limits a small forged id could use a large amount of memory.
+const (
+	maxCompactIdOps         = 4096
+	maxCompactIdEntityBytes = 1 << 20
+)
+
+// expandCompactIdOps returns the operations encoded by compactIdOps.
+func expandCompactIdOps(dict []string, cops []*macaroonpb.CompactOp) ([]Op, error) {
+	var ops []Op
+	prevEntity := ""
+	entityBytes := 0
+	for _, cop := range cops {
+		if int(cop.PrefixLen) > len(prevEntity) {
+			return nil, errgo.Newf("invalid entity prefix length in macaroon id")
+		}
+		if len(ops)+len(cop.Actions) > maxCompactIdOps {
+			return nil, errgo.Newf("too many operations in macaroon id")
+		}
+		entityBytes += int(cop.PrefixLen) + len(cop.EntitySuffix)
+		if entityBytes > maxCompactIdEntityBytes {
+			return nil, errgo.Newf("macaroon id operations too large")
+		}
+		entity := prevEntity[:cop.PrefixLen] + cop.EntitySuffix
+		for _, i := range cop.Actions {
+			if int(i) >= len(dict) {
+				return nil, errgo.Newf("invalid action index in macaroon id")
+			}
+			ops = append(ops, Op{
+				Entity: entity,
+				Action: dict[i],
+			})
+		}
+		prevEntity = entity
+	}
+	return ops, nil
+}
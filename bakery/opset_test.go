@@ -0,0 +1,325 @@
+package bakery_test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon.v2"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/internal/macaroonpb"
+)
+
+func manyOps(n int) []bakery.Op {
+	ops := make([]bakery.Op, 0, 2*n)
+	for i := 0; i < n; i++ {
+		entity := fmt.Sprintf("/models/user-bob/model-%04d", i)
+		ops = append(ops, bakery.Op{entity, "read"}, bakery.Op{entity, "write"})
+	}
+	return bakery.CanonicalOps(ops)
+}
+
+func TestCompactOps(t *testing.T) {
+	c := qt.New(t)
+	store := bakery.NewMemRootKeyStore()
+	newOven := func(compact bool) *bakery.Oven {
+		return bakery.NewOven(bakery.OvenParams{
+			RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+				return store
+			},
+			CompactOps: compact,
+		})
+	}
+	literalOven := newOven(false)
+	compactOven := newOven(true)
+
+	ops := manyOps(100)
+	m0, err := literalOven.NewMacaroon(testContext, bakery.LatestVersion, nil, ops...)
+	c.Assert(err, qt.IsNil)
+	m1, err := compactOven.NewMacaroon(testContext, bakery.LatestVersion, nil, ops...)
+	c.Assert(err, qt.IsNil)
+	c.Assert(len(m1.M().Id()) < len(m0.M().Id())/2, qt.Equals, true, qt.Commentf("literal %d; compact %d", len(m0.M().Id()), len(m1.M().Id())))
+
+	info, err := bakery.ParseMacaroonId(m1.M().Id())
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Ops, qt.DeepEquals, ops)
+
+	// Both ovens can verify both macaroons.
+	for _, oven := range []*bakery.Oven{literalOven, compactOven} {
+		for _, m := range []*bakery.Macaroon{m0, m1} {
+			gotOps, _, err := oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+			c.Assert(err, qt.IsNil)
+			c.Assert(gotOps, qt.DeepEquals, ops)
+		}
+	}
+}
+
+var compactOpsLimitTests = []struct {
+	about       string
+	cops        func() []*macaroonpb.CompactOp
+	expectError string
+}{{
+	about: "entities too large",
+	cops: func() []*macaroonpb.CompactOp {
+		// Each entity reuses all of the previous one, so the
+		// expanded entities would total about 50MB.
+		cops := make([]*macaroonpb.CompactOp, 10000)
+		for i := range cops {
+			cops[i] = &macaroonpb.CompactOp{
+				PrefixLen:    uint32(i),
+				EntitySuffix: "x",
+				Actions:      []uint32{0},
+			}
+		}
+		return cops
+	},
+	expectError: `macaroon id operations too large`,
+}, {
+	about: "too many operations",
+	cops: func() []*macaroonpb.CompactOp {
+		return []*macaroonpb.CompactOp{{
+			EntitySuffix: "x",
+			Actions:      make([]uint32, 100000),
+		}}
+	},
+	expectError: `too many operations in macaroon id`,
+}}
+
+func TestCompactOpsLimits(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range compactOpsLimitTests {
+		c.Run(test.about, func(c *qt.C) {
+			id := macaroonpb.MacaroonId{
+				Nonce:      []byte("nonce"),
+				StorageId:  []byte("0"),
+				ActionDict: []string{"read"},
+				CompactOps: test.cops(),
+			}
+			data, err := id.MarshalBinary()
+			c.Assert(err, qt.IsNil)
+			data = append([]byte{byte(bakery.Version3)}, data...)
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err = bakery.ParseMacaroonId(data)
+			runtime.ReadMemStats(&after)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			// The id is rejected before much memory is used.
+			allocated := after.TotalAlloc - before.TotalAlloc
+			c.Assert(allocated < 8<<20, qt.Equals, true, qt.Commentf("allocated %d bytes", allocated))
+		})
+	}
+}
+
+func TestCompactOpsNotUsedWhenLarger(t *testing.T) {
+	c := qt.New(t)
+	store := bakery.NewMemRootKeyStore()
+	newOven := func(compact bool) *bakery.Oven {
+		return bakery.NewOven(bakery.OvenParams{
+			RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+				return store
+			},
+			CompactOps: compact,
+		})
+	}
+	op := bakery.Op{"entity", "read"}
+	m0, err := newOven(false).NewMacaroon(testContext, bakery.LatestVersion, nil, op)
+	c.Assert(err, qt.IsNil)
+	m1, err := newOven(true).NewMacaroon(testContext, bakery.LatestVersion, nil, op)
+	c.Assert(err, qt.IsNil)
+	c.Assert(len(m1.M().Id()), qt.Equals, len(m0.M().Id()))
+}
+
+var compactOpsRoundTripTests = []struct {
+	about string
+	ops   []bakery.Op
+}{{
+	about: "single op",
+	ops:   []bakery.Op{{"a", "b"}},
+}, {
+	about: "empty entity and action",
+	ops:   []bakery.Op{{"", ""}, {"", "x"}, {"a", ""}},
+}, {
+	about: "entity that is a prefix of the next",
+	ops:   []bakery.Op{{"abc", "read"}, {"abcd", "read"}, {"abcde", "write"}},
+}, {
+	about: "prefix shorter than previous entity",
+	ops:   []bakery.Op{{"abcdef", "read"}, {"abd", "read"}, {"b", "read"}},
+}, {
+	about: "multi-byte characters sharing a leading byte",
+	ops:   []bakery.Op{{"xè", "read"}, {"xé", "read"}, {"xéé", "read"}},
+}, {
+	about: "many ops",
+	ops:   manyOps(50),
+}}
+
+func TestCompactOpsRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{
+		CompactOps: true,
+	})
+	for _, test := range compactOpsRoundTripTests {
+		c.Run(test.about, func(c *qt.C) {
+			ops := bakery.CanonicalOps(test.ops)
+			m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, ops...)
+			c.Assert(err, qt.IsNil)
+			gotOps, _, err := oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+			c.Assert(err, qt.IsNil)
+			c.Assert(gotOps, qt.DeepEquals, ops)
+		})
+	}
+}
+
+func TestOpSetStore(t *testing.T) {
+	c := qt.New(t)
+	store := bakery.NewMemRootKeyStore()
+	opSets := bakery.NewMemOpSetStore()
+	newOven := func(opSets bakery.OpSetStore) *bakery.Oven {
+		return bakery.NewOven(bakery.OvenParams{
+			RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+				return store
+			},
+			OpSetStore:       opSets,
+			OpSetStoreMinOps: 4,
+		})
+	}
+	oven := newOven(opSets)
+
+	ops := manyOps(100)
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, ops...)
+	c.Assert(err, qt.IsNil)
+	c.Assert(len(m.M().Id()) < 100, qt.Equals, true, qt.Commentf("id length %d", len(m.M().Id())))
+
+	info, err := bakery.ParseMacaroonId(m.M().Id())
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Ops, qt.HasLen, 0)
+	c.Assert(info.OpSetDigest, qt.HasLen, 32)
+
+	gotOps, _, err := oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(gotOps, qt.DeepEquals, ops)
+
+	info, _, err = oven.VerifyMacaroonIdInfo(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Ops, qt.DeepEquals, ops)
+
+	// Another oven sharing the store can verify the macaroon.
+	gotOps, _, err = newOven(opSets).VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(gotOps, qt.DeepEquals, ops)
+
+	// An oven with a different store cannot.
+	_, _, err = newOven(bakery.NewMemOpSetStore()).VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.ErrorMatches, `verification failed: macaroon operations not found in op set store`)
+	_, ok := errgo.Cause(err).(*bakery.VerificationError)
+	c.Assert(ok, qt.Equals, true)
+
+	// An oven without a store cannot either.
+	_, _, err = newOven(nil).VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.ErrorMatches, `macaroon operations are held in an op set store but none is configured`)
+
+	// Macaroons with fewer operations hold them in the id.
+	m, err = oven.NewMacaroon(testContext, bakery.LatestVersion, nil, ops[:3]...)
+	c.Assert(err, qt.IsNil)
+	info, err = bakery.ParseMacaroonId(m.M().Id())
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Ops, qt.DeepEquals, ops[:3])
+	c.Assert(info.OpSetDigest, qt.IsNil)
+}
+
+func TestOpSetStoreMismatch(t *testing.T) {
+	c := qt.New(t)
+	opSets := &tamperingOpSetStore{
+		OpSetStore: bakery.NewMemOpSetStore(),
+	}
+	oven := bakery.NewOven(bakery.OvenParams{
+		OpSetStore:       opSets,
+		OpSetStoreMinOps: 1,
+	})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	opSets.extra = &bakery.Op{"entity", "write"}
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.ErrorMatches, `op set store returned operations that do not match digest`)
+}
+
+func TestCheckerGetsOpSetOnce(t *testing.T) {
+	c := qt.New(t)
+	opSets := &tamperingOpSetStore{
+		OpSetStore: bakery.NewMemOpSetStore(),
+	}
+	oven := bakery.NewOven(bakery.OvenParams{
+		OpSetStore:       opSets,
+		OpSetStoreMinOps: 1,
+	})
+	op := bakery.Op{"entity", "read"}
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, op)
+	c.Assert(err, qt.IsNil)
+	checker := bakery.NewChecker(bakery.CheckerParams{
+		MacaroonVerifier: oven,
+	})
+	authInfo, err := checker.Auth(macaroon.Slice{m.M()}).Allow(testContext, op)
+	c.Assert(err, qt.IsNil)
+	c.Assert(authInfo.MacaroonIds[0].Ops, qt.DeepEquals, []bakery.Op{op})
+	// The operations found when verifying the macaroon
+	// are reused for its id information.
+	c.Assert(opSets.gets, qt.Equals, 1)
+}
+
+func TestOpSetStorePutError(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{
+		OpSetStore: &tamperingOpSetStore{
+			putErr: errgo.New("some error"),
+		},
+		OpSetStoreMinOps: 1,
+	})
+	_, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.ErrorMatches, `cannot store macaroon operations: some error`)
+}
+
+func TestMemOpSetStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	store := bakery.NewMemOpSetStore()
+	_, err := store.Get(ctx, []byte("digest"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+
+	ops := []bakery.Op{{"a", "read"}, {"b", "write"}}
+	err = store.Put(ctx, []byte("digest"), ops)
+	c.Assert(err, qt.IsNil)
+	ops[0].Action = "changed"
+	gotOps, err := store.Get(ctx, []byte("digest"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(gotOps, qt.DeepEquals, []bakery.Op{{"a", "read"}, {"b", "write"}})
+}
+
+// tamperingOpSetStore wraps an OpSetStore to return
+// errors or unexpected operations. It also counts
+// calls to Get.
+type tamperingOpSetStore struct {
+	bakery.OpSetStore
+	extra  *bakery.Op
+	putErr error
+	gets   int
+}
+
+func (s *tamperingOpSetStore) Put(ctx context.Context, digest []byte, ops []bakery.Op) error {
+	if s.putErr != nil {
+		return s.putErr
+	}
+	return s.OpSetStore.Put(ctx, digest, ops)
+}
+
+func (s *tamperingOpSetStore) Get(ctx context.Context, digest []byte) ([]bakery.Op, error) {
+	s.gets++
+	ops, err := s.OpSetStore.Get(ctx, digest)
+	if err != nil || s.extra == nil {
+		return ops, err
+	}
+	return append(ops, *s.extra), nil
+}
@@ -1,10 +1,11 @@
 package bakery
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"sort"
+	"time"
 
 	"github.com/rogpeppe/fastuuid"
 	errgo "gopkg.in/errgo.v1"
@@ -30,6 +31,17 @@ type MacaroonVerifier interface {
 	VerifyMacaroon(ctx context.Context, ms macaroon.Slice) ([]Op, []string, error)
 }
 
+// MacaroonIdInfoVerifier may be implemented by a MacaroonVerifier to
+// report the information held in the ids of the macaroons that it
+// verifies. If it is implemented, Checker uses it instead of
+// VerifyMacaroon and fills out AuthInfo.MacaroonIds.
+type MacaroonIdInfoVerifier interface {
+	// VerifyMacaroonIdInfo is like VerifyMacaroon except that
+	// it returns all the information held in the id of the
+	// given macaroon, including its operations.
+	VerifyMacaroonIdInfo(ctx context.Context, ms macaroon.Slice) (*MacaroonIdInfo, []string, error)
+}
+
 var uuidGen = fastuuid.MustNewGenerator()
 
 // Oven bakes macaroons. They emerge sweet and delicious
@@ -45,6 +57,10 @@ var uuidGen = fastuuid.MustNewGenerator()
 // It is up to the caller to decide on semantics for other operations.
 type Oven struct {
 	p OvenParams
+
+	// verifyCache holds the verification cache, or nil if
+	// VerificationCacheSize is not positive.
+	verifyCache *verifyCache
 }
 
 type OvenParams struct {
@@ -58,6 +74,8 @@ type OvenParams struct {
 	//
 	// If this is nil, NewMemRootKeyStore will be used to create
 	// a new store to be used for all entities.
+	//
+	// See RootKeyRouter for a way to choose stores declaratively.
 	RootKeyStoreForOps func(ops []Op) RootKeyStore
 
 	// Key holds the private key pair used to encrypt third party caveats.
@@ -79,6 +97,59 @@ type OvenParams struct {
 	// with any operations.
 	LegacyMacaroonOp Op
 
+	// RevocationStore, if non-nil, is used by VerifyMacaroon to
+	// reject macaroons that have been revoked with
+	// Oven.RevokeMacaroon.
+	RevocationStore RevocationStore
+
+	// Issuer holds a name identifying the service instance that
+	// mints macaroons with this oven, for example a host name.
+	// It is recorded in the ids of new macaroons.
+	Issuer string
+
+	// Labels holds arbitrary metadata to record in the ids of
+	// new macaroons. Note that it increases the size of every
+	// macaroon.
+	Labels map[string]string
+
+	// RecordIssueTime specifies that the time that each macaroon
+	// is minted is recorded in its id, to the nearest second.
+	RecordIssueTime bool
+
+	// Clock is used to obtain the issue time when RecordIssueTime
+	// is true. If it is nil, the current time is used.
+	Clock checkers.Clock
+
+	// VerificationCacheSize, if positive, holds the maximum number
+	// of successful verifications that VerifyMacaroon will cache.
+	// A cached result avoids recomputing the signature of a
+	// macaroon slice that has already been verified. The root key
+	// is still fetched from the root key store on every call, so
+	// a macaroon is rejected as soon as the store no longer returns
+	// its root key (because it has expired or been revoked). Failed
+	// verifications are never cached, and the RevocationStore is
+	// always consulted.
+	VerificationCacheSize int
+
+	// CompactOps specifies that operations are recorded in the ids
+	// of new macaroons using a dictionary of actions and entity
+	// names that share prefixes with their predecessors, when that
+	// is smaller than listing them literally. Such macaroons cannot
+	// be verified by versions of the bakery that predate the
+	// encoding.
+	CompactOps bool
+
+	// OpSetStore, if non-nil, is used to hold the operations of
+	// macaroons associated with at least OpSetStoreMinOps
+	// operations, so that their ids need only hold a digest of
+	// the operations. Any oven that verifies such macaroons must
+	// use a store holding the same operation sets.
+	OpSetStore OpSetStore
+
+	// OpSetStoreMinOps holds the minimum number of operations
+	// that will be held in OpSetStore. If it is zero, 32 is used.
+	OpSetStoreMinOps int
+
 	// TODO max macaroon or macaroon id size?
 }
 
@@ -96,9 +167,13 @@ func NewOven(p OvenParams) *Oven {
 	if p.Namespace == nil {
 		p.Namespace = checkers.New(nil).Namespace()
 	}
-	return &Oven{
+	o := &Oven{
 		p: p,
 	}
+	if p.VerificationCacheSize > 0 {
+		o.verifyCache = newVerifyCache(p.VerificationCacheSize)
+	}
+	return o
 }
 
 // VerifyMacaroon implements MacaroonVerifier.VerifyMacaroon, making Oven
@@ -107,14 +182,26 @@ func NewOven(p OvenParams) *Oven {
 // For macaroons minted with previous bakery versions, it always
 // returns a single LoginOp operation.
 func (o *Oven) VerifyMacaroon(ctx context.Context, ms macaroon.Slice) (ops []Op, conditions []string, err error) {
+	info, conditions, err := o.VerifyMacaroonIdInfo(ctx, ms)
+	if err != nil {
+		// Return the error unchanged so that callers can
+		// still check for *VerificationError directly.
+		return nil, nil, err
+	}
+	return info.Ops, conditions, nil
+}
+
+// VerifyMacaroonIdInfo implements
+// MacaroonIdInfoVerifier.VerifyMacaroonIdInfo.
+func (o *Oven) VerifyMacaroonIdInfo(ctx context.Context, ms macaroon.Slice) (*MacaroonIdInfo, []string, error) {
 	if len(ms) == 0 {
 		return nil, nil, errgo.Newf("no macaroons in slice")
 	}
-	storageId, ops, err := o.decodeMacaroonId(ms[0].Id())
+	info, err := o.macaroonIdInfo(ctx, ms[0].Id())
 	if err != nil {
-		return nil, nil, errgo.Mask(err)
+		return nil, nil, errgo.Mask(err, isVerificationError)
 	}
-	rootKey, err := o.p.RootKeyStoreForOps(ops).Get(ctx, storageId)
+	rootKey, err := o.p.RootKeyStoreForOps(info.Ops).Get(ctx, info.StorageId)
 	if err != nil {
 		if errgo.Cause(err) != ErrNotFound {
 			return nil, nil, errgo.Notef(err, "cannot get macaroon")
@@ -126,73 +213,73 @@ func (o *Oven) VerifyMacaroon(ctx context.Context, ms macaroon.Slice) (ops []Op,
 			Reason: errgo.Newf("macaroon not found in storage"),
 		}
 	}
-	conditions, err = ms[0].VerifySignature(rootKey, ms[1:])
+	conditions, cacheKey, err := o.verifySignature(ms, rootKey)
 	if err != nil {
 		return nil, nil, &VerificationError{
 			Reason: errgo.Mask(err),
 		}
 	}
-	return ops, conditions, nil
-}
-
-func (o *Oven) decodeMacaroonId(id []byte) (storageId []byte, ops []Op, err error) {
-	base64Decoded := false
-	if id[0] == 'A' {
-		// The first byte is not a version number and it's 'A', which is the
-		// base64 encoding of the top 6 bits (all zero) of the version number 2 or 3,
-		// so we assume that it's the base64 encoding of a new-style
-		// macaroon id, so we base64 decode it.
-		//
-		// Note that old-style ids always start with an ASCII character >= 4
-		// (> 32 in fact) so this logic won't be triggered for those.
-		dec := make([]byte, base64.RawURLEncoding.DecodedLen(len(id)))
-		n, err := base64.RawURLEncoding.Decode(dec, id)
-		if err == nil {
-			// Set the id only on success - if it's a bad encoding, we'll get a not-found error
-			// which is fine because "not found" is a correct description of the issue - we
-			// can't find the root key for the given id.
-			id = dec[0:n]
-			base64Decoded = true
+	if o.p.RevocationStore != nil && len(info.Nonce) > 0 {
+		// Check for revocation only after the signature has been
+		// verified so that forged macaroons cannot be used to
+		// probe the revocation store.
+		revoked, err := o.p.RevocationStore.IsRevoked(ctx, info.Nonce)
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "cannot check macaroon revocation")
 		}
-	}
-	// Trim any extraneous information from the id before retrieving
-	// it from storage, including the UUID that's added when
-	// creating macaroons to make all macaroons unique even if
-	// they're using the same root key.
-	switch id[0] {
-	case byte(Version2):
-		// Skip the UUID at the start of the id.
-		storageId = id[1+16:]
-	case byte(Version3):
-		var id1 macaroonpb.MacaroonId
-		if err := id1.UnmarshalBinary(id[1:]); err != nil {
-			return nil, nil, errgo.Notef(err, "cannot unmarshal macaroon id")
-		}
-		if len(id1.Ops) == 0 || len(id1.Ops[0].Actions) == 0 {
-			return nil, nil, errgo.Newf("no operations found in macaroon")
-		}
-		ops = make([]Op, 0, len(id1.Ops))
-		for _, op := range id1.Ops {
-			for _, action := range op.Actions {
-				ops = append(ops, Op{
-					Entity: op.Entity,
-					Action: action,
-				})
+		if revoked {
+			if o.verifyCache != nil {
+				o.verifyCache.remove(cacheKey)
+			}
+			return nil, nil, &VerificationError{
+				Reason: errgo.Newf("macaroon has been revoked"),
 			}
 		}
-		return id1.StorageId, ops, nil
 	}
-	if !base64Decoded && isLowerCaseHexChar(id[0]) {
-		// It's an old-style id, probably with a hyphenated UUID.
-		// so trim that off.
-		if i := bytes.LastIndexByte(id, '-'); i >= 0 {
-			storageId = id[0:i]
+	return info, conditions, nil
+}
+
+// verifySignature verifies the signature of the given slice
+// with the given root key and returns its first party caveat
+// conditions, using the verification cache if there is one.
+// It also returns the cache key for the slice.
+func (o *Oven) verifySignature(ms macaroon.Slice, rootKey []byte) ([]string, [sha256.Size]byte, error) {
+	if o.verifyCache == nil {
+		conditions, err := ms[0].VerifySignature(rootKey, ms[1:])
+		return conditions, [sha256.Size]byte{}, err
+	}
+	key := verifyCacheKey(ms)
+	if conditions, ok := o.verifyCache.get(key, rootKey); ok {
+		return conditions, key, nil
+	}
+	conditions, err := ms[0].VerifySignature(rootKey, ms[1:])
+	if err != nil {
+		return nil, key, err
+	}
+	o.verifyCache.add(key, rootKey, conditions)
+	return conditions, key, nil
+}
+
+// macaroonIdInfo returns the information held in the given macaroon
+// id. Old-style ids are associated with o.p.LegacyMacaroonOp, and
+// operations held in o.p.OpSetStore are resolved.
+func (o *Oven) macaroonIdInfo(ctx context.Context, id []byte) (*MacaroonIdInfo, error) {
+	info, err := parseMacaroonId(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(info.OpSetDigest) > 0 {
+		info.Ops, err = o.resolveOpSet(ctx, info.OpSetDigest)
+		if err != nil {
+			return nil, errgo.Mask(err, isVerificationError)
 		}
 	}
-	if op := o.p.LegacyMacaroonOp; op != (Op{}) {
-		ops = []Op{op}
+	if info.Version < Version3 {
+		if op := o.p.LegacyMacaroonOp; op != (Op{}) {
+			info.Ops = []Op{op}
+		}
 	}
-	return storageId, ops, nil
+	return info, nil
 }
 
 // NewMacaroon takes a macaroon with the given version from the oven, associates it with the given operations
@@ -215,7 +302,8 @@ func (o *Oven) NewMacaroon(ctx context.Context, version Version, caveats []check
 		return nil, errgo.Mask(err)
 	}
 	idBytes := make([]byte, len(idBytesNoVersion)+1)
-	idBytes[0] = byte(LatestVersion)
+	// The macaroon id format has not changed since Version3.
+	idBytes[0] = byte(Version3)
 	// TODO We could use a proto.Buffer to avoid this copy.
 	copy(idBytes[1:], idBytesNoVersion)
 
@@ -290,11 +378,23 @@ func CanonicalOps(ops []Op) []Op {
 func (o *Oven) newMacaroonId(ctx context.Context, ops []Op, storageId []byte) (*macaroonpb.MacaroonId, error) {
 	uuid := uuidGen.Next()
 	nonce := uuid[0:16]
-	return &macaroonpb.MacaroonId{
+	id := &macaroonpb.MacaroonId{
 		Nonce:     nonce,
 		StorageId: storageId,
-		Ops:       macaroonIdOps(ops),
-	}, nil
+		Issuer:    o.p.Issuer,
+		Labels:    o.p.Labels,
+	}
+	if err := o.setIdOps(ctx, id, ops); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if o.p.RecordIssueTime {
+		now := time.Now()
+		if o.p.Clock != nil {
+			now = o.p.Clock.Now()
+		}
+		id.IssuedAt = now.Unix()
+	}
+	return id, nil
 }
 
 // macaroonIdOps returns operations suitable for serializing
@@ -2,6 +2,7 @@ package bakery_test
 
 import (
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"gopkg.in/macaroon.v2"
@@ -85,3 +86,48 @@ func TestMultipleOpsInIdWithVersion1(t *testing.T) {
 	c.Assert(conds, qt.HasLen, 0)
 	c.Assert(bakery.CanonicalOps(gotOps), qt.DeepEquals, ops)
 }
+
+func TestMacaroonIdMetadata(t *testing.T) {
+	c := qt.New(t)
+	issueTime := time.Date(2020, 5, 1, 12, 30, 15, 500, time.UTC)
+	oven := bakery.NewOven(bakery.OvenParams{
+		Issuer:          "host-1",
+		Labels:          map[string]string{"region": "eu"},
+		RecordIssueTime: true,
+		Clock:           stoppedClock{issueTime},
+	})
+	op := bakery.Op{"one", "read"}
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, op)
+	c.Assert(err, qt.IsNil)
+
+	info, err := bakery.ParseMacaroonId(m.M().Id())
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Issuer, qt.Equals, "host-1")
+	c.Assert(info.Labels, qt.DeepEquals, map[string]string{"region": "eu"})
+	c.Assert(info.IssuedAt, qt.DeepEquals, time.Date(2020, 5, 1, 12, 30, 15, 0, time.UTC))
+
+	// The information is available in the AuthInfo.
+	checker := bakery.NewChecker(bakery.CheckerParams{
+		MacaroonVerifier: oven,
+	})
+	// A macaroon from another oven is not valid.
+	m1, err := bakery.NewOven(bakery.OvenParams{}).NewMacaroon(testContext, bakery.LatestVersion, nil, op)
+	c.Assert(err, qt.IsNil)
+	authInfo, err := checker.Auth(macaroon.Slice{m.M()}, macaroon.Slice{m1.M()}).Allow(testContext, op)
+	c.Assert(err, qt.IsNil)
+	c.Assert(authInfo.MacaroonIds, qt.HasLen, 2)
+	c.Assert(authInfo.MacaroonIds[0], qt.DeepEquals, info)
+	c.Assert(authInfo.MacaroonIds[1], qt.IsNil)
+}
+
+func TestMacaroonIdWithoutMetadata(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"one", "read"})
+	c.Assert(err, qt.IsNil)
+	info, err := bakery.ParseMacaroonId(m.M().Id())
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.IssuedAt.IsZero(), qt.Equals, true)
+	c.Assert(info.Issuer, qt.Equals, "")
+	c.Assert(info.Labels, qt.HasLen, 0)
+}
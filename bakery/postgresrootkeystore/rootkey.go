@@ -3,6 +3,7 @@
 package postgresrootkeystore
 
 import (
+	"context"
 	"database/sql"
 	"sync"
 	"time"
@@ -99,23 +100,133 @@ func (s *RootKeys) NewStore(policy Policy) bakery.RootKeyStore {
 	return s.keys.NewStore(b, dbrootkeystore.Policy(policy))
 }
 
-// backing implements dbrootkeystore.Backing by using Postgres as
-// a backing store.
+// Backing returns the dbrootkeystore.Backing used by the store. It can be
+// used to wrap the backing (for example with
+// dbrootkeystore.NewEncryptedBacking) or to copy keys between stores.
+func (s *RootKeys) Backing() dbrootkeystore.Backing {
+	return newBacking(s)
+}
+
+// DeleteExpired deletes all keys that expired before the given
+// time from the database and from the cache.
+func (s *RootKeys) DeleteExpired(ctx context.Context, before time.Time) error {
+	return s.keys.DeleteExpired(ctx, newBacking(s), before)
+}
+
+// StartCollector starts a goroutine that periodically deletes expired
+// keys from the Postgres table. The returned stop function should be
+// called before the RootKeys instance is closed. See
+// dbrootkeystore.RootKeys.StartCollector for details.
+func (s *RootKeys) StartCollector(interval time.Duration, logger bakery.Logger) (stop func(), err error) {
+	return s.keys.StartCollector(newBacking(s), interval, logger)
+}
+
+// Revoke revokes the key with the given id so that no macaroon
+// minted with it will verify any longer. Other RootKeys instances
+// using the same database will stop using the key within their
+// revalidate interval (see SetRevalidateInterval).
+//
+// If the key is not found, Revoke returns an error with a
+// bakery.ErrNotFound cause.
+func (s *RootKeys) Revoke(ctx context.Context, id []byte) error {
+	return s.keys.Revoke(ctx, newBacking(s), id)
+}
+
+// SetRevalidateInterval sets the maximum length of time that a key
+// will be served from the cache before it is fetched again from the
+// database. This bounds the time it takes for a key revoked by
+// another RootKeys instance to stop being used by this one. If d is
+// zero (the default), cached keys are never revalidated.
+func (s *RootKeys) SetRevalidateInterval(d time.Duration) {
+	s.keys.SetRevalidateInterval(d)
+}
+
+// SetNegativeTTL sets the maximum length of time that a lookup of a
+// key that was not found in the database will be answered from the
+// cache. If d is zero (the default), only the revalidate interval
+// applies to such lookups.
+func (s *RootKeys) SetNegativeTTL(d time.Duration) {
+	s.keys.SetNegativeTTL(d)
+}
+
+// SetObserver sets the observer that is notified of cache hits,
+// cache misses, key generation, key expiry and backing store errors.
+// If o is nil, events are ignored (the default).
+func (s *RootKeys) SetObserver(o dbrootkeystore.Observer) {
+	s.keys.SetObserver(o)
+}
+
+// CacheStats returns statistics about the key cache.
+func (s *RootKeys) CacheStats() dbrootkeystore.CacheStats {
+	return s.keys.CacheStats()
+}
+
+// backing implements dbrootkeystore.Backing and
+// dbrootkeystore.ContextBacking by using Postgres as a backing store.
 type backing struct {
 	keys *RootKeys
 }
 
+var _ dbrootkeystore.Backing = backing{}
+var _ dbrootkeystore.ContextBacking = backing{}
+var _ dbrootkeystore.ExpiryBacking = backing{}
+var _ dbrootkeystore.RevocationBacking = backing{}
+var _ dbrootkeystore.IterBacking = backing{}
+var _ dbrootkeystore.UpdateBacking = backing{}
+var _ dbrootkeystore.WindowInsertBacking = backing{}
+
 // GetKey implements dbrootkeystore.Backing.GetKey.
 func (b backing) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
-	return b.keys.getKey(id)
+	return b.keys.getKey(context.Background(), id)
+}
+
+// GetKeyContext implements dbrootkeystore.ContextBacking.GetKeyContext.
+func (b backing) GetKeyContext(ctx context.Context, id []byte) (dbrootkeystore.RootKey, error) {
+	return b.keys.getKey(ctx, id)
 }
 
 // InsertKey implements dbrootkeystore.Backing.InsertKey.
 func (b backing) InsertKey(key dbrootkeystore.RootKey) error {
-	return b.keys.insertKey(key)
+	return b.keys.insertKey(context.Background(), key)
+}
+
+// InsertKeyContext implements dbrootkeystore.ContextBacking.InsertKeyContext.
+func (b backing) InsertKeyContext(ctx context.Context, key dbrootkeystore.RootKey) error {
+	return b.keys.insertKey(ctx, key)
 }
 
 // FindLatestKey implements dbrootkeystore.Backing.FindLatestKey.
 func (b backing) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
-	return b.keys.findLatestKey(createdAfter, expiresAfter, expiresBefore)
+	return b.keys.findLatestKey(context.Background(), createdAfter, expiresAfter, expiresBefore)
+}
+
+// FindLatestKeyContext implements dbrootkeystore.ContextBacking.FindLatestKeyContext.
+func (b backing) FindLatestKeyContext(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	return b.keys.findLatestKey(ctx, createdAfter, expiresAfter, expiresBefore)
+}
+
+// DeleteExpiredKeys implements dbrootkeystore.ExpiryBacking.DeleteExpiredKeys.
+func (b backing) DeleteExpiredKeys(ctx context.Context, before time.Time) error {
+	return b.keys.deleteExpired(ctx, before)
+}
+
+// RevokeKey implements dbrootkeystore.RevocationBacking.RevokeKey.
+func (b backing) RevokeKey(ctx context.Context, id []byte) error {
+	return b.keys.revokeKey(ctx, id)
+}
+
+// ForEachKey implements dbrootkeystore.IterBacking.ForEachKey.
+func (b backing) ForEachKey(ctx context.Context, f func(dbrootkeystore.RootKey) error) error {
+	return b.keys.forEachKey(ctx, f)
+}
+
+// UpdateKey implements dbrootkeystore.UpdateBacking.UpdateKey.
+func (b backing) UpdateKey(ctx context.Context, key dbrootkeystore.RootKey) error {
+	return b.keys.updateKey(ctx, key)
+}
+
+// InsertKeyIfNoneInWindow implements
+// dbrootkeystore.WindowInsertBacking.InsertKeyIfNoneInWindow.
+func (b backing) InsertKeyIfNoneInWindow(ctx context.Context, key dbrootkeystore.RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	return b.keys.insertKeyIfNoneInWindow(ctx, key, createdAfter, expiresAfter, expiresBefore)
 }
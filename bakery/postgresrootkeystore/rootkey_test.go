@@ -1,6 +1,7 @@
 package postgresrootkeystore_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"testing"
@@ -362,16 +363,12 @@ func (s *RootKeyStoreSuite) TestGet(c *qt.C) {
 	}
 	// Check that the keys are cached.
 	//
-	// Since the cache size is 5, the most recent 5 items will be in
-	// the primary cache; the 5 items before that will be in the old
-	// cache and nothing else will be cached.
+	// Since the cache size is 5, only the 5 most recently used
+	// items will be cached. We fetch the keys most recent first,
+	// so each fetch of an uncached key evicts the least recently
+	// used key, which is never one that we go on to fetch.
 	//
-	// The first time we fetch an item from the old cache, a new
-	// primary cache will be allocated, all existing items in the
-	// old cache except that item will be evicted, and all items in
-	// the current primary cache moved to the old cache.
-	//
-	// The upshot of that is that all but the first 6 calls to Get
+	// The upshot of that is that all but the first 5 calls to Get
 	// should result in a database fetch.
 
 	c.Logf("testing cache")
@@ -383,9 +380,9 @@ func (s *RootKeyStoreSuite) TestGet(c *qt.C) {
 		c.Assert(err, qt.IsNil, qt.Commentf("key %d (%s)", i, k.id))
 		c.Assert(key, qt.DeepEquals, k.key, qt.Commentf("key %d (%s)", i, k.id))
 	}
-	c.Assert(len(fetched), qt.Equals, len(keys)-6)
+	c.Assert(len(fetched), qt.Equals, len(keys)-5)
 	for i, id := range fetched {
-		c.Assert(id, qt.Equals, keys[len(keys)-6-i-1].id)
+		c.Assert(id, qt.Equals, keys[len(keys)-5-i-1].id)
 	}
 }
 
@@ -481,6 +478,147 @@ func (s *RootKeyStoreSuite) TestKeyExpiration(c *qt.C) {
 	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
 }
 
+func (s *RootKeyStoreSuite) TestDoneContext(c *qt.C) {
+	store := postgresrootkeystore.NewRootKeys(s.db, testTable, 10).NewStore(postgresrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := store.RootKey(ctx)
+	c.Assert(err, qt.ErrorMatches, `cannot query existing keys: context canceled`)
+}
+
+func (s *RootKeyStoreSuite) TestGetContextPassedToBacking(c *qt.C) {
+	store := postgresrootkeystore.NewRootKeys(s.db, testTable, 10).NewStore(postgresrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := store.Get(ctx, []byte("foo"))
+	c.Assert(err, qt.ErrorMatches, `context canceled`)
+}
+
+func (s *RootKeyStoreSuite) TestDeleteExpired(c *qt.C) {
+	s.primeRootKeys(c, []dbrootkeystore.RootKey{{
+		Created: epoch,
+		Expires: epoch.Add(time.Minute),
+		Id:      []byte("id0"),
+		RootKey: []byte("key0"),
+	}, {
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		Id:      []byte("id1"),
+		RootKey: []byte("key1"),
+	}})
+	err := s.store.DeleteExpired(context.Background(), epoch.Add(30*time.Minute))
+	c.Assert(err, qt.IsNil)
+
+	_, err = postgresrootkeystore.Backing(s.store).GetKey([]byte("id0"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+	key, err := postgresrootkeystore.Backing(s.store).GetKey([]byte("id1"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(key.RootKey), qt.Equals, "key1")
+}
+
+func (s *RootKeyStoreSuite) TestRevoke(c *qt.C) {
+	now := epoch
+	c.Patch(postgresrootkeystore.Clock, clockVal(&now))
+	policy := postgresrootkeystore.Policy{
+		ExpiryDuration: 5 * time.Minute,
+	}
+	keys := postgresrootkeystore.NewRootKeys(s.db, testTable, 10)
+	keys.SetRevalidateInterval(time.Minute)
+	store := keys.NewStore(policy)
+	ctx := context.Background()
+	_, id, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	// Revoke the key through a different instance.
+	err = s.store.Revoke(ctx, id)
+	c.Assert(err, qt.IsNil)
+	_, err = postgresrootkeystore.Backing(s.store).GetKey(id)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+	_, err = s.store.NewStore(policy).Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+
+	// The first instance notices after the revalidate interval.
+	now = epoch.Add(time.Minute)
+	_, err = store.Get(ctx, id)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, id1, err := store.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(id1), qt.Not(qt.Equals), string(id))
+
+	err = s.store.Revoke(ctx, []byte("foo"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+}
+
+func (s *RootKeyStoreSuite) TestEncryptedBackingRewrap(c *qt.C) {
+	s.primeRootKeys(c, []dbrootkeystore.RootKey{{
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		Id:      []byte("id0"),
+		RootKey: []byte("key0"),
+	}, {
+		Created: epoch,
+		Expires: epoch.Add(time.Hour),
+		Id:      []byte("id1"),
+		RootKey: []byte("key1"),
+	}})
+	b := s.store.Backing()
+	eb, err := dbrootkeystore.NewEncryptedBacking(b, dbrootkeystore.EncryptionParams{
+		KEKs: []dbrootkeystore.KEK{{
+			Version: 1,
+			Key:     bytes.Repeat([]byte{1}, 32),
+		}},
+		AllowPlaintext: true,
+	})
+	c.Assert(err, qt.IsNil)
+	n, err := eb.RewrapKeys(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	want := map[string]string{"id0": "key0", "id1": "key1"}
+	for _, id := range []string{"id0", "id1"} {
+		key, err := b.GetKey([]byte(id))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(key.RootKey), qt.Not(qt.Equals), want[id])
+		key, err = eb.GetKey([]byte(id))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(key.RootKey), qt.Equals, want[id])
+	}
+}
+
+func (s *RootKeyStoreSuite) TestInsertKeyIfNoneInWindow(c *qt.C) {
+	s.primeRootKeys(c, nil)
+	b := postgresrootkeystore.Backing(s.store).(dbrootkeystore.WindowInsertBacking)
+	ctx := context.Background()
+	key0 := dbrootkeystore.RootKey{
+		Created: epoch,
+		Expires: epoch.Add(6 * time.Minute),
+		Id:      []byte("id0"),
+		RootKey: []byte("key0"),
+	}
+	key, err := b.InsertKeyIfNoneInWindow(ctx, key0, epoch.Add(-time.Minute), epoch.Add(5*time.Minute), epoch.Add(6*time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(key, qt.DeepEquals, key0)
+
+	// A second key in the same window is not inserted.
+	key1 := dbrootkeystore.RootKey{
+		Created: epoch.Add(time.Second),
+		Expires: epoch.Add(6*time.Minute + time.Second),
+		Id:      []byte("id1"),
+		RootKey: []byte("key1"),
+	}
+	key, err = b.InsertKeyIfNoneInWindow(ctx, key1, epoch.Add(-59*time.Second), epoch.Add(5*time.Minute+time.Second), epoch.Add(6*time.Minute+time.Second))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(key.Id), qt.Equals, "id0")
+	_, err = postgresrootkeystore.Backing(s.store).GetKey([]byte("id1"))
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+}
+
 // primeRootKeys deletes all rows from the root key table
 // and inserts the given keys.
 func (s *RootKeyStoreSuite) primeRootKeys(c *qt.C, keys []dbrootkeystore.RootKey) {
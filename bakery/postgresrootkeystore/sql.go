@@ -2,6 +2,7 @@ package postgresrootkeystore
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"text/template"
@@ -19,6 +20,11 @@ const (
 	findIdStmt stmtId = iota
 	findBestRootKeyStmt
 	insertKeyStmt
+	deleteExpiredStmt
+	revokeKeyStmt
+	iterKeysStmt
+	updateKeyStmt
+	lockInsertStmt
 	numStmts
 )
 
@@ -106,6 +112,21 @@ func (s *RootKeys) prepareAll(p *templateParams) error {
 	if err := s.prepareInsertKey(p); err != nil {
 		return errgo.Mask(err)
 	}
+	if err := s.prepareDeleteExpired(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareRevokeKey(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareIterKeys(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareUpdateKey(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareLockInsert(p); err != nil {
+		return errgo.Mask(err)
+	}
 	return nil
 }
 
@@ -115,12 +136,12 @@ SELECT id, created, expires, rootkey FROM {{.Table}} WHERE id=$1
 `)
 }
 
-func (s *RootKeys) getKey(id []byte) (dbrootkeystore.RootKey, error) {
+func (s *RootKeys) getKey(ctx context.Context, id []byte) (dbrootkeystore.RootKey, error) {
 	if err := s.initDB(); err != nil {
 		return dbrootkeystore.RootKey{}, errgo.Mask(err)
 	}
 	var key dbrootkeystore.RootKey
-	err := s.stmts[findIdStmt].QueryRow(id).Scan(
+	err := s.stmts[findIdStmt].QueryRowContext(ctx, id).Scan(
 		&key.Id,
 		&key.Created,
 		&key.Expires,
@@ -131,6 +152,9 @@ func (s *RootKeys) getKey(id []byte) (dbrootkeystore.RootKey, error) {
 		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
 	case err != nil:
 		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	case !key.IsValid():
+		// The key has been revoked.
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
 	}
 	return key, nil
 }
@@ -139,6 +163,7 @@ func (s *RootKeys) prepareFindBestRootKey(p *templateParams) error {
 	return s.prepare(findBestRootKeyStmt, p, `
 SELECT id, created, expires, rootkey FROM {{.Table}}
 WHERE
+	rootkey IS NOT NULL AND
 	created >= $1 AND
 	expires >= $2 AND
 	expires <= $3
@@ -146,12 +171,18 @@ ORDER BY created DESC
 `)
 }
 
-func (s *RootKeys) findLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+func (s *RootKeys) findLatestKey(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
 	if err := s.initDB(); err != nil {
 		return dbrootkeystore.RootKey{}, errgo.Mask(err)
 	}
+	return findLatestKey(ctx, s.stmts[findBestRootKeyStmt], createdAfter, expiresAfter, expiresBefore)
+}
+
+// findLatestKey runs the given findBestRootKeyStmt statement.
+func findLatestKey(ctx context.Context, stmt *sql.Stmt, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
 	var key dbrootkeystore.RootKey
-	err := s.stmts[findBestRootKeyStmt].QueryRow(
+	err := stmt.QueryRowContext(
+		ctx,
 		createdAfter,
 		expiresAfter,
 		expiresBefore,
@@ -173,14 +204,164 @@ INSERT into {{.Table}} (id, rootkey, created, expires) VALUES ($1, $2, $3, $4)
 `)
 }
 
-func (s *RootKeys) insertKey(key dbrootkeystore.RootKey) error {
+func (s *RootKeys) insertKey(ctx context.Context, key dbrootkeystore.RootKey) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err := s.stmts[insertKeyStmt].ExecContext(ctx, key.Id, key.RootKey, key.Created, key.Expires)
+	if err == nil {
+		return nil
+	}
+	// The error doesn't tell us portably whether the id was
+	// already taken, so look for an existing row, which may
+	// hold a revoked key.
+	var id []byte
+	var created, expires time.Time
+	var rootKey []byte
+	if findErr := s.stmts[findIdStmt].QueryRowContext(ctx, key.Id).Scan(&id, &created, &expires, &rootKey); findErr == nil {
+		return errgo.WithCausef(err, dbrootkeystore.ErrKeyExists, "duplicate key id %q", key.Id)
+	}
+	return errgo.Mask(err)
+}
+
+// prepareLockInsert prepares the statement used to serialize
+// conditional key insertions. The lock is held until the end of the
+// enclosing transaction.
+func (s *RootKeys) prepareLockInsert(p *templateParams) error {
+	return s.prepare(lockInsertStmt, p, `
+SELECT pg_advisory_xact_lock(hashtext('{{.Table}}_insert'))
+`)
+}
+
+// insertKeyIfNoneInWindow inserts the given key unless there is already
+// a key in the given window. To prevent two clients from
+// both finding no key and then both inserting one, the query and the
+// insertion are done in a transaction while holding an advisory lock
+// specific to the table.
+func (s *RootKeys) insertKeyIfNoneInWindow(ctx context.Context, key dbrootkeystore.RootKey, createdAfter, expiresAfter, expiresBefore time.Time) (_ dbrootkeystore.RootKey, err error) {
+	if err := s.initDB(); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if _, err := tx.StmtContext(ctx, s.stmts[lockInsertStmt]).ExecContext(ctx); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot acquire insert lock")
+	}
+	existing, err := findLatestKey(ctx, tx.StmtContext(ctx, s.stmts[findBestRootKeyStmt]), createdAfter, expiresAfter, expiresBefore)
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	if existing.IsValid() {
+		key = existing
+	} else if _, err := tx.StmtContext(ctx, s.stmts[insertKeyStmt]).ExecContext(ctx, key.Id, key.RootKey, key.Created, key.Expires); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+func (s *RootKeys) prepareDeleteExpired(p *templateParams) error {
+	return s.prepare(deleteExpiredStmt, p, `
+DELETE FROM {{.Table}} WHERE expires < $1
+`)
+}
+
+func (s *RootKeys) deleteExpired(ctx context.Context, before time.Time) error {
 	if err := s.initDB(); err != nil {
 		return errgo.Mask(err)
 	}
-	_, err := s.stmts[insertKeyStmt].Exec(key.Id, key.RootKey, key.Created, key.Expires)
+	_, err := s.stmts[deleteExpiredStmt].ExecContext(ctx, before)
 	return errgo.Mask(err)
 }
 
+// prepareRevokeKey prepares the statement used to revoke a key.
+// A revoked key is marked by removing its root key secret, which
+// leaves the rest of the row in place until it expires.
+func (s *RootKeys) prepareRevokeKey(p *templateParams) error {
+	return s.prepare(revokeKeyStmt, p, `
+UPDATE {{.Table}} SET rootkey = NULL WHERE id=$1
+`)
+}
+
+func (s *RootKeys) revokeKey(ctx context.Context, id []byte) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.execOne(ctx, revokeKeyStmt, id)
+}
+
+func (s *RootKeys) prepareIterKeys(p *templateParams) error {
+	return s.prepare(iterKeysStmt, p, `
+SELECT id, created, expires, rootkey FROM {{.Table}} WHERE rootkey IS NOT NULL
+`)
+}
+
+func (s *RootKeys) forEachKey(ctx context.Context, f func(dbrootkeystore.RootKey) error) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	rows, err := s.stmts[iterKeysStmt].QueryContext(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key dbrootkeystore.RootKey
+		if err := rows.Scan(
+			&key.Id,
+			&key.Created,
+			&key.Expires,
+			&key.RootKey,
+		); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := f(key); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return errgo.Mask(rows.Err())
+}
+
+func (s *RootKeys) prepareUpdateKey(p *templateParams) error {
+	return s.prepare(updateKeyStmt, p, `
+UPDATE {{.Table}} SET rootkey = $2 WHERE id=$1 AND rootkey IS NOT NULL
+`)
+}
+
+func (s *RootKeys) updateKey(ctx context.Context, key dbrootkeystore.RootKey) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.execOne(ctx, updateKeyStmt, key.Id, key.RootKey)
+}
+
+// execOne executes the given statement, which should affect
+// exactly one row. If no rows were affected, it returns
+// bakery.ErrNotFound.
+func (s *RootKeys) execOne(ctx context.Context, id stmtId, args ...interface{}) error {
+	result, err := s.stmts[id].ExecContext(ctx, args...)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n == 0 {
+		return bakery.ErrNotFound
+	}
+	return nil
+}
+
 func (s *RootKeys) prepare(id stmtId, p *templateParams, tmpl string) error {
 	if s.stmts[id] != nil {
 		panic(fmt.Sprintf("statement %v prepared twice", id))
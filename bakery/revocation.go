@@ -0,0 +1,122 @@
+package bakery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// RevocationStore records individual macaroons that have been
+// revoked, so that they can be rejected without replacing the root key
+// that they were minted with. Macaroons are identified by the random
+// nonce held in their id.
+//
+// See OvenParams.RevocationStore and Oven.RevokeMacaroon.
+type RevocationStore interface {
+	// Revoke records that the macaroon with the given nonce has
+	// been revoked. The record may be removed after the given
+	// expiry time; if it is zero, the record is kept indefinitely.
+	Revoke(ctx context.Context, nonce []byte, expires time.Time) error
+
+	// IsRevoked reports whether the macaroon with the given nonce
+	// has been revoked.
+	IsRevoked(ctx context.Context, nonce []byte) (bool, error)
+}
+
+// RootKeyExpirer may be implemented by a RootKeyStore to report
+// when root keys expire. Oven.RevokeMacaroon uses it so that
+// revocation records are removed once the macaroon can no
+// longer be verified anyway.
+type RootKeyExpirer interface {
+	// RootKeyExpiry returns the time that the root key with the
+	// given id expires. If the key is not found, it returns an
+	// error with an ErrNotFound cause.
+	RootKeyExpiry(ctx context.Context, id []byte) (time.Time, error)
+}
+
+// NewMemRevocationStore returns an implementation of RevocationStore
+// that holds revocation records in memory.
+func NewMemRevocationStore() RevocationStore {
+	return &memRevocationStore{
+		revoked: make(map[string]time.Time),
+	}
+}
+
+type memRevocationStore struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// Revoke implements RevocationStore.Revoke. It also removes
+// any records that have expired.
+func (s *memRevocationStore) Revoke(_ context.Context, nonce []byte, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for n, t := range s.revoked {
+		if !t.IsZero() && now.After(t) {
+			delete(s.revoked, n)
+		}
+	}
+	if t, ok := s.revoked[string(nonce)]; ok && (t.IsZero() || !expires.IsZero() && t.After(expires)) {
+		// Never shorten the life of an existing record.
+		return nil
+	}
+	s.revoked[string(nonce)] = expires
+	return nil
+}
+
+// IsRevoked implements RevocationStore.IsRevoked.
+func (s *memRevocationStore) IsRevoked(_ context.Context, nonce []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.revoked[string(nonce)]
+	if !ok {
+		return false, nil
+	}
+	if !t.IsZero() && time.Now().After(t) {
+		delete(s.revoked, string(nonce))
+		return false, nil
+	}
+	return true, nil
+}
+
+// RevokeMacaroon revokes the macaroon with the given id, as returned
+// by macaroon.Macaroon.Id, so that VerifyMacaroon will reject it and
+// any macaroons derived from it. The oven must have been created with
+// a RevocationStore.
+//
+// If the root key store for the macaroon implements RootKeyExpirer,
+// the revocation record expires with the root key; otherwise it is
+// kept indefinitely.
+//
+// Macaroons minted by versions of the bakery prior to Version2 hold
+// no nonce and cannot be revoked.
+func (o *Oven) RevokeMacaroon(ctx context.Context, id []byte) error {
+	if o.p.RevocationStore == nil {
+		return errgo.Newf("no revocation store configured")
+	}
+	if len(id) == 0 {
+		return errgo.Newf("empty macaroon id")
+	}
+	info, err := o.macaroonIdInfo(ctx, id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(info.Nonce) == 0 {
+		return errgo.Newf("macaroon id holds no nonce")
+	}
+	var expires time.Time
+	if e, ok := o.p.RootKeyStoreForOps(info.Ops).(RootKeyExpirer); ok {
+		expires, err = e.RootKeyExpiry(ctx, info.StorageId)
+		if err != nil {
+			return errgo.NoteMask(err, "cannot get root key expiry", errgo.Is(ErrNotFound))
+		}
+	}
+	if err := o.p.RevocationStore.Revoke(ctx, info.Nonce, expires); err != nil {
+		return errgo.Notef(err, "cannot revoke macaroon")
+	}
+	return nil
+}
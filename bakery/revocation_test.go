@@ -0,0 +1,120 @@
+package bakery_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon.v2"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+func TestRevokeMacaroon(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{
+		RevocationStore: bakery.NewMemRevocationStore(),
+	})
+	for _, version := range []bakery.Version{bakery.Version1, bakery.LatestVersion} {
+		c.Run(fmt.Sprintf("version%d", version), func(c *qt.C) {
+			m0, err := oven.NewMacaroon(testContext, version, nil, bakery.Op{"entity", "read"})
+			c.Assert(err, qt.IsNil)
+			m1, err := oven.NewMacaroon(testContext, version, nil, bakery.Op{"entity", "read"})
+			c.Assert(err, qt.IsNil)
+			_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m0.M()})
+			c.Assert(err, qt.IsNil)
+
+			err = oven.RevokeMacaroon(testContext, m0.M().Id())
+			c.Assert(err, qt.IsNil)
+			_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m0.M()})
+			c.Assert(err, qt.ErrorMatches, `verification failed: macaroon has been revoked`)
+			_, ok := err.(*bakery.VerificationError)
+			c.Assert(ok, qt.Equals, true)
+
+			// Other macaroons using the same root key are not affected.
+			_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m1.M()})
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+func TestRevokeMacaroonWithoutRevocationStore(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	err = oven.RevokeMacaroon(testContext, m.M().Id())
+	c.Assert(err, qt.ErrorMatches, `no revocation store configured`)
+}
+
+func TestRevokeMacaroonUsesRootKeyExpiry(t *testing.T) {
+	c := qt.New(t)
+	expires := time.Date(2200, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rstore := &recordingRevocationStore{
+		RevocationStore: bakery.NewMemRevocationStore(),
+	}
+	keyStore := expiringRootKeyStore{
+		RootKeyStore: bakery.NewMemRootKeyStore(),
+		expires:      expires,
+	}
+	oven := bakery.NewOven(bakery.OvenParams{
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return keyStore
+		},
+		RevocationStore: rstore,
+	})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	err = oven.RevokeMacaroon(testContext, m.M().Id())
+	c.Assert(err, qt.IsNil)
+	c.Assert(rstore.expires, qt.DeepEquals, []time.Time{expires})
+}
+
+func TestMemRevocationStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	store := bakery.NewMemRevocationStore()
+	assertRevoked := func(nonce string, expect bool) {
+		revoked, err := store.IsRevoked(ctx, []byte(nonce))
+		c.Assert(err, qt.IsNil)
+		c.Assert(revoked, qt.Equals, expect, qt.Commentf("nonce %q", nonce))
+	}
+	assertRevoked("a", false)
+
+	err := store.Revoke(ctx, []byte("a"), time.Now().Add(time.Hour))
+	c.Assert(err, qt.IsNil)
+	err = store.Revoke(ctx, []byte("forever"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	err = store.Revoke(ctx, []byte("expired"), time.Now().Add(-time.Second))
+	c.Assert(err, qt.IsNil)
+	assertRevoked("a", true)
+	assertRevoked("forever", true)
+	assertRevoked("expired", false)
+
+	// Revoking again with an earlier expiry time does not
+	// shorten the life of the record.
+	err = store.Revoke(ctx, []byte("forever"), time.Now().Add(-time.Second))
+	c.Assert(err, qt.IsNil)
+	assertRevoked("forever", true)
+}
+
+type recordingRevocationStore struct {
+	bakery.RevocationStore
+	expires []time.Time
+}
+
+func (s *recordingRevocationStore) Revoke(ctx context.Context, nonce []byte, expires time.Time) error {
+	s.expires = append(s.expires, expires)
+	return s.RevocationStore.Revoke(ctx, nonce, expires)
+}
+
+type expiringRootKeyStore struct {
+	bakery.RootKeyStore
+	expires time.Time
+}
+
+func (s expiringRootKeyStore) RootKeyExpiry(ctx context.Context, id []byte) (time.Time, error) {
+	return s.expires, nil
+}
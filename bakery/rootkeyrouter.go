@@ -0,0 +1,123 @@
+package bakery
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// RootKeyRoute holds a rule used by a RootKeyRouter to choose the root
+// key store for a set of operations. An operation matches the route
+// if its entity starts with EntityPrefix and its action matches one
+// of the patterns in Actions.
+type RootKeyRoute struct {
+	// Name holds a name for the route, used in error messages.
+	Name string
+
+	// EntityPrefix holds the prefix that an operation's entity
+	// must start with. If it is empty, all entities match.
+	EntityPrefix string
+
+	// Actions holds patterns that an operation's action must
+	// match, in the syntax used by path.Match. If it is empty,
+	// all actions match.
+	Actions []string
+
+	// Priority holds the priority of the route. When the
+	// operations associated with a macaroon match several
+	// routes, the route with the highest priority is used; if
+	// several routes have the same priority, the one that was
+	// specified first is used.
+	Priority int
+
+	// Store holds the root key store used for operations that
+	// match the route. To use different key lifetimes for
+	// different routes, use stores with different policies,
+	// for example by calling dbrootkeystore.RootKeys.NewStore
+	// with different Policy values.
+	Store RootKeyStore
+}
+
+// RootKeyRouter chooses a root key store for a set of operations
+// according to a set of declarative rules. Its StoreForOps method
+// is suitable for use as OvenParams.RootKeyStoreForOps.
+//
+// Note that the same store must be chosen when a macaroon is
+// verified as when it was minted, so changing the routes may
+// prevent existing macaroons from being verified.
+type RootKeyRouter struct {
+	routes   []RootKeyRoute
+	fallback RootKeyStore
+}
+
+// NewRootKeyRouter returns a router that uses the given routes, and
+// uses defaultStore for operations that match none of them. It
+// returns an error if any of the routes are invalid.
+func NewRootKeyRouter(defaultStore RootKeyStore, routes ...RootKeyRoute) (*RootKeyRouter, error) {
+	if defaultStore == nil {
+		return nil, errgo.Newf("no default root key store")
+	}
+	names := make(map[string]bool)
+	for i, r := range routes {
+		name := fmt.Sprint(i)
+		if r.Name != "" {
+			if names[r.Name] {
+				return nil, errgo.Newf("duplicate route name %q", r.Name)
+			}
+			names[r.Name] = true
+			name = fmt.Sprintf("%q", r.Name)
+		}
+		if r.Store == nil {
+			return nil, errgo.Newf("route %s has no store", name)
+		}
+		for _, a := range r.Actions {
+			if _, err := path.Match(a, ""); err != nil {
+				return nil, errgo.Newf("route %s has invalid action pattern %q", name, a)
+			}
+		}
+	}
+	return &RootKeyRouter{
+		routes:   append([]RootKeyRoute(nil), routes...),
+		fallback: defaultStore,
+	}, nil
+}
+
+// StoreForOps returns the store to use for a macaroon associated
+// with the given operations. It returns the store of the
+// highest priority route matched by any of the operations, or the
+// default store if no operations match any route.
+func (r *RootKeyRouter) StoreForOps(ops []Op) RootKeyStore {
+	best := -1
+	for _, op := range ops {
+		for i, route := range r.routes {
+			if best != -1 && (route.Priority < r.routes[best].Priority || route.Priority == r.routes[best].Priority && i >= best) {
+				continue
+			}
+			if route.matches(op) {
+				best = i
+			}
+		}
+	}
+	if best == -1 {
+		return r.fallback
+	}
+	return r.routes[best].Store
+}
+
+// matches reports whether the given operation matches the route.
+func (r *RootKeyRoute) matches(op Op) bool {
+	if !strings.HasPrefix(op.Entity, r.EntityPrefix) {
+		return false
+	}
+	if len(r.Actions) == 0 {
+		return true
+	}
+	for _, a := range r.Actions {
+		if ok, _ := path.Match(a, op.Action); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package bakery_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon.v2"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+var (
+	defaultStore = bakery.NewMemRootKeyStore()
+	adminStore   = bakery.NewMemRootKeyStore()
+	readStore    = bakery.NewMemRootKeyStore()
+	userStore    = bakery.NewMemRootKeyStore()
+)
+
+var testRoutes = []bakery.RootKeyRoute{{
+	Name:     "read",
+	Actions:  []string{"read", "list*"},
+	Priority: 0,
+	Store:    readStore,
+}, {
+	Name:         "admin",
+	EntityPrefix: "admin-",
+	Priority:     10,
+	Store:        adminStore,
+}, {
+	Name:         "user",
+	EntityPrefix: "user-",
+	Priority:     0,
+	Store:        userStore,
+}}
+
+var storeForOpsTests = []struct {
+	about  string
+	ops    []bakery.Op
+	expect bakery.RootKeyStore
+}{{
+	about:  "no ops",
+	expect: defaultStore,
+}, {
+	about:  "no matching route",
+	ops:    []bakery.Op{{"other", "write"}},
+	expect: defaultStore,
+}, {
+	about:  "action match",
+	ops:    []bakery.Op{{"other", "read"}},
+	expect: readStore,
+}, {
+	about:  "action pattern match",
+	ops:    []bakery.Op{{"other", "listall"}},
+	expect: readStore,
+}, {
+	about:  "entity prefix match",
+	ops:    []bakery.Op{{"admin-1", "write"}},
+	expect: adminStore,
+}, {
+	about:  "higher priority wins",
+	ops:    []bakery.Op{{"admin-1", "read"}},
+	expect: adminStore,
+}, {
+	about:  "higher priority wins across ops",
+	ops:    []bakery.Op{{"other", "read"}, {"admin-1", "write"}},
+	expect: adminStore,
+}, {
+	about:  "earlier route wins with equal priority",
+	ops:    []bakery.Op{{"user-1", "read"}},
+	expect: readStore,
+}, {
+	about:  "earlier route wins with equal priority across ops",
+	ops:    []bakery.Op{{"user-1", "write"}, {"other", "read"}},
+	expect: readStore,
+}, {
+	about:  "matched route wins over default",
+	ops:    []bakery.Op{{"other", "write"}, {"user-1", "write"}},
+	expect: userStore,
+}}
+
+func TestRootKeyRouterStoreForOps(t *testing.T) {
+	c := qt.New(t)
+	r, err := bakery.NewRootKeyRouter(defaultStore, testRoutes...)
+	c.Assert(err, qt.IsNil)
+	for _, test := range storeForOpsTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(r.StoreForOps(test.ops), qt.Equals, test.expect)
+		})
+	}
+}
+
+var newRootKeyRouterErrorTests = []struct {
+	about        string
+	defaultStore bakery.RootKeyStore
+	routes       []bakery.RootKeyRoute
+	expectError  string
+}{{
+	about:       "no default store",
+	expectError: `no default root key store`,
+}, {
+	about:        "no store",
+	defaultStore: defaultStore,
+	routes: []bakery.RootKeyRoute{{
+		Store: readStore,
+	}, {
+		EntityPrefix: "foo",
+	}},
+	expectError: `route 1 has no store`,
+}, {
+	about:        "invalid pattern",
+	defaultStore: defaultStore,
+	routes: []bakery.RootKeyRoute{{
+		Name:    "bad",
+		Actions: []string{"["},
+		Store:   readStore,
+	}},
+	expectError: `route "bad" has invalid action pattern "\["`,
+}, {
+	about:        "duplicate name",
+	defaultStore: defaultStore,
+	routes: []bakery.RootKeyRoute{{
+		Name:  "x",
+		Store: readStore,
+	}, {
+		Name:  "x",
+		Store: adminStore,
+	}},
+	expectError: `duplicate route name "x"`,
+}}
+
+func TestNewRootKeyRouterErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newRootKeyRouterErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := bakery.NewRootKeyRouter(test.defaultStore, test.routes...)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func TestRootKeyRouterWithOven(t *testing.T) {
+	c := qt.New(t)
+	r, err := bakery.NewRootKeyRouter(defaultStore, testRoutes...)
+	c.Assert(err, qt.IsNil)
+	oven := bakery.NewOven(bakery.OvenParams{
+		RootKeyStoreForOps: r.StoreForOps,
+	})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"admin-1", "write"})
+	c.Assert(err, qt.IsNil)
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+
+	// The key was stored in the admin store.
+	_, err = adminStore.Get(testContext, []byte("0"))
+	c.Assert(err, qt.IsNil)
+}
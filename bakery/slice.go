@@ -3,6 +3,7 @@ package bakery
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	errgo "gopkg.in/errgo.v1"
@@ -56,79 +57,241 @@ func (ms Slice) Purge(t time.Time) Slice {
 	return ms1
 }
 
+// DischargeAllParams holds parameters for Slice.DischargeAllWithParams
+// and DischargeAllWithParams.
+type DischargeAllParams struct {
+	// GetDischarge is used to acquire each discharge macaroon.
+	// It is passed the caveat to be discharged and the external
+	// caveat payload, if any.
+	GetDischarge func(ctx context.Context, cav macaroon.Caveat, encryptedCaveat []byte) (*Macaroon, error)
+
+	// LocalKey optionally holds the key of the client, used to
+	// discharge third party caveats with the special location
+	// "local". See DischargeAllWithKey.
+	LocalKey *KeyPair
+
+	// Concurrency holds the maximum number of discharge macaroons
+	// that will be acquired at the same time. If it is greater
+	// than one, GetDischarge must be safe to call concurrently.
+	// If it is zero or one, discharges are acquired one at a time.
+	//
+	// Whatever the concurrency, the discharge macaroons are
+	// returned in the same order, as are the errors from any
+	// discharges that fail (see DischargeAll). However, when
+	// discharging concurrently, the context passed to
+	// GetDischarge is cancelled as soon as any discharge fails
+	// and no more discharges are started, so fewer discharge
+	// macaroons may be returned on error, and discharges that
+	// fail because they were cancelled are not reported.
+	Concurrency int
+}
+
 // DischargeAll discharges all the third party caveats in the slice for
 // which discharge macaroons are not already present, using getDischarge
 // to acquire the discharge macaroons. It always returns the slice with
 // any acquired discharge macaroons added, even on error. It returns an
-// error if all the discharges could not be acquired.
+// error if all the discharges could not be acquired. If several
+// discharges failed, the error describes all the failures in the
+// order of their caveats, and its cause is that of the first.
 //
 // Note that this differs from DischargeAll in that it can be given several existing
 // discharges, and that the resulting discharges are not bound to the primary,
 // so it's still possible to add caveats and reacquire expired discharges
 // without reacquiring the primary macaroon.
 func (ms Slice) DischargeAll(ctx context.Context, getDischarge func(ctx context.Context, cav macaroon.Caveat, encryptedCaveat []byte) (*Macaroon, error), localKey *KeyPair) (Slice, error) {
+	return ms.DischargeAllWithParams(ctx, DischargeAllParams{
+		GetDischarge: getDischarge,
+		LocalKey:     localKey,
+	})
+}
+
+// DischargeAllWithParams is like DischargeAll except that the
+// parameters are taken from p, which allows independent third party
+// caveats to be discharged concurrently.
+func (ms Slice) DischargeAllWithParams(ctx context.Context, p DischargeAllParams) (Slice, error) {
 	if len(ms) == 0 {
 		return nil, errgo.Newf("no macaroons to discharge")
 	}
 	ms1 := make(Slice, len(ms))
 	copy(ms1, ms)
 	// have holds the keys of all the macaroon ids in the slice.
-	type needCaveat struct {
-		// cav holds the caveat that needs discharge.
-		cav macaroon.Caveat
-		// encryptedCaveat holds encrypted caveat
-		// if it was held externally.
-		encryptedCaveat []byte
-	}
-	var need []needCaveat
 	have := make(map[string]bool)
 	for _, m := range ms[1:] {
 		have[string(m.M().Id())] = true
 	}
-	// addCaveats adds any required third party caveats to the need slice
-	// that aren't already present .
-	addCaveats := func(m *Macaroon) {
+	// needCaveats returns any required third party caveats in m
+	// that aren't already present.
+	needCaveats := func(m *Macaroon) []*needCaveat {
+		var need []*needCaveat
 		for _, cav := range m.M().Caveats() {
 			if len(cav.VerificationId) == 0 || have[string(cav.Id)] {
 				continue
 			}
-			need = append(need, needCaveat{
+			need = append(need, &needCaveat{
 				cav:             cav,
 				encryptedCaveat: m.caveatData[string(cav.Id)],
 			})
 		}
+		return need
 	}
+	var need []*needCaveat
 	for _, m := range ms {
-		addCaveats(m)
+		need = append(need, needCaveats(m)...)
+	}
+	if p.Concurrency > 1 {
+		dischargeConcurrently(ctx, p, need, needCaveats)
 	}
 	var errs []error
 	for len(need) > 0 {
 		cav := need[0]
 		need = need[1:]
-		var dm *Macaroon
-		var err error
-		if localKey != nil && cav.cav.Location == "local" {
-			// TODO use a small caveat id.
-			dm, err = Discharge(ctx, DischargeParams{
-				Key:     localKey,
-				Checker: localDischargeChecker,
-				Caveat:  cav.encryptedCaveat,
-				Id:      cav.cav.Id,
-				Locator: emptyLocator{},
-			})
-		} else {
-			dm, err = getDischarge(ctx, cav.cav, cav.encryptedCaveat)
+		if p.Concurrency <= 1 {
+			cav.discharge(ctx, p)
+			if cav.err == nil {
+				cav.need = needCaveats(cav.dm)
+			}
 		}
-		if err != nil {
-			errs = append(errs, errgo.NoteMask(err, fmt.Sprintf("cannot get discharge from %q", cav.cav.Location), errgo.Any))
+		if cav.abandoned {
 			continue
 		}
-		ms1 = append(ms1, dm)
-		addCaveats(dm)
+		if cav.err != nil {
+			errs = append(errs, errgo.NoteMask(cav.err, fmt.Sprintf("cannot get discharge from %q", cav.cav.Location), errgo.Any))
+			continue
+		}
+		ms1 = append(ms1, cav.dm)
+		need = append(need, cav.need...)
 	}
-	if errs != nil {
-		// TODO log other errors? Return them all?
+	switch len(errs) {
+	case 0:
+		return ms1, nil
+	case 1:
 		return ms1, errgo.Mask(errs[0], errgo.Any)
 	}
-	return ms1, nil
+	return ms1, errgo.Mask(dischargeErrors(errs), errgo.Any)
+}
+
+// dischargeErrors holds the errors from several failed discharges.
+// Its cause is that of the first error.
+type dischargeErrors []error
+
+// Error implements error.Error by joining all the error messages.
+func (errs dischargeErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Cause implements errgo.Causer.
+func (errs dischargeErrors) Cause() error {
+	return errgo.Cause(errs[0])
+}
+
+// needCaveat holds a third party caveat that needs to be discharged
+// and, once it has been, the result.
+type needCaveat struct {
+	// cav holds the caveat that needs discharge.
+	cav macaroon.Caveat
+	// encryptedCaveat holds encrypted caveat
+	// if it was held externally.
+	encryptedCaveat []byte
+
+	// dm and err hold the result of the discharge.
+	dm  *Macaroon
+	err error
+
+	// need holds the caveats in dm that need discharge.
+	need []*needCaveat
+
+	// abandoned holds whether the discharge was not started or
+	// was cancelled because another discharge failed.
+	abandoned bool
+}
+
+// discharge acquires a discharge macaroon for the caveat.
+func (cav *needCaveat) discharge(ctx context.Context, p DischargeAllParams) {
+	if p.LocalKey != nil && cav.cav.Location == "local" {
+		// TODO use a small caveat id.
+		cav.dm, cav.err = Discharge(ctx, DischargeParams{
+			Key:     p.LocalKey,
+			Checker: localDischargeChecker,
+			Caveat:  cav.encryptedCaveat,
+			Id:      cav.cav.Id,
+			Locator: emptyLocator{},
+		})
+	} else {
+		cav.dm, cav.err = p.GetDischarge(ctx, cav.cav, cav.encryptedCaveat)
+	}
+}
+
+// dischargeConcurrently discharges all the given caveats, and any
+// caveats found by needCaveats in the resulting discharge macaroons,
+// with at most p.Concurrency discharges in progress at once. The
+// results are left in the needCaveat values, so that the caller
+// can gather them in the same order that they would be acquired
+// sequentially.
+//
+// When a discharge fails, the others in progress are cancelled and
+// no more are started.
+func dischargeConcurrently(ctx context.Context, p DischargeAllParams, need []*needCaveat, needCaveats func(*Macaroon) []*needCaveat) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sem := make(chan struct{}, p.Concurrency)
+	done := make(chan *needCaveat)
+	queue := append([]*needCaveat(nil), need...)
+	running := 0
+	// failed holds whether a discharge has failed, in which
+	// case ctx has been cancelled.
+	failed := false
+	for len(queue) > 0 || running > 0 {
+		// Only try to acquire the semaphore when there's
+		// something to start.
+		var acquire chan struct{}
+		if len(queue) > 0 {
+			acquire = sem
+		}
+		select {
+		case acquire <- struct{}{}:
+			cav := queue[0]
+			queue = queue[1:]
+			running++
+			go func() {
+				cav.discharge(ctx, p)
+				done <- cav
+			}()
+		case cav := <-done:
+			<-sem
+			running--
+			if failed && cav.err != nil && isContextError(cav.err) {
+				// The discharge was probably cancelled
+				// because of the earlier failure.
+				cav.abandoned = true
+				continue
+			}
+			if cav.err != nil {
+				failed = true
+				cancel()
+				for _, cav := range queue {
+					cav.abandoned = true
+				}
+				queue = nil
+				continue
+			}
+			if !failed {
+				cav.need = needCaveats(cav.dm)
+				queue = append(queue, cav.need...)
+			}
+		}
+	}
+}
+
+// isContextError reports whether the cause of err is
+// a context error.
+func isContextError(err error) bool {
+	switch errgo.Cause(err) {
+	case context.Canceled, context.DeadlineExceeded:
+		return true
+	}
+	return false
 }
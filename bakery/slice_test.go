@@ -171,7 +171,8 @@ func TestDischargeAllAcquiresManyMacaroonsAsPossible(t *testing.T) {
 	ms := bakery.Slice{m}
 
 	ms, err = ms.DischargeAll(testContext, getDischarge, nil)
-	c.Check(err, qt.ErrorMatches, `cannot get discharge from "somewhere": discharge failure on "id1"`)
+	c.Check(err, qt.ErrorMatches, `cannot get discharge from "somewhere": discharge failure on "id1"; `+
+		`cannot get discharge from "somewhere": discharge failure on "id3"`)
 	c.Assert(ms, qt.HasLen, 4)
 
 	// Try again without id1 failing - we should acquire one more discharge.
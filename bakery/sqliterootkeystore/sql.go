@@ -0,0 +1,317 @@
+package sqliterootkeystore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"text/template"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+)
+
+type stmtId int
+
+const (
+	findIdStmt stmtId = iota
+	findBestRootKeyStmt
+	insertKeyStmt
+	deleteExpiredStmt
+	revokeKeyStmt
+	iterKeysStmt
+	updateKeyStmt
+	numStmts
+)
+
+// SQLite has no native time type, so the created and expires
+// columns hold times as nanoseconds since the Unix epoch. That
+// keeps comparisons and ordering exact and independent of
+// the time zone of the stored values.
+var initStatements = `
+CREATE TABLE IF NOT EXISTS {{.Table}} (
+	id BLOB PRIMARY KEY NOT NULL,
+	rootkey BLOB,
+	created INTEGER NOT NULL,
+	expires INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS {{.CreateIndex}} ON {{.Table}} (created);
+
+CREATE INDEX IF NOT EXISTS {{.ExpireIndex}} ON {{.Table}} (expires);
+
+CREATE TRIGGER IF NOT EXISTS {{.ExpireTrigger}}
+	BEFORE INSERT ON {{.Table}}
+	BEGIN
+		DELETE FROM {{.Table}}
+		WHERE expires < CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER) * 1000000;
+	END;
+`
+
+type templateParams struct {
+	Table         string
+	CreateIndex   string
+	ExpireIndex   string
+	ExpireTrigger string
+}
+
+func (s *RootKeys) initDB() error {
+	s.initDBOnce.Do(func() {
+		s.initDBErr = s._initDB()
+	})
+	if s.initDBErr != nil {
+		return errgo.Notef(s.initDBErr, "cannot initialize database")
+	}
+	return nil
+}
+
+func (s *RootKeys) _initDB() error {
+	p := &templateParams{
+		Table:         s.table,
+		CreateIndex:   s.table + "_index_create",
+		ExpireIndex:   s.table + "_index_expire",
+		ExpireTrigger: s.table + "_trigger",
+	}
+	if _, err := s.db.Exec(templateVal(p, initStatements)); err != nil {
+		return errgo.Notef(err, "cannot initialize table")
+	}
+	if err := s.prepareAll(p); err != nil {
+		return errgo.Notef(err, "cannot prepare statements")
+	}
+	return nil
+}
+
+func (s *RootKeys) prepareAll(p *templateParams) error {
+	if err := s.prepareFindId(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareFindBestRootKey(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareInsertKey(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareDeleteExpired(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareRevokeKey(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareIterKeys(p); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepareUpdateKey(p); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (s *RootKeys) prepareFindId(p *templateParams) error {
+	return s.prepare(findIdStmt, p, `
+SELECT id, created, expires, rootkey FROM {{.Table}} WHERE id=?
+`)
+}
+
+func (s *RootKeys) getKey(ctx context.Context, id []byte) (dbrootkeystore.RootKey, error) {
+	if err := s.initDB(); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	key, err := scanKey(s.stmts[findIdStmt].QueryRowContext(ctx, id))
+	switch {
+	case err == sql.ErrNoRows:
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	case err != nil:
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	case !key.IsValid():
+		// The key has been revoked.
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *RootKeys) prepareFindBestRootKey(p *templateParams) error {
+	return s.prepare(findBestRootKeyStmt, p, `
+SELECT id, created, expires, rootkey FROM {{.Table}}
+WHERE
+	rootkey IS NOT NULL AND
+	created >= ? AND
+	expires >= ? AND
+	expires <= ?
+ORDER BY created DESC
+LIMIT 1
+`)
+}
+
+func (s *RootKeys) findLatestKey(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	if err := s.initDB(); err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	key, err := scanKey(s.stmts[findBestRootKeyStmt].QueryRowContext(
+		ctx,
+		createdAfter.UnixNano(),
+		expiresAfter.UnixNano(),
+		expiresBefore.UnixNano(),
+	))
+	switch {
+	case err == sql.ErrNoRows:
+		return dbrootkeystore.RootKey{}, nil
+	case err != nil:
+		return dbrootkeystore.RootKey{}, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+func (s *RootKeys) prepareInsertKey(p *templateParams) error {
+	return s.prepare(insertKeyStmt, p, `
+INSERT into {{.Table}} (id, rootkey, created, expires) VALUES (?, ?, ?, ?)
+`)
+}
+
+func (s *RootKeys) insertKey(ctx context.Context, key dbrootkeystore.RootKey) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err := s.stmts[insertKeyStmt].ExecContext(ctx, key.Id, key.RootKey, key.Created.UnixNano(), key.Expires.UnixNano())
+	if err == nil {
+		return nil
+	}
+	// The error doesn't tell us portably whether the id was
+	// already taken, so look for an existing row, which may
+	// hold a revoked key.
+	if _, findErr := scanKey(s.stmts[findIdStmt].QueryRowContext(ctx, key.Id)); findErr == nil {
+		return errgo.WithCausef(err, dbrootkeystore.ErrKeyExists, "duplicate key id %q", key.Id)
+	}
+	return errgo.Mask(err)
+}
+
+// scanKey scans a root key from a row holding the
+// id, created, expires and rootkey columns in that order.
+func scanKey(row interface {
+	Scan(dest ...interface{}) error
+}) (dbrootkeystore.RootKey, error) {
+	var key dbrootkeystore.RootKey
+	var created, expires int64
+	if err := row.Scan(
+		&key.Id,
+		&created,
+		&expires,
+		&key.RootKey,
+	); err != nil {
+		return dbrootkeystore.RootKey{}, err
+	}
+	key.Created = time.Unix(0, created)
+	key.Expires = time.Unix(0, expires)
+	return key, nil
+}
+
+func (s *RootKeys) prepareDeleteExpired(p *templateParams) error {
+	return s.prepare(deleteExpiredStmt, p, `
+DELETE FROM {{.Table}} WHERE expires < ?
+`)
+}
+
+func (s *RootKeys) deleteExpired(ctx context.Context, before time.Time) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err := s.stmts[deleteExpiredStmt].ExecContext(ctx, before.UnixNano())
+	return errgo.Mask(err)
+}
+
+// prepareRevokeKey prepares the statement used to revoke a key.
+// A revoked key is marked by removing its root key secret, which
+// leaves the rest of the row in place until it expires.
+func (s *RootKeys) prepareRevokeKey(p *templateParams) error {
+	return s.prepare(revokeKeyStmt, p, `
+UPDATE {{.Table}} SET rootkey = NULL WHERE id=?
+`)
+}
+
+func (s *RootKeys) revokeKey(ctx context.Context, id []byte) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.execOne(ctx, revokeKeyStmt, id)
+}
+
+func (s *RootKeys) prepareIterKeys(p *templateParams) error {
+	return s.prepare(iterKeysStmt, p, `
+SELECT id, created, expires, rootkey FROM {{.Table}} WHERE rootkey IS NOT NULL
+`)
+}
+
+func (s *RootKeys) forEachKey(ctx context.Context, f func(dbrootkeystore.RootKey) error) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	rows, err := s.stmts[iterKeysStmt].QueryContext(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := f(key); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return errgo.Mask(rows.Err())
+}
+
+func (s *RootKeys) prepareUpdateKey(p *templateParams) error {
+	return s.prepare(updateKeyStmt, p, `
+UPDATE {{.Table}} SET rootkey = ?2 WHERE id=?1 AND rootkey IS NOT NULL
+`)
+}
+
+func (s *RootKeys) updateKey(ctx context.Context, key dbrootkeystore.RootKey) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	return s.execOne(ctx, updateKeyStmt, key.Id, key.RootKey)
+}
+
+// execOne executes the given statement, which should affect
+// exactly one row. If no rows were affected, it returns
+// bakery.ErrNotFound.
+func (s *RootKeys) execOne(ctx context.Context, id stmtId, args ...interface{}) error {
+	result, err := s.stmts[id].ExecContext(ctx, args...)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n == 0 {
+		return bakery.ErrNotFound
+	}
+	return nil
+}
+
+func (s *RootKeys) prepare(id stmtId, p *templateParams, tmpl string) error {
+	if s.stmts[id] != nil {
+		panic(fmt.Sprintf("statement %v prepared twice", id))
+	}
+	stmt, err := s.db.Prepare(templateVal(p, tmpl))
+	if err != nil {
+		return errgo.Notef(err, "statement %v (%q) invalid", id, templateVal(p, tmpl))
+	}
+	s.stmts[id] = stmt
+	return nil
+}
+
+func templateVal(p *templateParams, s string) string {
+	tmpl := template.Must(template.New("").Parse(s))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, p); err != nil {
+		panic(errgo.Notef(err, "cannot create initialization statements"))
+	}
+	return buf.String()
+}
@@ -0,0 +1,3 @@
+package sqlrevocationstore
+
+var Now = &now
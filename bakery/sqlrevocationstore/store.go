@@ -0,0 +1,252 @@
+// Package sqlrevocationstore provides an implementation of
+// bakery.RevocationStore that uses a PostgreSQL or SQLite database
+// as a persistent store.
+package sqlrevocationstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// Variables defined so they can be overidden for testing.
+var now = time.Now
+
+// Dialect specifies the SQL dialect spoken by the database.
+type Dialect int
+
+const (
+	// Postgres specifies a PostgreSQL database, for example one
+	// opened with the github.com/lib/pq driver.
+	Postgres Dialect = iota
+
+	// SQLite specifies a SQLite database, for example one opened
+	// with the github.com/mattn/go-sqlite3 driver. SQLite 3.24 or
+	// later is required.
+	SQLite
+)
+
+type stmtId int
+
+const (
+	isRevokedStmt stmtId = iota
+	revokeStmt
+	deleteExpiredStmt
+	numStmts
+)
+
+// The expires column holds times as nanoseconds since the Unix epoch
+// so that the same schema works with both dialects. Records that
+// never expire hold the maximum int64 value.
+var initStatements = `
+CREATE TABLE IF NOT EXISTS {{.Table}} (
+	nonce {{.BytesType}} PRIMARY KEY NOT NULL,
+	expires BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS {{.ExpireIndex}} ON {{.Table}} (expires);
+`
+
+type templateParams struct {
+	Table       string
+	BytesType   string
+	ExpireIndex string
+}
+
+// Store is a bakery.RevocationStore that records revoked macaroons in
+// a database table.
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+	stmts   [numStmts]*sql.Stmt
+
+	// initDBOnce guards initDBErr.
+	initDBOnce sync.Once
+	initDBErr  error
+}
+
+var _ bakery.RevocationStore = (*Store)(nil)
+
+// New returns a revocation store that uses the given table in the
+// given database, which must use the given dialect. The table will
+// be created lazily when the store is first used.
+//
+// It also creates other SQL resources using the table name
+// as a prefix.
+//
+// The returned Store must be closed after use.
+func New(db *sql.DB, dialect Dialect, table string) *Store {
+	return &Store{
+		db:      db,
+		dialect: dialect,
+		table:   table,
+	}
+}
+
+// Close closes the Store. This must be called after using the instance.
+func (s *Store) Close() error {
+	var retErr error
+	for _, stmt := range s.stmts {
+		if stmt == nil {
+			continue
+		}
+		if err := stmt.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}
+	return errgo.Mask(retErr)
+}
+
+// Revoke implements bakery.RevocationStore.Revoke. The expiry
+// time of an existing record is never reduced. It also deletes
+// any records that have expired.
+func (s *Store) Revoke(ctx context.Context, nonce []byte, expires time.Time) error {
+	if err := s.DeleteExpired(ctx, now()); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := s.stmts[revokeStmt].ExecContext(ctx, nonce, timeToDB(expires)); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// IsRevoked implements bakery.RevocationStore.IsRevoked.
+func (s *Store) IsRevoked(ctx context.Context, nonce []byte) (bool, error) {
+	if err := s.initDB(); err != nil {
+		return false, errgo.Mask(err)
+	}
+	var one int
+	err := s.stmts[isRevokedStmt].QueryRowContext(ctx, nonce, timeToDB(now())).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return true, nil
+}
+
+// DeleteExpired deletes all records that expired before the given
+// time.
+func (s *Store) DeleteExpired(ctx context.Context, before time.Time) error {
+	if err := s.initDB(); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := s.stmts[deleteExpiredStmt].ExecContext(ctx, timeToDB(before)); err != nil {
+		return errgo.Notef(err, "cannot delete expired revocation records")
+	}
+	return nil
+}
+
+// timeToDB returns the database representation of t.
+func timeToDB(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MaxInt64
+	}
+	return t.UnixNano()
+}
+
+func (s *Store) initDB() error {
+	s.initDBOnce.Do(func() {
+		s.initDBErr = s._initDB()
+	})
+	if s.initDBErr != nil {
+		return errgo.Notef(s.initDBErr, "cannot initialize database")
+	}
+	return nil
+}
+
+func (s *Store) _initDB() error {
+	p := &templateParams{
+		Table:       s.table,
+		BytesType:   "BLOB",
+		ExpireIndex: s.table + "_index_expire",
+	}
+	if s.dialect == Postgres {
+		p.BytesType = "BYTEA"
+	}
+	if _, err := s.db.Exec(templateVal(p, initStatements)); err != nil {
+		return errgo.Notef(err, "cannot initialize table")
+	}
+	if err := s.prepareAll(p); err != nil {
+		return errgo.Notef(err, "cannot prepare statements")
+	}
+	return nil
+}
+
+func (s *Store) prepareAll(p *templateParams) error {
+	if err := s.prepare(isRevokedStmt, p, `
+SELECT 1 FROM {{.Table}} WHERE nonce=? AND expires>?
+`); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepare(revokeStmt, p, `
+INSERT INTO {{.Table}} (nonce, expires) VALUES (?, ?)
+ON CONFLICT (nonce) DO UPDATE SET expires=
+	CASE WHEN excluded.expires > {{.Table}}.expires
+	THEN excluded.expires ELSE {{.Table}}.expires END
+`); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.prepare(deleteExpiredStmt, p, `
+DELETE FROM {{.Table}} WHERE expires<?
+`); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// prepare prepares the statement with the given id from the given
+// template. Placeholders are written as "?" and are rewritten as
+// required by the dialect.
+func (s *Store) prepare(id stmtId, p *templateParams, tmpl string) error {
+	if s.stmts[id] != nil {
+		panic(fmt.Sprintf("statement %v prepared twice", id))
+	}
+	query := templateVal(p, tmpl)
+	if s.dialect == Postgres {
+		query = postgresPlaceholders(query)
+	}
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return errgo.Notef(err, "statement %v (%q) invalid", id, query)
+	}
+	s.stmts[id] = stmt
+	return nil
+}
+
+// postgresPlaceholders replaces each "?" in the given query with a
+// numbered PostgreSQL placeholder.
+func postgresPlaceholders(query string) string {
+	var buf strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&buf, "$%d", n)
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func templateVal(p *templateParams, s string) string {
+	tmpl := template.Must(template.New("").Parse(s))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, p); err != nil {
+		panic(errgo.Notef(err, "cannot create initialization statements"))
+	}
+	return buf.String()
+}
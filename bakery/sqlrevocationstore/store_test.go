@@ -0,0 +1,141 @@
+package sqlrevocationstore_test
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"github.com/juju/postgrestest"
+	_ "github.com/mattn/go-sqlite3"
+
+	"gopkg.in/macaroon-bakery.v2/bakery/sqlrevocationstore"
+)
+
+const testTable = "testrevoked"
+
+var epoch = time.Date(2200, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type storeSuite struct {
+	newDB func(c *qt.C) (*sql.DB, sqlrevocationstore.Dialect)
+	db    *sql.DB
+	store *sqlrevocationstore.Store
+}
+
+func TestSQLite(t *testing.T) {
+	qtsuite.Run(qt.New(t), &storeSuite{
+		newDB: func(c *qt.C) (*sql.DB, sqlrevocationstore.Dialect) {
+			dir, err := ioutil.TempDir("", "sqlrevocationstore")
+			c.Assert(err, qt.Equals, nil)
+			c.Defer(func() {
+				err := os.RemoveAll(dir)
+				c.Check(err, qt.Equals, nil)
+			})
+			db, err := sql.Open("sqlite3", filepath.Join(dir, "revoked.db"))
+			c.Assert(err, qt.Equals, nil)
+			c.Defer(func() {
+				err := db.Close()
+				c.Check(err, qt.Equals, nil)
+			})
+			return db, sqlrevocationstore.SQLite
+		},
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	qtsuite.Run(qt.New(t), &storeSuite{
+		newDB: func(c *qt.C) (*sql.DB, sqlrevocationstore.Dialect) {
+			db, err := postgrestest.New()
+			if err == postgrestest.ErrDisabled {
+				c.Skip("postgres testing is disabled")
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Defer(func() {
+				err := db.Close()
+				c.Check(err, qt.Equals, nil)
+			})
+			return db.DB, sqlrevocationstore.Postgres
+		},
+	})
+}
+
+func (s *storeSuite) Init(c *qt.C) {
+	c.Patch(sqlrevocationstore.Now, func() time.Time {
+		return epoch
+	})
+	db, dialect := s.newDB(c)
+	s.db = db
+	s.store = sqlrevocationstore.New(db, dialect, testTable)
+	c.Defer(func() {
+		err := s.store.Close()
+		c.Check(err, qt.Equals, nil)
+	})
+}
+
+func (s *storeSuite) TestRevoke(c *qt.C) {
+	ctx := context.Background()
+	revoked, err := s.store.IsRevoked(ctx, []byte("nonce"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, false)
+
+	err = s.store.Revoke(ctx, []byte("nonce"), epoch.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	revoked, err = s.store.IsRevoked(ctx, []byte("nonce"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, true)
+
+	revoked, err = s.store.IsRevoked(ctx, []byte("other"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, false)
+}
+
+func (s *storeSuite) TestRevokeTwice(c *qt.C) {
+	ctx := context.Background()
+	err := s.store.Revoke(ctx, []byte("nonce"), epoch.Add(2*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	// Revoking again with an earlier expiry time does not
+	// shorten the life of the record.
+	err = s.store.Revoke(ctx, []byte("nonce"), epoch.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	c.Patch(sqlrevocationstore.Now, func() time.Time {
+		return epoch.Add(90 * time.Minute)
+	})
+	revoked, err := s.store.IsRevoked(ctx, []byte("nonce"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, true)
+}
+
+func (s *storeSuite) TestExpiry(c *qt.C) {
+	ctx := context.Background()
+	err := s.store.Revoke(ctx, []byte("expiring"), epoch.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = s.store.Revoke(ctx, []byte("forever"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	c.Patch(sqlrevocationstore.Now, func() time.Time {
+		return epoch.Add(2 * time.Hour)
+	})
+	revoked, err := s.store.IsRevoked(ctx, []byte("expiring"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, false)
+	revoked, err = s.store.IsRevoked(ctx, []byte("forever"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, true)
+
+	err = s.store.DeleteExpired(ctx, epoch.Add(2*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s.count(c), qt.Equals, 1)
+}
+
+func (s *storeSuite) count(c *qt.C) int {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM " + testTable).Scan(&n)
+	c.Assert(err, qt.Equals, nil)
+	return n
+}
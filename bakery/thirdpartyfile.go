@@ -0,0 +1,332 @@
+package bakery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// FileThirdPartyStoreParams holds parameters for
+// NewFileThirdPartyStore.
+type FileThirdPartyStoreParams struct {
+	// Path holds the path of the file holding the third party
+	// information. If it has a ".yaml" or ".yml" extension, it is
+	// in YAML format; otherwise it is in JSON format. In both
+	// cases it holds a list of entries, each with "location",
+	// "public" and "version" fields, where "public" holds the
+	// public key in the same form that KeyPair is marshaled.
+	// For example:
+	//
+	//	[{
+	//		"location": "https://discharger.example.com",
+	//		"public": "qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g=",
+	//		"version": 3
+	//	}]
+	//
+	// The file need not exist; it will be created when
+	// information is first added.
+	Path string
+
+	// TrustOnFirstUse holds whether the store refuses to
+	// change the public key recorded for a location. When it is
+	// true, AddInfo records the information for locations that
+	// are not yet in the store but returns an error with an
+	// ErrPublicKeyChanged cause if the public key for a location
+	// differs from the one already recorded, or with an
+	// ErrVersionDowngraded cause if the version is earlier than
+	// the one already recorded, as that could be used to make
+	// clients use a weaker caveat encoding.
+	TrustOnFirstUse bool
+
+	// ReloadInterval holds how often the file is checked for
+	// changes made by other means, such as by an administrator
+	// or another process. If it has changed, it is reloaded.
+	// If this is zero, the file is only reloaded when Reload
+	// or AddInfo is called.
+	ReloadInterval time.Duration
+
+	// Logger is used to log errors encountered when reloading
+	// the file in the background. If it is nil,
+	// DefaultLogger("bakery") will be used.
+	Logger Logger
+}
+
+// FileThirdPartyStore implements ThirdPartyLocator by holding
+// information on third parties in a file, so that it persists
+// across restarts and can be provided by administrators in
+// environments where third parties cannot be contacted to
+// find out their public keys.
+//
+// A FileThirdPartyStore is safe to use concurrently.
+type FileThirdPartyStore struct {
+	p      FileThirdPartyStoreParams
+	closed chan struct{}
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// m holds the current contents of the file, keyed by
+	// canonical location.
+	m map[string]ThirdPartyInfo
+
+	// modTime and size hold the modification time and size of
+	// the file when it was last read or written. They are zero
+	// if the file did not exist.
+	modTime time.Time
+	size    int64
+}
+
+var _ ThirdPartyLocator = (*FileThirdPartyStore)(nil)
+
+// NewFileThirdPartyStore returns a new FileThirdPartyStore that holds
+// its information in the file specified by p.Path, loading any
+// information that's already there.
+//
+// If p.ReloadInterval is non-zero, Close should be called when the
+// store is no longer needed.
+func NewFileThirdPartyStore(p FileThirdPartyStoreParams) (*FileThirdPartyStore, error) {
+	if p.Path == "" {
+		return nil, errgo.Newf("no third party store file path specified")
+	}
+	if p.Logger == nil {
+		p.Logger = DefaultLogger("bakery")
+	}
+	s := &FileThirdPartyStore{
+		p:      p,
+		closed: make(chan struct{}),
+		m:      make(map[string]ThirdPartyInfo),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if p.ReloadInterval > 0 {
+		go s.watch()
+	}
+	return s, nil
+}
+
+// ThirdPartyInfo implements ThirdPartyLocator.ThirdPartyInfo.
+func (s *FileThirdPartyStore) ThirdPartyInfo(ctx context.Context, loc string) (ThirdPartyInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, ok := s.m[canonicalLocation(loc)]; ok {
+		return info, nil
+	}
+	return ThirdPartyInfo{}, ErrNotFound
+}
+
+// AddInfo associates the given information with the given location,
+// ignoring any trailing slash, and saves it to the file. See
+// FileThirdPartyStoreParams.TrustOnFirstUse for when the information
+// will be refused.
+func (s *FileThirdPartyStore) AddInfo(loc string, info ThirdPartyInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Make sure that we don't overwrite changes made
+	// by others since the file was last read.
+	if err := s.reloadIfChanged(); err != nil {
+		return errgo.Mask(err)
+	}
+	loc = canonicalLocation(loc)
+	old, ok := s.m[loc]
+	if ok && old == info {
+		return nil
+	}
+	if ok && s.p.TrustOnFirstUse && old.PublicKey != info.PublicKey {
+		return errgo.WithCausef(nil, ErrPublicKeyChanged, "public key for %q has changed from %v to %v", loc, old.PublicKey, info.PublicKey)
+	}
+	if ok && s.p.TrustOnFirstUse && info.Version < old.Version {
+		return errgo.WithCausef(nil, ErrVersionDowngraded, "version for %q has been downgraded from %d to %d", loc, old.Version, info.Version)
+	}
+	m := make(map[string]ThirdPartyInfo, len(s.m)+1)
+	for loc, info := range s.m {
+		m[loc] = info
+	}
+	m[loc] = info
+	if err := s.save(m); err != nil {
+		return errgo.Notef(err, "cannot save third party information")
+	}
+	s.m = m
+	return nil
+}
+
+// Reload reloads the information from the file, discarding
+// any that is no longer there.
+func (s *FileThirdPartyStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reload()
+}
+
+// Close stops the store from watching the file for changes.
+func (s *FileThirdPartyStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+// watch reloads the file whenever it changes
+// until the store is closed.
+func (s *FileThirdPartyStore) watch() {
+	ticker := time.NewTicker(s.p.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		s.mu.Lock()
+		err := s.reloadIfChanged()
+		s.mu.Unlock()
+		if err != nil {
+			s.p.Logger.Infof(context.Background(), "cannot reload third party information: %v", err)
+		}
+	}
+}
+
+// reloadIfChanged reloads the file if its modification time or size
+// have changed since it was last read or written. It must be called
+// with s.mu held.
+func (s *FileThirdPartyStore) reloadIfChanged() error {
+	modTime, size, err := fileStat(s.p.Path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if modTime.Equal(s.modTime) && size == s.size {
+		return nil
+	}
+	return s.reload()
+}
+
+// reload reads the file. It must be called with s.mu held.
+func (s *FileThirdPartyStore) reload() error {
+	modTime, size, err := fileStat(s.p.Path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	data, err := ioutil.ReadFile(s.p.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return errgo.Mask(err)
+	}
+	var entries []thirdPartyFileEntry
+	if len(data) > 0 {
+		if isYAMLFile(s.p.Path) {
+			err = yaml.Unmarshal(data, &entries)
+		} else {
+			err = json.Unmarshal(data, &entries)
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot load %q", s.p.Path)
+		}
+	}
+	m := make(map[string]ThirdPartyInfo, len(entries))
+	for _, e := range entries {
+		if e.Location == "" {
+			return errgo.Newf("cannot load %q: entry with no location", s.p.Path)
+		}
+		if e.PublicKey.isZero() {
+			return errgo.Newf("cannot load %q: no public key for %q", s.p.Path, e.Location)
+		}
+		if e.Version > LatestVersion {
+			return errgo.Newf("cannot load %q: unknown version %d for %q", s.p.Path, e.Version, e.Location)
+		}
+		m[canonicalLocation(e.Location)] = ThirdPartyInfo{
+			PublicKey: e.PublicKey,
+			Version:   e.Version,
+		}
+	}
+	s.m = m
+	s.modTime, s.size = modTime, size
+	return nil
+}
+
+// save writes m to the file, replacing it atomically. It must be
+// called with s.mu held.
+func (s *FileThirdPartyStore) save(m map[string]ThirdPartyInfo) error {
+	entries := make([]thirdPartyFileEntry, 0, len(m))
+	for loc, info := range m {
+		entries = append(entries, thirdPartyFileEntry{
+			Location:  loc,
+			PublicKey: info.PublicKey,
+			Version:   info.Version,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Location < entries[j].Location
+	})
+	var data []byte
+	var err error
+	if isYAMLFile(s.p.Path) {
+		data, err = yaml.Marshal(entries)
+	} else {
+		data, err = json.MarshalIndent(entries, "", "\t")
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.p.Path), filepath.Base(s.p.Path)+".tmp")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(f.Name(), s.p.Path); err != nil {
+		return errgo.Mask(err)
+	}
+	s.modTime, s.size, err = fileStat(s.p.Path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// thirdPartyFileEntry holds an entry in a FileThirdPartyStore file.
+type thirdPartyFileEntry struct {
+	Location  string    `json:"location" yaml:"location"`
+	PublicKey PublicKey `json:"public" yaml:"public"`
+	Version   Version   `json:"version" yaml:"version"`
+}
+
+// fileStat returns the modification time and size of the named
+// file, or zero values if it does not exist.
+func fileStat(path string) (time.Time, int64, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, 0, nil
+	}
+	if err != nil {
+		return time.Time{}, 0, errgo.Mask(err)
+	}
+	return fi.ModTime(), fi.Size(), nil
+}
+
+func isYAMLFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+package bakery_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+func TestFileThirdPartyStoreSaveLoad(t *testing.T) {
+	c := qt.New(t)
+	for _, name := range []string{"thirdparty.json", "thirdparty.yaml", "thirdparty.yml"} {
+		c.Run(name, func(c *qt.C) {
+			defer c.Done()
+			path := filepath.Join(c.Mkdir(), name)
+			s, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+				Path: path,
+			})
+			c.Assert(err, qt.IsNil)
+			_, err = s.ThirdPartyInfo(testContext, "https://example.com")
+			c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+
+			info1 := bakery.ThirdPartyInfo{
+				PublicKey: mustGenerateKey().Public,
+				Version:   bakery.Version3,
+			}
+			info2 := bakery.ThirdPartyInfo{
+				PublicKey: mustGenerateKey().Public,
+				Version:   bakery.Version1,
+			}
+			err = s.AddInfo("https://example.com/", info1)
+			c.Assert(err, qt.IsNil)
+			err = s.AddInfo("https://other.example.com", info2)
+			c.Assert(err, qt.IsNil)
+
+			s1, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+				Path: path,
+			})
+			c.Assert(err, qt.IsNil)
+			info, err := s1.ThirdPartyInfo(testContext, "https://example.com")
+			c.Assert(err, qt.IsNil)
+			c.Assert(info, qt.Equals, info1)
+			info, err = s1.ThirdPartyInfo(testContext, "https://other.example.com/")
+			c.Assert(err, qt.IsNil)
+			c.Assert(info, qt.Equals, info2)
+		})
+	}
+}
+
+var fileThirdPartyStoreLoadTests = []struct {
+	about       string
+	name        string
+	data        string
+	expectInfo  map[string]bakery.ThirdPartyInfo
+	expectError string
+}{{
+	about: "json",
+	name:  "thirdparty.json",
+	data: `[{
+		"location": "https://example.com",
+		"public": "qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g=",
+		"version": 3
+	}]`,
+	expectInfo: map[string]bakery.ThirdPartyInfo{
+		"https://example.com": {
+			PublicKey: mustParsePublicKey("qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g="),
+			Version:   bakery.Version3,
+		},
+	},
+}, {
+	about: "yaml",
+	name:  "thirdparty.yaml",
+	data: `
+- location: https://example.com
+  public: qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g=
+  version: 2
+`,
+	expectInfo: map[string]bakery.ThirdPartyInfo{
+		"https://example.com": {
+			PublicKey: mustParsePublicKey("qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g="),
+			Version:   bakery.Version2,
+		},
+	},
+}, {
+	about: "empty file",
+	name:  "thirdparty.json",
+	data:  "",
+}, {
+	about:       "invalid json",
+	name:        "thirdparty.json",
+	data:        "{",
+	expectError: `cannot load ".*": unexpected end of JSON input`,
+}, {
+	about:       "no location",
+	name:        "thirdparty.json",
+	data:        `[{"public": "qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g="}]`,
+	expectError: `cannot load ".*": entry with no location`,
+}, {
+	about:       "no public key",
+	name:        "thirdparty.json",
+	data:        `[{"location": "https://example.com"}]`,
+	expectError: `cannot load ".*": no public key for "https://example.com"`,
+}, {
+	about:       "bad public key",
+	name:        "thirdparty.json",
+	data:        `[{"location": "https://example.com", "public": "aGVsbG8="}]`,
+	expectError: `cannot load ".*": wrong length for key, got 5 want 32`,
+}, {
+	about:       "unknown version",
+	name:        "thirdparty.json",
+	data:        `[{"location": "https://example.com", "public": "qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g=", "version": 99}]`,
+	expectError: `cannot load ".*": unknown version 99 for "https://example.com"`,
+}}
+
+func TestFileThirdPartyStoreLoad(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range fileThirdPartyStoreLoadTests {
+		c.Run(test.about, func(c *qt.C) {
+			defer c.Done()
+			path := filepath.Join(c.Mkdir(), test.name)
+			err := ioutil.WriteFile(path, []byte(test.data), 0644)
+			c.Assert(err, qt.IsNil)
+			s, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+				Path: path,
+			})
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			for loc, expectInfo := range test.expectInfo {
+				info, err := s.ThirdPartyInfo(testContext, loc)
+				c.Assert(err, qt.IsNil)
+				c.Assert(info, qt.Equals, expectInfo)
+			}
+		})
+	}
+}
+
+func TestFileThirdPartyStoreNoPath(t *testing.T) {
+	c := qt.New(t)
+	_, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{})
+	c.Assert(err, qt.ErrorMatches, `no third party store file path specified`)
+}
+
+func TestFileThirdPartyStoreTrustOnFirstUse(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	path := filepath.Join(c.Mkdir(), "thirdparty.json")
+	s, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+		Path:            path,
+		TrustOnFirstUse: true,
+	})
+	c.Assert(err, qt.IsNil)
+	info := bakery.ThirdPartyInfo{
+		PublicKey: mustGenerateKey().Public,
+		Version:   bakery.Version2,
+	}
+	err = s.AddInfo("https://example.com", info)
+	c.Assert(err, qt.IsNil)
+
+	// The version may be upgraded but not downgraded.
+	info.Version = bakery.Version3
+	err = s.AddInfo("https://example.com", info)
+	c.Assert(err, qt.IsNil)
+	downgraded := info
+	downgraded.Version = bakery.Version1
+	err = s.AddInfo("https://example.com", downgraded)
+	c.Assert(err, qt.ErrorMatches, `version for "https://example.com" has been downgraded from 3 to 1`)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrVersionDowngraded)
+
+	// The public key may not change.
+
+	info1 := bakery.ThirdPartyInfo{
+		PublicKey: mustGenerateKey().Public,
+		Version:   bakery.Version3,
+	}
+	err = s.AddInfo("https://example.com/", info1)
+	c.Assert(err, qt.ErrorMatches, `public key for "https://example.com" has changed from .* to .*`)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrPublicKeyChanged)
+
+	gotInfo, err := s.ThirdPartyInfo(testContext, "https://example.com")
+	c.Assert(err, qt.IsNil)
+	c.Assert(gotInfo, qt.Equals, info)
+
+	// The key can still be changed by editing the file.
+	c.Assert(os.Remove(path), qt.IsNil)
+	c.Assert(s.Reload(), qt.IsNil)
+	err = s.AddInfo("https://example.com/", info1)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestFileThirdPartyStoreWithoutTrustOnFirstUse(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	path := filepath.Join(c.Mkdir(), "thirdparty.json")
+	s, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+		Path: path,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.AddInfo("https://example.com", bakery.ThirdPartyInfo{
+		PublicKey: mustGenerateKey().Public,
+		Version:   bakery.Version3,
+	})
+	c.Assert(err, qt.IsNil)
+	info := bakery.ThirdPartyInfo{
+		PublicKey: mustGenerateKey().Public,
+		Version:   bakery.Version3,
+	}
+	err = s.AddInfo("https://example.com", info)
+	c.Assert(err, qt.IsNil)
+	gotInfo, err := s.ThirdPartyInfo(testContext, "https://example.com")
+	c.Assert(err, qt.IsNil)
+	c.Assert(gotInfo, qt.Equals, info)
+}
+
+func TestFileThirdPartyStoreAddInfoPreservesExternalChanges(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	path := filepath.Join(c.Mkdir(), "thirdparty.json")
+	s, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+		Path: path,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Another store adds information to the same file.
+	s1, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+		Path: path,
+	})
+	c.Assert(err, qt.IsNil)
+	info1 := bakery.ThirdPartyInfo{
+		PublicKey: mustGenerateKey().Public,
+		Version:   bakery.Version3,
+	}
+	err = s1.AddInfo("https://one.example.com", info1)
+	c.Assert(err, qt.IsNil)
+
+	info2 := bakery.ThirdPartyInfo{
+		PublicKey: mustGenerateKey().Public,
+		Version:   bakery.Version3,
+	}
+	err = s.AddInfo("https://two.example.com", info2)
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(s.Reload(), qt.IsNil)
+	info, err := s.ThirdPartyInfo(testContext, "https://one.example.com")
+	c.Assert(err, qt.IsNil)
+	c.Assert(info, qt.Equals, info1)
+	info, err = s.ThirdPartyInfo(testContext, "https://two.example.com")
+	c.Assert(err, qt.IsNil)
+	c.Assert(info, qt.Equals, info2)
+}
+
+func TestFileThirdPartyStoreWatch(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	path := filepath.Join(c.Mkdir(), "thirdparty.json")
+	s, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+		Path:           path,
+		ReloadInterval: time.Millisecond,
+	})
+	c.Assert(err, qt.IsNil)
+	defer s.Close()
+
+	err = ioutil.WriteFile(path, []byte(`[{
+		"location": "https://example.com",
+		"public": "qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g=",
+		"version": 3
+	}]`), 0644)
+	c.Assert(err, qt.IsNil)
+	expectInfo := bakery.ThirdPartyInfo{
+		PublicKey: mustParsePublicKey("qdk6mOK5E0bbGHg2sB7J3F0MVefqD7FXRU47CJXoR3g="),
+		Version:   bakery.Version3,
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		info, err := s.ThirdPartyInfo(testContext, "https://example.com")
+		if err == nil {
+			c.Assert(info, qt.Equals, expectInfo)
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("file not reloaded in time")
+		}
+	}
+
+	// A file that cannot be parsed leaves the
+	// information unchanged.
+	err = ioutil.WriteFile(path, []byte(`bad`), 0644)
+	c.Assert(err, qt.IsNil)
+	time.Sleep(20 * time.Millisecond)
+	info, err := s.ThirdPartyInfo(testContext, "https://example.com")
+	c.Assert(err, qt.IsNil)
+	c.Assert(info, qt.Equals, expectInfo)
+}
+
+func mustParsePublicKey(s string) bakery.PublicKey {
+	var k bakery.PublicKey
+	if err := k.UnmarshalText([]byte(s)); err != nil {
+		panic(err)
+	}
+	return k
+}
@@ -0,0 +1,133 @@
+package bakery
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"gopkg.in/macaroon.v2"
+)
+
+// verifyCache holds the results of successful macaroon signature
+// verifications so that the HMAC chain need not be recomputed
+// for a macaroon slice that has been seen before.
+//
+// Each entry records a hash of the root key that the slice was
+// verified with. The root key is still obtained from the root key
+// store for every verification, so an entry can never outlive
+// its root key: if the key has expired or been revoked, the store
+// will not return it and the entry is discarded.
+//
+// Only successful verifications are cached. Macaroon revocation
+// (see RevocationStore) is checked independently of the cache.
+type verifyCache struct {
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	// lru holds the entries in least-recently-used order,
+	// most recently used first.
+	lru list.List
+}
+
+type verifyCacheEntry struct {
+	key        [sha256.Size]byte
+	rootKey    [sha256.Size]byte
+	conditions []string
+}
+
+func newVerifyCache(maxSize int) *verifyCache {
+	return &verifyCache{
+		maxSize: maxSize,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// verifyCacheKey returns the key used to cache the result of
+// verifying the given slice. It is derived from the primary
+// macaroon's id and the signatures of all the macaroons
+// in the slice.
+func verifyCacheKey(ms macaroon.Slice) [sha256.Size]byte {
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	writeBytes := func(b []byte) {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))])
+		h.Write(b)
+	}
+	writeBytes(ms[0].Id())
+	for _, m := range ms {
+		writeBytes(m.Signature())
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// get returns the conditions recorded for the given key, which
+// must have been verified with the given root key.
+func (c *verifyCache) get(key [sha256.Size]byte, rootKey []byte) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*verifyCacheEntry)
+	if entry.rootKey != sha256.Sum256(rootKey) {
+		// The root key has changed since the entry was added,
+		// so the entry can no longer be trusted.
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return copyStrings(entry.conditions), true
+}
+
+// add records that the slice with the given key was successfully
+// verified with the given root key, yielding the given conditions.
+func (c *verifyCache) add(key [sha256.Size]byte, rootKey []byte, conditions []string) {
+	entry := &verifyCacheEntry{
+		key:        key,
+		rootKey:    sha256.Sum256(rootKey),
+		conditions: copyStrings(conditions),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxSize {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*verifyCacheEntry).key)
+	}
+}
+
+// remove removes any entry for the given key.
+func (c *verifyCache) remove(key [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// len returns the number of entries in the cache.
+func (c *verifyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func copyStrings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	return append([]string(nil), ss...)
+}
@@ -0,0 +1,241 @@
+package bakery_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon.v2"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+)
+
+func TestVerificationCache(t *testing.T) {
+	c := qt.New(t)
+	store := &switchableRootKeyStore{
+		RootKeyStore: bakery.NewMemRootKeyStore(),
+	}
+	oven := newCachingOven(store, 10)
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, []checkers.Caveat{
+		checkers.DeclaredCaveat("user", "bob"),
+	}, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+
+	for i := 0; i < 3; i++ {
+		ops, conds, err := oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+		c.Assert(err, qt.IsNil)
+		c.Assert(ops, qt.DeepEquals, []bakery.Op{{"entity", "read"}})
+		c.Assert(conds, qt.DeepEquals, []string{"declared user bob"})
+		// Changing the returned conditions must not affect
+		// later results.
+		conds[0] = "something else"
+	}
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 1)
+	// The root key is fetched on every call even when the
+	// result is cached.
+	c.Assert(store.getCount(), qt.Equals, 3)
+}
+
+func TestVerificationCacheDoesNotCacheFailures(t *testing.T) {
+	c := qt.New(t)
+	oven := newCachingOven(&switchableRootKeyStore{
+		RootKeyStore: bakery.NewMemRootKeyStore(),
+	}, 10)
+	_, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	// A macaroon minted by another oven has the same root key
+	// id but a different root key, so it fails verification.
+	m, err := bakery.NewOven(bakery.OvenParams{}).NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	bad := m.M()
+	for i := 0; i < 2; i++ {
+		_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{bad})
+		c.Assert(err, qt.ErrorMatches, `verification failed: signature mismatch after caveat verification`)
+	}
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 0)
+}
+
+func TestVerificationCacheRootKeyRemoved(t *testing.T) {
+	c := qt.New(t)
+	store := &switchableRootKeyStore{
+		RootKeyStore: bakery.NewMemRootKeyStore(),
+	}
+	oven := newCachingOven(store, 10)
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+
+	// When the root key expires or is revoked, the store
+	// no longer returns it and the cached result is not used.
+	store.setRemoved(true)
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.ErrorMatches, `verification failed: macaroon not found in storage`)
+	_, ok := err.(*bakery.VerificationError)
+	c.Assert(ok, qt.Equals, true)
+}
+
+func TestVerificationCacheRootKeyChanged(t *testing.T) {
+	c := qt.New(t)
+	store := &switchableRootKeyStore{
+		RootKeyStore: bakery.NewMemRootKeyStore(),
+	}
+	oven := newCachingOven(store, 10)
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 1)
+
+	// If the store returns a different key for the same id,
+	// the cached entry is discarded and the signature is
+	// checked against the new key.
+	store.setRootKey([]byte("some other root key"))
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.ErrorMatches, `verification failed: signature mismatch after caveat verification`)
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 0)
+}
+
+func TestVerificationCacheRevokedMacaroon(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{
+		RevocationStore:       bakery.NewMemRevocationStore(),
+		VerificationCacheSize: 10,
+	})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 1)
+
+	err = oven.RevokeMacaroon(testContext, m.M().Id())
+	c.Assert(err, qt.IsNil)
+	for i := 0; i < 2; i++ {
+		_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+		c.Assert(err, qt.ErrorMatches, `verification failed: macaroon has been revoked`)
+	}
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 0)
+}
+
+func TestVerificationCacheWithDischarges(t *testing.T) {
+	c := qt.New(t)
+	locator := bakery.NewThirdPartyStore()
+	as := newBakery("as-loc", locator)
+	ts := newBakery("ts-loc", locator)
+	oven := bakery.NewOven(bakery.OvenParams{
+		Key:                   ts.Oven.Key(),
+		Locator:               locator,
+		Location:              "ts-loc",
+		VerificationCacheSize: 10,
+	})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, []checkers.Caveat{{
+		Location:  "as-loc",
+		Condition: "something",
+	}}, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	discharge := func(cond string) macaroon.Slice {
+		ms, err := bakery.DischargeAllWithKey(testContext, m, func(ctx context.Context, cav macaroon.Caveat, encodedCav []byte) (*bakery.Macaroon, error) {
+			return bakery.Discharge(ctx, bakery.DischargeParams{
+				Id:     cav.Id,
+				Caveat: encodedCav,
+				Key:    as.Oven.Key(),
+				Checker: thirdPartyCheckerWithCaveats{
+					checkers.Caveat{Condition: cond},
+				},
+			})
+		}, nil)
+		c.Assert(err, qt.IsNil)
+		return ms
+	}
+	ms1 := discharge("a")
+	ms2 := discharge("b")
+	_, conds, err := oven.VerifyMacaroon(testContext, ms1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(conds, qt.DeepEquals, []string{"a"})
+	// The same primary macaroon with a different discharge
+	// is cached separately.
+	_, conds, err = oven.VerifyMacaroon(testContext, ms2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(conds, qt.DeepEquals, []string{"b"})
+	_, conds, err = oven.VerifyMacaroon(testContext, ms1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(conds, qt.DeepEquals, []string{"a"})
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 2)
+}
+
+func TestVerificationCacheSizeLimit(t *testing.T) {
+	c := qt.New(t)
+	oven := newCachingOven(&switchableRootKeyStore{
+		RootKeyStore: bakery.NewMemRootKeyStore(),
+	}, 2)
+	for i := 0; i < 5; i++ {
+		m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+		c.Assert(err, qt.IsNil)
+		_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 2)
+}
+
+func TestVerificationCacheDisabled(t *testing.T) {
+	c := qt.New(t)
+	oven := bakery.NewOven(bakery.OvenParams{})
+	m, err := oven.NewMacaroon(testContext, bakery.LatestVersion, nil, bakery.Op{"entity", "read"})
+	c.Assert(err, qt.IsNil)
+	_, _, err = oven.VerifyMacaroon(testContext, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(bakery.VerificationCacheLen(oven), qt.Equals, 0)
+}
+
+func newCachingOven(store bakery.RootKeyStore, size int) *bakery.Oven {
+	return bakery.NewOven(bakery.OvenParams{
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return store
+		},
+		VerificationCacheSize: size,
+	})
+}
+
+// switchableRootKeyStore wraps a RootKeyStore so that
+// tests can remove or replace root keys.
+type switchableRootKeyStore struct {
+	bakery.RootKeyStore
+
+	mu      sync.Mutex
+	removed bool
+	rootKey []byte
+	gets    int
+}
+
+func (s *switchableRootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	if s.removed {
+		return nil, bakery.ErrNotFound
+	}
+	if s.rootKey != nil {
+		return s.rootKey, nil
+	}
+	return s.RootKeyStore.Get(ctx, id)
+}
+
+func (s *switchableRootKeyStore) setRemoved(removed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removed = removed
+}
+
+func (s *switchableRootKeyStore) setRootKey(rootKey []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rootKey = rootKey
+}
+
+func (s *switchableRootKeyStore) getCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
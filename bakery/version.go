@@ -14,8 +14,12 @@ const (
 	Version2 Version = 2
 	// In version 3, we support operations associated with macaroons
 	// and external third party caveats.
-	Version3      Version = 3
-	LatestVersion         = Version3
+	Version3 Version = 3
+	// In version 4, third party caveats are encrypted with an
+	// authenticated KDF-based scheme, identify the third party key
+	// in full and are bound to the third party location.
+	Version4      Version = 4
+	LatestVersion         = Version4
 )
 
 // MacaroonVersion returns the macaroon version that should
@@ -0,0 +1,259 @@
+// The bakery-rootkeys command copies macaroon root keys between root
+// key stores and exports them to and imports them from encrypted
+// backup files.
+//
+// Usage:
+//
+//	bakery-rootkeys copy <from> <to>
+//	bakery-rootkeys export <from> <file>
+//	bakery-rootkeys import <file> <to>
+//
+// Stores are specified as URLs:
+//
+//	mongodb://host[:port]/database/collection
+//	postgres://user@host/database?table=rootkeys
+//	sqlite:path/to/file.db?table=rootkeys
+//	bolt:path/to/file.db?bucket=rootkeys
+//
+// All other query parameters of a postgres URL are passed to the
+// driver. Only keys that have not expired are copied. The passphrase
+// for export files is read from the BAKERY_ROOTKEYS_PASSPHRASE
+// environment variable.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/mgo/v2"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/macaroon-bakery.v2/bakery/boltrootkeystore"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+	"gopkg.in/macaroon-bakery.v2/bakery/mgorootkeystore"
+	"gopkg.in/macaroon-bakery.v2/bakery/postgresrootkeystore"
+	"gopkg.in/macaroon-bakery.v2/bakery/sqliterootkeystore"
+)
+
+const passphraseEnv = "BAKERY_ROOTKEYS_PASSPHRASE"
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage:\n")
+		fmt.Fprintf(os.Stderr, "\tbakery-rootkeys copy <from> <to>\n")
+		fmt.Fprintf(os.Stderr, "\tbakery-rootkeys export <from> <file>\n")
+		fmt.Fprintf(os.Stderr, "\tbakery-rootkeys import <file> <to>\n")
+	}
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0), flag.Arg(1), flag.Arg(2)); err != nil {
+		fmt.Fprintf(os.Stderr, "bakery-rootkeys: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cmd, arg0, arg1 string) error {
+	ctx := context.Background()
+	now := time.Now()
+	switch cmd {
+	case "copy":
+		src, err := openStore(arg0)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer src.close()
+		dst, err := openStore(arg1)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer dst.close()
+		n, err := dbrootkeystore.CopyKeys(ctx, dst.backing, src.backing, now)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Printf("copied %d keys\n", n)
+	case "export":
+		passphrase, err := getPassphrase()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		src, err := openStore(arg0)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer src.close()
+		f, err := os.OpenFile(arg1, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		n, err := dbrootkeystore.ExportKeys(ctx, f, src.backing, now, passphrase)
+		if err != nil {
+			f.Close()
+			os.Remove(arg1)
+			return errgo.Mask(err)
+		}
+		if err := f.Close(); err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Printf("exported %d keys\n", n)
+	case "import":
+		passphrase, err := getPassphrase()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		f, err := os.Open(arg0)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer f.Close()
+		dst, err := openStore(arg1)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer dst.close()
+		n, err := dbrootkeystore.ImportKeys(ctx, dst.backing, f, now, passphrase)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Printf("imported %d keys\n", n)
+	default:
+		return errgo.Newf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+func getPassphrase() ([]byte, error) {
+	p := os.Getenv(passphraseEnv)
+	if p == "" {
+		return nil, errgo.Newf("no passphrase found in $%s", passphraseEnv)
+	}
+	return []byte(p), nil
+}
+
+// store holds a backing store opened by openStore.
+type store struct {
+	backing dbrootkeystore.Backing
+	close   func()
+}
+
+// openStore opens the root key store specified by the given URL.
+func openStore(s string) (*store, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid store URL %q", s)
+	}
+	switch u.Scheme {
+	case "mongodb":
+		return openMongo(u)
+	case "postgres", "postgresql":
+		return openPostgres(u)
+	case "sqlite":
+		return openSQLite(u)
+	case "bolt":
+		return openBolt(u)
+	}
+	return nil, errgo.Newf("unknown store type %q", u.Scheme)
+}
+
+func openMongo(u *url.URL) (*store, error) {
+	path := strings.TrimPrefix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return nil, errgo.Newf("no collection specified in MongoDB URL")
+	}
+	coll := path[i+1:]
+	u1 := *u
+	u1.Path = "/" + path[:i]
+	session, err := mgo.Dial(u1.String())
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to MongoDB at %q", u.Host)
+	}
+	c := session.DB("").C(coll)
+	return &store{
+		backing: mgorootkeystore.NewRootKeys(0).Backing(c),
+		close:   session.Close,
+	}, nil
+}
+
+func openPostgres(u *url.URL) (*store, error) {
+	q := u.Query()
+	table := q.Get("table")
+	if table == "" {
+		return nil, errgo.Newf("no table specified in postgres URL")
+	}
+	q.Del("table")
+	u1 := *u
+	u1.RawQuery = q.Encode()
+	db, err := sql.Open("postgres", u1.String())
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open postgres database at %q", u.Host)
+	}
+	keys := postgresrootkeystore.NewRootKeys(db, table, 0)
+	return &store{
+		backing: keys.Backing(),
+		close: func() {
+			keys.Close()
+			db.Close()
+		},
+	}, nil
+}
+
+func openSQLite(u *url.URL) (*store, error) {
+	table := u.Query().Get("table")
+	if table == "" {
+		return nil, errgo.Newf("no table specified in %q", u)
+	}
+	db, err := sql.Open("sqlite3", filePath(u))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open %q", filePath(u))
+	}
+	keys := sqliterootkeystore.NewRootKeys(db, table, 0)
+	return &store{
+		backing: keys.Backing(),
+		close: func() {
+			keys.Close()
+			db.Close()
+		},
+	}, nil
+}
+
+func openBolt(u *url.URL) (*store, error) {
+	bucket := u.Query().Get("bucket")
+	if bucket == "" {
+		return nil, errgo.Newf("no bucket specified in %q", u)
+	}
+	db, err := bolt.Open(filePath(u), 0600, &bolt.Options{
+		Timeout: 10 * time.Second,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open %q", filePath(u))
+	}
+	keys := boltrootkeystore.NewRootKeys(db, bucket, 0)
+	return &store{
+		backing: keys.Backing(),
+		close: func() {
+			db.Close()
+		},
+	}, nil
+}
+
+// filePath returns the file path from a URL of the form
+// scheme:path or scheme:///path.
+func filePath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
@@ -11,8 +11,10 @@ require (
 	github.com/juju/webbrowser v0.0.0-20160309143629-54b8c57083b4
 	github.com/julienschmidt/httprouter v1.2.0
 	github.com/kr/text v0.2.0 // indirect
-	github.com/lib/pq v1.3.0 // indirect
+	github.com/lib/pq v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/rogpeppe/fastuuid v0.0.0-20150106093220-6724a57986af
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	gopkg.in/errgo.v1 v1.0.1
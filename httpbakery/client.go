@@ -119,6 +119,15 @@ type Client struct {
 	// bakery.LocalThirdPartyCaveat for more information
 	Key *bakery.KeyPair
 
+	// DischargeConcurrency holds the maximum number of discharge
+	// macaroons that will be acquired at the same time when
+	// discharging a macaroon with several third party caveats.
+	// If it is zero or one, discharges are acquired one at a time.
+	// If it is greater than one, the interactors in
+	// InteractionMethods must be safe to use concurrently.
+	// See bakery.DischargeAllParams.Concurrency.
+	DischargeConcurrency int
+
 	// Logger is used to log information about client activities.
 	// If it is nil, bakery.DefaultLogger("httpbakery") will be used.
 	Logger bakery.Logger
@@ -197,13 +206,23 @@ func (c *Client) AddInteractor(i Interactor) {
 // The returned macaroon slice will not be stored in the client
 // cookie jar (see SetCookie if you need to do that).
 func (c *Client) DischargeAll(ctx context.Context, m *bakery.Macaroon) (macaroon.Slice, error) {
-	return bakery.DischargeAllWithKey(ctx, m, c.AcquireDischarge, c.Key)
+	return bakery.DischargeAllWithParams(ctx, m, c.dischargeAllParams())
 }
 
 // DischargeAllUnbound is like DischargeAll except that it does not
 // bind the resulting macaroons.
 func (c *Client) DischargeAllUnbound(ctx context.Context, ms bakery.Slice) (bakery.Slice, error) {
-	return ms.DischargeAll(ctx, c.AcquireDischarge, c.Key)
+	return ms.DischargeAllWithParams(ctx, c.dischargeAllParams())
+}
+
+// dischargeAllParams returns the parameters used to
+// discharge all the third party caveats in a macaroon.
+func (c *Client) dischargeAllParams() bakery.DischargeAllParams {
+	return bakery.DischargeAllParams{
+		GetDischarge: c.AcquireDischarge,
+		LocalKey:     c.Key,
+		Concurrency:  c.DischargeConcurrency,
+	}
 }
 
 // Do is like DoWithContext, except the context is automatically derived.
@@ -328,7 +347,7 @@ func (c *Client) HandleError(ctx context.Context, reqURL *url.URL, err error) er
 		return errgo.New("no macaroon found in discharge-required response")
 	}
 	mac := respErr.Info.Macaroon
-	macaroons, err := bakery.DischargeAllWithKey(ctx, mac, c.AcquireDischarge, c.Key)
+	macaroons, err := bakery.DischargeAllWithParams(ctx, mac, c.dischargeAllParams())
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
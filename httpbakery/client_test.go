@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -712,6 +713,49 @@ func TestThirdPartyDischargeRefused(t *testing.T) {
 	c.Assert(resp, qt.IsNil)
 }
 
+func TestDischargeConcurrency(t *testing.T) {
+	c := qt.New(t)
+	d := bakerytest.NewDischarger(nil)
+	defer d.Close()
+	const concurrency = 3
+	var mu sync.Mutex
+	started := 0
+	allStarted := make(chan struct{})
+	d.CheckerP = bakerytest.ConditionParser(func(cond, arg string) ([]checkers.Caveat, error) {
+		mu.Lock()
+		started++
+		if started == concurrency {
+			close(allStarted)
+		}
+		mu.Unlock()
+		select {
+		case <-allStarted:
+			return nil, nil
+		case <-time.After(5 * time.Second):
+			return nil, errgo.Newf("caveats not discharged concurrently")
+		}
+	})
+	b := newBakery("loc", d, nil)
+	var caveats []checkers.Caveat
+	for i := 0; i < concurrency; i++ {
+		caveats = append(caveats, checkers.Caveat{
+			Location:  d.Location(),
+			Condition: fmt.Sprintf("wait %d", i),
+		})
+	}
+	m, err := b.Oven.NewMacaroon(testContext, bakery.LatestVersion, caveats, testOp)
+	c.Assert(err, qt.IsNil)
+
+	client := httpbakery.NewClient()
+	client.DischargeConcurrency = concurrency
+	ms, err := client.DischargeAll(testContext, m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms, qt.HasLen, concurrency+1)
+	for i, cav := range m.M().Caveats() {
+		c.Assert(ms[i+1].Id(), qt.DeepEquals, cav.Id)
+	}
+}
+
 func TestDischargeWithInteractionRequiredError(t *testing.T) {
 	c := qt.New(t)
 	d := bakerytest.NewDischarger(nil)
@@ -109,11 +109,26 @@ type DischargerParams struct {
 	// Key holds the key pair of the discharger.
 	Key *bakery.KeyPair
 
+	// KeyRing, if non-nil, holds the key pairs of the discharger
+	// and is used in preference to Key. The public key of its
+	// current key pair is advertised by the discharger, but
+	// caveats encrypted for any key in the ring will be
+	// discharged. This enables the discharger's key to be
+	// rotated without invalidating outstanding caveats.
+	KeyRing *bakery.KeyRing
+
 	// Locator is used to find public keys when adding
 	// third-party caveats on discharge macaroons.
 	// If this is nil, no third party caveats may be added.
 	Locator bakery.ThirdPartyLocator
 
+	// Location, if non-empty, holds the location of the discharger
+	// as used in third party caveats addressed to it. Caveats
+	// encoded with bakery.Version4 or later that were addressed to
+	// a different location will not be discharged.
+	// See bakery.DischargeParams.Location.
+	Location string
+
 	// ErrorToResponse is used to convert errors returned by the third
 	// party caveat checker to the form that will be JSON-marshaled
 	// on the wire. If zero, this defaults to ErrorToResponse.
@@ -151,6 +166,14 @@ type DischargerParams struct {
 //	result:
 //		public key of service
 //		expiry time of key
+//
+// GET /discharge/info
+//	result:
+//		public key of service
+//		latest bakery version supported by the service
+//
+// When the discharger uses a KeyRing, the public key of the
+// current key pair is returned.
 type Discharger struct {
 	p DischargerParams
 }
@@ -164,6 +187,9 @@ func NewDischarger(p DischargerParams) *Discharger {
 	if p.Locator == nil {
 		p.Locator = emptyLocator{}
 	}
+	if p.KeyRing == nil {
+		p.KeyRing = bakery.NewKeyRing(p.Key)
+	}
 	if p.CheckerP == nil {
 		p.CheckerP = ThirdPartyCaveatCheckerPFunc(func(ctx context.Context, cp ThirdPartyCaveatCheckerParams) ([]checkers.Caveat, error) {
 			return p.Checker.CheckThirdPartyCaveat(ctx, cp.Caveat, cp.Request, cp.Token)
@@ -265,9 +291,9 @@ func (h dischargeHandler) Discharge(p httprequest.Params, r *dischargeRequest) (
 		}
 	}
 	m, err := bakery.Discharge(p.Context, bakery.DischargeParams{
-		Id:     id,
-		Caveat: caveat,
-		Key:    h.discharger.p.Key,
+		Id:      id,
+		Caveat:  caveat,
+		KeyRing: h.discharger.p.KeyRing,
 		Checker: bakery.ThirdPartyCaveatCheckerFunc(
 			func(ctx context.Context, cav *bakery.ThirdPartyCaveatInfo) ([]checkers.Caveat, error) {
 				return h.discharger.p.CheckerP.CheckThirdPartyCaveat(ctx, ThirdPartyCaveatCheckerParams{
@@ -278,7 +304,8 @@ func (h dischargeHandler) Discharge(p httprequest.Params, r *dischargeRequest) (
 				})
 			},
 		),
-		Locator: h.discharger.p.Locator,
+		Locator:  h.discharger.p.Locator,
+		Location: h.discharger.p.Location,
 	})
 	if err != nil {
 		return nil, errgo.NoteMask(err, "cannot discharge", errgo.Any)
@@ -311,14 +338,14 @@ type dischargeInfoResponse struct {
 // PublicKey returns the public key of the discharge service.
 func (h dischargeHandler) PublicKey(*publicKeyRequest) (publicKeyResponse, error) {
 	return publicKeyResponse{
-		PublicKey: &h.discharger.p.Key.Public,
+		PublicKey: &h.discharger.p.KeyRing.Current().Public,
 	}, nil
 }
 
 // DischargeInfo returns information on the discharger.
 func (h dischargeHandler) DischargeInfo(*dischargeInfoRequest) (dischargeInfoResponse, error) {
 	return dischargeInfoResponse{
-		PublicKey: &h.discharger.p.Key.Public,
+		PublicKey: &h.discharger.p.KeyRing.Current().Public,
 		Version:   bakery.LatestVersion,
 	}, nil
 }
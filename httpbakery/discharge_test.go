@@ -0,0 +1,128 @@
+package httpbakery_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+)
+
+func TestDischargerKeyRing(t *testing.T) {
+	c := qt.New(t)
+	oldKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	newKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	ring := bakery.NewKeyRing(oldKey)
+
+	mux := http.NewServeMux()
+	d := httpbakery.NewDischarger(httpbakery.DischargerParams{
+		KeyRing: ring,
+		CheckerP: httpbakery.ThirdPartyCaveatCheckerPFunc(func(context.Context, httpbakery.ThirdPartyCaveatCheckerParams) ([]checkers.Caveat, error) {
+			return nil, nil
+		}),
+	})
+	d.AddMuxHandlers(mux, "/")
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	info, err := httpbakery.ThirdPartyInfoForLocation(testContext, nil, ts.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+
+	// Mint a macaroon with a caveat encrypted for the old key.
+	locator := bakery.NewThirdPartyStore()
+	locator.AddInfo(ts.URL, info)
+	b := newBakery("loc", locator, nil)
+	m, err := b.Oven.NewMacaroon(testContext, bakery.LatestVersion, []checkers.Caveat{{
+		Location:  ts.URL,
+		Condition: "something",
+	}}, testOp)
+	c.Assert(err, qt.IsNil)
+
+	ring.Rotate(newKey, time.Now().Add(time.Hour))
+
+	// The discharger advertises the new key...
+	info, err = httpbakery.ThirdPartyInfoForLocation(testContext, nil, ts.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, newKey.Public)
+	resp, err := http.Get(ts.URL + "/publickey")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	var pkResp httpbakery.PublicKeyResponse
+	err = json.NewDecoder(resp.Body).Decode(&pkResp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(*pkResp.PublicKey, qt.Equals, newKey.Public)
+
+	// ... but still discharges caveats encrypted for the old one.
+	ms, err := httpbakery.NewClient().DischargeAll(testContext, m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms, qt.HasLen, 2)
+
+	ring.Remove(oldKey.Public)
+	_, err = httpbakery.NewClient().DischargeAll(testContext, m)
+	c.Assert(err, qt.ErrorMatches, `cannot get discharge from ".*": third party refused discharge: cannot discharge: discharger cannot decode caveat id: public key mismatch`)
+}
+
+func TestDischargerLocation(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range []struct {
+		about       string
+		location    string
+		expectError string
+	}{{
+		about: "matching location",
+	}, {
+		about:       "mismatched location",
+		location:    "https://discharger.example.com",
+		expectError: `cannot get discharge from ".*": third party refused discharge: cannot discharge: caveat addressed to ".*", not "https://discharger.example.com"`,
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			key, err := bakery.GenerateKey()
+			c.Assert(err, qt.IsNil)
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			location := test.location
+			if location == "" {
+				location = ts.URL
+			}
+			d := httpbakery.NewDischarger(httpbakery.DischargerParams{
+				Key:      key,
+				Location: location,
+				CheckerP: httpbakery.ThirdPartyCaveatCheckerPFunc(func(context.Context, httpbakery.ThirdPartyCaveatCheckerParams) ([]checkers.Caveat, error) {
+					return nil, nil
+				}),
+			})
+			d.AddMuxHandlers(mux, "/")
+
+			locator := bakery.NewThirdPartyStore()
+			locator.AddInfo(ts.URL, bakery.ThirdPartyInfo{
+				PublicKey: key.Public,
+				Version:   bakery.LatestVersion,
+			})
+			b := newBakery("loc", locator, nil)
+			m, err := b.Oven.NewMacaroon(testContext, bakery.LatestVersion, []checkers.Caveat{{
+				Location:  ts.URL,
+				Condition: "something",
+			}}, testOp)
+			c.Assert(err, qt.IsNil)
+
+			ms, err := httpbakery.NewClient().DischargeAll(testContext, m)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(ms, qt.HasLen, 2)
+		})
+	}
+}
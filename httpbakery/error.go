@@ -177,7 +177,7 @@ func ErrorToResponse(ctx context.Context, err error) (int, interface{}) {
 		switch errorBody.version {
 		case bakery.Version0:
 			status = http.StatusProxyAuthRequired
-		case bakery.Version1, bakery.Version2, bakery.Version3:
+		case bakery.Version1, bakery.Version2, bakery.Version3, bakery.Version4:
 			status = http.StatusUnauthorized
 			body = httprequest.CustomHeader{
 				Body:          body,
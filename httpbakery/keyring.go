@@ -2,17 +2,94 @@ package httpbakery
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 
 	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 )
 
 var _ bakery.ThirdPartyLocator = (*ThirdPartyLocator)(nil)
 
+// ThirdPartyLocatorParams holds parameters for
+// NewThirdPartyLocatorWithParams.
+type ThirdPartyLocatorParams struct {
+	// Client is used to make HTTP requests to third party
+	// dischargers. If this is nil, http.DefaultClient will be used.
+	Client httprequest.Doer
+
+	// Pinned holds information on third parties that is always
+	// used in preference to information fetched from the
+	// dischargers themselves. Entries in Pinned never expire and
+	// may be for insecure URLs. If this is nil, a new store will be
+	// created; see also ThirdPartyLocator.Pin.
+	//
+	// If TTL is zero, information fetched from dischargers is
+	// added to Pinned.
+	Pinned *bakery.ThirdPartyStore
+
+	// TTL holds how long information fetched from a discharger
+	// will be used before it is fetched again. If this is zero,
+	// the information will be used indefinitely.
+	TTL time.Duration
+
+	// StaleTTL holds how long after TTL has elapsed the
+	// information will still be returned while it is fetched
+	// again in the background. If this is zero, the information
+	// is fetched again when it is next needed after the TTL has
+	// elapsed. If the background fetch fails, another is not
+	// started until NegativeTTL has elapsed, or RefreshTimeout
+	// if NegativeTTL is zero.
+	StaleTTL time.Duration
+
+	// RefreshTimeout holds the maximum length of time that
+	// a background fetch (see StaleTTL) may take. If this
+	// is zero, 30 seconds is used.
+	RefreshTimeout time.Duration
+
+	// NegativeTTL holds how long a failure to fetch information
+	// from a discharger will be remembered. During this time,
+	// requests for information on that discharger will return
+	// the same error without contacting it. If this is zero,
+	// failures are not remembered. Failures caused by the
+	// caller's context being cancelled are never remembered.
+	NegativeTTL time.Duration
+
+	// AllowInsecure holds whether information may be fetched
+	// from non-HTTPS URLs. See also AllowInsecureThirdPartyLocator.
+	AllowInsecure bool
+
+	// Store, if non-nil, is used to record the information
+	// fetched from dischargers. If the information cannot be
+	// recorded, for example because a bakery.FileThirdPartyStore
+	// in trust-on-first-use mode refuses a changed public key,
+	// the fetch fails. If a discharger cannot be contacted,
+	// any information previously recorded in Store is used.
+	Store ThirdPartyInfoStore
+
+	// Clock is used to find the current time. If it is nil,
+	// time.Now will be used.
+	Clock checkers.Clock
+}
+
+// ThirdPartyInfoStore is used by ThirdPartyLocator to record
+// information about third parties. It is implemented by
+// *bakery.FileThirdPartyStore.
+type ThirdPartyInfoStore interface {
+	bakery.ThirdPartyLocator
+
+	// AddInfo associates the given information with
+	// the given location.
+	AddInfo(loc string, info bakery.ThirdPartyInfo) error
+}
+
 // NewThirdPartyLocator returns a new third party
 // locator that uses the given client to find
 // information about third parties and
@@ -21,19 +98,49 @@ var _ bakery.ThirdPartyLocator = (*ThirdPartyLocator)(nil)
 // If cache is nil, a new cache will be created.
 //
 // If client is nil, http.DefaultClient will be used.
+//
+// Information is cached indefinitely; use
+// NewThirdPartyLocatorWithParams for more control
+// over caching.
 func NewThirdPartyLocator(client httprequest.Doer, cache *bakery.ThirdPartyStore) *ThirdPartyLocator {
-	if cache == nil {
-		cache = bakery.NewThirdPartyStore()
+	return NewThirdPartyLocatorWithParams(ThirdPartyLocatorParams{
+		Client: client,
+		Pinned: cache,
+	})
+}
+
+// NewThirdPartyLocatorWithParams returns a new third party locator
+// that caches information about third parties as specified by the
+// given parameters.
+//
+// If p.StaleTTL is non-zero, Close should be called when the
+// locator is no longer needed.
+func NewThirdPartyLocatorWithParams(p ThirdPartyLocatorParams) *ThirdPartyLocator {
+	if p.Pinned == nil {
+		p.Pinned = bakery.NewThirdPartyStore()
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
 	}
-	if client == nil {
-		client = http.DefaultClient
+	if p.Clock == nil {
+		p.Clock = wallClock{}
 	}
+	if p.RefreshTimeout == 0 {
+		p.RefreshTimeout = defaultRefreshTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ThirdPartyLocator{
-		client: client,
-		cache:  cache,
+		p:       p,
+		ctx:     ctx,
+		cancel:  cancel,
+		entries: make(map[string]*thirdPartyEntry),
 	}
 }
 
+// defaultRefreshTimeout holds the default value of
+// ThirdPartyLocatorParams.RefreshTimeout.
+const defaultRefreshTimeout = 30 * time.Second
+
 // AllowInsecureThirdPartyLocator holds whether ThirdPartyLocator allows
 // insecure HTTP connections for fetching third party information.
 // It is provided for testing purposes and should not be used
@@ -42,48 +149,246 @@ var AllowInsecureThirdPartyLocator = false
 
 // ThirdPartyLocator represents locator that can interrogate
 // third party discharge services for information. By default it refuses
-// to use insecure URLs.
+// to use insecure URLs. It is safe to use concurrently.
 type ThirdPartyLocator struct {
-	client        httprequest.Doer
-	allowInsecure bool
-	cache         *bakery.ThirdPartyStore
+	p ThirdPartyLocatorParams
+
+	// ctx is used for background fetches. It is
+	// cancelled by Close.
+	ctx    context.Context
+	cancel func()
+
+	// refreshes is used to wait for background fetches
+	// to finish.
+	refreshes sync.WaitGroup
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// entries holds the information fetched from dischargers,
+	// keyed by canonical location. It is only used when
+	// p.TTL or p.NegativeTTL is non-zero.
+	entries map[string]*thirdPartyEntry
+}
+
+// thirdPartyEntry holds the result of fetching information
+// from a discharger.
+type thirdPartyEntry struct {
+	info bakery.ThirdPartyInfo
+
+	// err holds the error from a failed fetch.
+	err error
+
+	// expires holds when the entry stops being fresh.
+	expires time.Time
+
+	// refreshing holds whether the entry is being
+	// fetched again in the background.
+	refreshing bool
+
+	// retryAfter holds when another background fetch may
+	// be started after one has failed.
+	retryAfter time.Time
 }
 
 // AllowInsecure allows insecure URLs. This can be useful
 // for testing purposes. See also AllowInsecureThirdPartyLocator.
 func (kr *ThirdPartyLocator) AllowInsecure() {
-	kr.allowInsecure = true
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.p.AllowInsecure = true
+}
+
+// Close stops the locator fetching information in the background,
+// cancelling any fetches in progress and waiting for them to
+// finish. The locator can still be used after it has been closed,
+// but stale information will then be fetched again only when it
+// is too stale to be used.
+func (kr *ThirdPartyLocator) Close() {
+	kr.mu.Lock()
+	kr.cancel()
+	kr.mu.Unlock()
+	kr.refreshes.Wait()
+}
+
+// Pin associates the given information with the given location.
+// It will always be used in preference to information fetched
+// from the discharger at that location.
+func (kr *ThirdPartyLocator) Pin(loc string, info bakery.ThirdPartyInfo) {
+	kr.p.Pinned.AddInfo(loc, info)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	delete(kr.entries, canonicalLocation(loc))
 }
 
 // ThirdPartyLocator implements bakery.ThirdPartyLocator
-// by first looking in the backing cache and, if that fails,
-// making an HTTP request to find the information associated
-// with the given discharge location.
+// by first looking in the pinned information and then in the
+// information previously fetched from dischargers. If neither
+// has usable information, it makes an HTTP request to find
+// the information associated with the given discharge location.
 //
 // It refuses to fetch information from non-HTTPS URLs.
 func (kr *ThirdPartyLocator) ThirdPartyInfo(ctx context.Context, loc string) (bakery.ThirdPartyInfo, error) {
 	// If the cache has an entry in, we can use it regardless of URL scheme.
 	// This allows entries for notionally insecure URLs to be added by other means (for
 	// example via a config file).
-	info, err := kr.cache.ThirdPartyInfo(ctx, loc)
+	info, err := kr.p.Pinned.ThirdPartyInfo(ctx, loc)
 	if err == nil {
 		return info, nil
 	}
+	if info, ok, err := kr.cachedInfo(loc); ok {
+		return info, errgo.Mask(err, errgo.Any)
+	}
 	u, err := url.Parse(loc)
 	if err != nil {
 		return bakery.ThirdPartyInfo{}, errgo.Notef(err, "invalid discharge URL %q", loc)
 	}
-	if u.Scheme != "https" && !kr.allowInsecure && !AllowInsecureThirdPartyLocator {
+	kr.mu.Lock()
+	allowInsecure := kr.p.AllowInsecure
+	kr.mu.Unlock()
+	if u.Scheme != "https" && !allowInsecure && !AllowInsecureThirdPartyLocator {
 		return bakery.ThirdPartyInfo{}, errgo.Newf("untrusted discharge URL %q", loc)
 	}
-	info, err = ThirdPartyInfoForLocation(ctx, kr.client, loc)
+	info, err = kr.fetch(ctx, loc)
 	if err != nil {
-		return bakery.ThirdPartyInfo{}, errgo.Mask(err)
+		return bakery.ThirdPartyInfo{}, errgo.Mask(err, errgo.Any)
 	}
-	kr.cache.AddInfo(loc, info)
 	return info, nil
 }
 
+// cachedInfo returns any usable information previously fetched
+// for the given location, starting a background fetch if the
+// information is stale. It reports whether any was found.
+func (kr *ThirdPartyLocator) cachedInfo(loc string) (bakery.ThirdPartyInfo, bool, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	e := kr.entries[canonicalLocation(loc)]
+	if e == nil {
+		return bakery.ThirdPartyInfo{}, false, nil
+	}
+	now := kr.p.Clock.Now()
+	if now.Before(e.expires) {
+		if e.err != nil {
+			return bakery.ThirdPartyInfo{}, true, e.err
+		}
+		return e.info, true, nil
+	}
+	if e.err != nil || !now.Before(e.expires.Add(kr.p.StaleTTL)) {
+		return bakery.ThirdPartyInfo{}, false, nil
+	}
+	if !e.refreshing && !now.Before(e.retryAfter) && kr.ctx.Err() == nil {
+		e.refreshing = true
+		kr.refreshes.Add(1)
+		go kr.refresh(loc, e)
+	}
+	return e.info, true, nil
+}
+
+// refresh fetches the information for the given location
+// in the background, replacing the stale entry e.
+func (kr *ThirdPartyLocator) refresh(loc string, e *thirdPartyEntry) {
+	defer kr.refreshes.Done()
+	ctx, cancel := context.WithTimeout(kr.ctx, kr.p.RefreshTimeout)
+	defer cancel()
+	info, err := kr.fetchInfo(ctx, loc)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if err != nil {
+		// Leave the stale entry in place so that it can
+		// be used until it's too old, at which point the
+		// information will be fetched synchronously, but
+		// don't try again in the background for a while.
+		e.refreshing = false
+		retry := kr.p.NegativeTTL
+		if retry == 0 {
+			retry = kr.p.RefreshTimeout
+		}
+		e.retryAfter = kr.p.Clock.Now().Add(retry)
+		return
+	}
+	if kr.entries[canonicalLocation(loc)] != e {
+		// The entry has been replaced in the meantime.
+		return
+	}
+	kr.entries[canonicalLocation(loc)] = &thirdPartyEntry{
+		info:    info,
+		expires: kr.p.Clock.Now().Add(kr.p.TTL),
+	}
+}
+
+// fetch fetches the information for the given location
+// from its discharger and caches the result.
+func (kr *ThirdPartyLocator) fetch(ctx context.Context, loc string) (bakery.ThirdPartyInfo, error) {
+	info, err := kr.fetchInfo(ctx, loc)
+	if err != nil {
+		// Don't remember failures caused by the caller
+		// giving up, as they say nothing about the
+		// discharger.
+		if kr.p.NegativeTTL > 0 && ctx.Err() == nil {
+			kr.setEntry(loc, &thirdPartyEntry{
+				err:     err,
+				expires: kr.p.Clock.Now().Add(kr.p.NegativeTTL),
+			})
+		}
+		return bakery.ThirdPartyInfo{}, errgo.Mask(err, errgo.Any)
+	}
+	if kr.p.TTL == 0 {
+		kr.p.Pinned.AddInfo(loc, info)
+		kr.setEntry(loc, nil)
+		return info, nil
+	}
+	kr.setEntry(loc, &thirdPartyEntry{
+		info:    info,
+		expires: kr.p.Clock.Now().Add(kr.p.TTL),
+	})
+	return info, nil
+}
+
+// fetchInfo fetches the information for the given location from
+// its discharger and records it in kr.p.Store, if set. If the
+// discharger cannot be contacted, information previously recorded
+// in the store is returned instead.
+func (kr *ThirdPartyLocator) fetchInfo(ctx context.Context, loc string) (bakery.ThirdPartyInfo, error) {
+	info, err := ThirdPartyInfoForLocation(ctx, kr.p.Client, loc)
+	if kr.p.Store == nil {
+		return info, errgo.Mask(err, errgo.Any)
+	}
+	if err != nil {
+		if info, err1 := kr.p.Store.ThirdPartyInfo(ctx, loc); err1 == nil {
+			return info, nil
+		}
+		return bakery.ThirdPartyInfo{}, errgo.Mask(err, errgo.Any)
+	}
+	if err := kr.p.Store.AddInfo(loc, info); err != nil {
+		return bakery.ThirdPartyInfo{}, errgo.NoteMask(err, fmt.Sprintf("cannot record information for %q", loc), errgo.Any)
+	}
+	return info, nil
+}
+
+// setEntry sets the cache entry for the given location,
+// removing it if e is nil.
+func (kr *ThirdPartyLocator) setEntry(loc string, e *thirdPartyEntry) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if e == nil {
+		delete(kr.entries, canonicalLocation(loc))
+		return
+	}
+	kr.entries[canonicalLocation(loc)] = e
+}
+
+// canonicalLocation returns loc without any trailing slash,
+// as used for keys by bakery.ThirdPartyStore.
+func canonicalLocation(loc string) string {
+	return strings.TrimSuffix(loc, "/")
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
 // ThirdPartyInfoForLocation returns information on the third party
 // discharge server running at the given location URL. Note that this is
 // insecure if an http: URL scheme is used. If client is nil,
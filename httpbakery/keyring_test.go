@@ -1,13 +1,16 @@
 package httpbakery_test
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"gopkg.in/errgo.v1"
@@ -215,3 +218,472 @@ type errorTransport struct{}
 func (errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return nil, errgo.New("custom round trip error")
 }
+
+func TestThirdPartyLocatorTTL(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Minute,
+		AllowInsecure: true,
+		Clock:         clock,
+	})
+	oldKey := d.ring.Current()
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	c.Assert(d.count(), qt.Equals, 1)
+
+	// The information is cached until the TTL expires.
+	newKey := d.rotate()
+	clock.advance(59 * time.Second)
+	info, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	c.Assert(d.count(), qt.Equals, 1)
+
+	// After that, it's fetched again.
+	clock.advance(time.Second)
+	info, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, newKey.Public)
+	c.Assert(d.count(), qt.Equals, 2)
+}
+
+func TestThirdPartyLocatorStaleTTL(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Minute,
+		StaleTTL:      time.Hour,
+		AllowInsecure: true,
+		Clock:         clock,
+	})
+	defer kr.Close()
+	oldKey := d.ring.Current()
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+
+	// When the information is stale, it's still returned
+	// while being fetched again in the background.
+	newKey := d.rotate()
+	clock.advance(2 * time.Minute)
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	waitFor(c, func() bool {
+		info, err := kr.ThirdPartyInfo(testContext, d.URL)
+		c.Assert(err, qt.IsNil)
+		return info.PublicKey == newKey.Public
+	})
+	c.Assert(d.count(), qt.Equals, 2)
+
+	// When it's too stale, it's fetched synchronously.
+	newKey = d.rotate()
+	clock.advance(2 * time.Hour)
+	info, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, newKey.Public)
+	c.Assert(d.count(), qt.Equals, 3)
+}
+
+func TestThirdPartyLocatorStaleTTLRefreshFailure(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Minute,
+		StaleTTL:      time.Hour,
+		AllowInsecure: true,
+		Clock:         clock,
+	})
+	defer kr.Close()
+	oldKey := d.ring.Current()
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+
+	// If the background fetch fails, the stale information
+	// continues to be used.
+	d.setFail(true)
+	clock.advance(2 * time.Minute)
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	waitFor(c, func() bool {
+		return d.count() == 2
+	})
+	info, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+
+	// It's an error once it's too stale.
+	clock.advance(2 * time.Hour)
+	_, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.ErrorMatches, `Get .*/discharge/info: cannot unmarshal error response \(status 500 Internal Server Error\): .*`)
+}
+
+func TestThirdPartyLocatorStaleTTLRefreshBackoff(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Minute,
+		StaleTTL:      time.Hour,
+		NegativeTTL:   5 * time.Minute,
+		AllowInsecure: true,
+		Clock:         clock,
+	})
+	defer kr.Close()
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+
+	// After a background fetch fails, another is not
+	// started until the negative TTL has elapsed.
+	d.setFail(true)
+	clock.advance(2 * time.Minute)
+	_, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	for deadline := time.Now().Add(50 * time.Millisecond); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		_, err := kr.ThirdPartyInfo(testContext, d.URL)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(d.count(), qt.Equals, 2)
+
+	d.setFail(false)
+	clock.advance(5 * time.Minute)
+	waitFor(c, func() bool {
+		_, err := kr.ThirdPartyInfo(testContext, d.URL)
+		c.Assert(err, qt.IsNil)
+		return d.count() == 3
+	})
+}
+
+func TestThirdPartyLocatorRefreshTimeout(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:            time.Minute,
+		StaleTTL:       time.Hour,
+		RefreshTimeout: 10 * time.Millisecond,
+		AllowInsecure:  true,
+		Clock:          clock,
+	})
+	defer kr.Close()
+	oldKey := d.ring.Current()
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+
+	// A background fetch that takes too long is abandoned,
+	// leaving the stale information in place, and another
+	// is started when the information is next needed after
+	// the refresh timeout.
+	d.setHang(true)
+	clock.advance(2 * time.Minute)
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	waitFor(c, func() bool {
+		clock.advance(10 * time.Millisecond)
+		info, err := kr.ThirdPartyInfo(testContext, d.URL)
+		c.Assert(err, qt.IsNil)
+		c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+		return d.count() >= 3
+	})
+}
+
+func TestThirdPartyLocatorClose(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Minute,
+		StaleTTL:      time.Hour,
+		AllowInsecure: true,
+		Clock:         clock,
+	})
+	oldKey := d.ring.Current()
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+
+	// Close cancels a background fetch in progress.
+	d.setHang(true)
+	clock.advance(2 * time.Minute)
+	_, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	waitFor(c, func() bool {
+		return d.count() == 2
+	})
+	kr.Close()
+
+	// After that, stale information is still returned
+	// but no more background fetches are started.
+	d.setHang(false)
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(d.count(), qt.Equals, 2)
+}
+
+func TestThirdPartyLocatorNegativeTTL(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Hour,
+		NegativeTTL:   time.Minute,
+		AllowInsecure: true,
+		Clock:         clock,
+	})
+	d.setFail(true)
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.ErrorMatches, `Get .*/discharge/info: cannot unmarshal error response \(status 500 Internal Server Error\): .*`)
+	c.Assert(d.count(), qt.Equals, 1)
+
+	// The failure is remembered until the negative TTL expires.
+	d.setFail(false)
+	_, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.ErrorMatches, `Get .*/discharge/info: cannot unmarshal error response \(status 500 Internal Server Error\): .*`)
+	c.Assert(d.count(), qt.Equals, 1)
+
+	clock.advance(time.Minute)
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, d.ring.Current().Public)
+	c.Assert(d.count(), qt.Equals, 2)
+}
+
+func TestThirdPartyLocatorNegativeTTLIgnoresContextErrors(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Hour,
+		NegativeTTL:   time.Hour,
+		AllowInsecure: true,
+	})
+	ctx, cancel := context.WithCancel(testContext)
+	cancel()
+	_, err := kr.ThirdPartyInfo(ctx, d.URL)
+	c.Assert(err, qt.ErrorMatches, `.*context canceled`)
+
+	// The cancellation was not remembered.
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, d.ring.Current().Public)
+}
+
+func TestThirdPartyLocatorWithoutNegativeTTL(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Hour,
+		AllowInsecure: true,
+	})
+	d.setFail(true)
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.Not(qt.IsNil))
+	d.setFail(false)
+	_, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.count(), qt.Equals, 2)
+}
+
+func TestThirdPartyLocatorPin(t *testing.T) {
+	c := qt.New(t)
+	d := newCountingDischarger(c)
+	defer d.Close()
+	clock := &testClock{t: epoch}
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+		TTL:           time.Minute,
+		AllowInsecure: true,
+		Clock:         clock,
+	})
+	_, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.count(), qt.Equals, 1)
+
+	// Pinned information takes precedence and never expires.
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	pinned := bakery.ThirdPartyInfo{
+		PublicKey: key.Public,
+		Version:   bakery.Version3,
+	}
+	kr.Pin(d.URL+"/", pinned)
+	clock.advance(time.Hour)
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info, qt.DeepEquals, pinned)
+	c.Assert(d.count(), qt.Equals, 1)
+}
+
+func TestThirdPartyLocatorPinInsecure(t *testing.T) {
+	c := qt.New(t)
+	kr := httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{})
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	pinned := bakery.ThirdPartyInfo{
+		PublicKey: key.Public,
+		Version:   bakery.LatestVersion,
+	}
+	kr.Pin("http://0.1.2.3/", pinned)
+	info, err := kr.ThirdPartyInfo(testContext, "http://0.1.2.3")
+	c.Assert(err, qt.IsNil)
+	c.Assert(info, qt.DeepEquals, pinned)
+}
+
+func TestThirdPartyLocatorTrustOnFirstUse(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	d := newCountingDischarger(c)
+	defer d.Close()
+	store, err := bakery.NewFileThirdPartyStore(bakery.FileThirdPartyStoreParams{
+		Path:            filepath.Join(c.Mkdir(), "thirdparty.json"),
+		TrustOnFirstUse: true,
+	})
+	c.Assert(err, qt.IsNil)
+	clock := &testClock{t: epoch}
+	newLocator := func() *httpbakery.ThirdPartyLocator {
+		return httpbakery.NewThirdPartyLocatorWithParams(httpbakery.ThirdPartyLocatorParams{
+			TTL:           time.Minute,
+			Store:         store,
+			AllowInsecure: true,
+			Clock:         clock,
+		})
+	}
+	kr := newLocator()
+
+	// The first key seen is recorded.
+	oldKey := d.ring.Current()
+	info, err := kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	info, err = store.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+
+	// When the discharger can't be contacted, the
+	// recorded key is used.
+	d.setFail(true)
+	info, err = newLocator().ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, oldKey.Public)
+	d.setFail(false)
+
+	// A changed key is refused.
+	d.rotate()
+	clock.advance(time.Minute)
+	_, err = kr.ThirdPartyInfo(testContext, d.URL)
+	c.Assert(err, qt.ErrorMatches, `cannot record information for ".*": public key for ".*" has changed from .* to .*`)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrPublicKeyChanged)
+}
+
+// countingDischarger is a discharger that counts the number of
+// requests made to it and can be made to fail them.
+type countingDischarger struct {
+	*httptest.Server
+	ring *bakery.KeyRing
+
+	mu       sync.Mutex
+	requests int
+	fail     bool
+	hang     bool
+}
+
+func newCountingDischarger(c *qt.C) *countingDischarger {
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	d := &countingDischarger{
+		ring: bakery.NewKeyRing(key),
+	}
+	mux := http.NewServeMux()
+	httpbakery.NewDischarger(httpbakery.DischargerParams{
+		KeyRing: d.ring,
+	}).AddMuxHandlers(mux, "/")
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		d.mu.Lock()
+		d.requests++
+		fail, hang := d.fail, d.hang
+		d.mu.Unlock()
+		if hang {
+			<-req.Context().Done()
+			return
+		}
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	}))
+	return d
+}
+
+func (d *countingDischarger) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.requests
+}
+
+func (d *countingDischarger) setFail(fail bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fail = fail
+}
+
+// setHang sets whether requests hang until
+// they are cancelled by the client.
+func (d *countingDischarger) setHang(hang bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hang = hang
+}
+
+// rotate gives the discharger a new key and returns it.
+func (d *countingDischarger) rotate() *bakery.KeyPair {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	d.ring.Rotate(key, time.Time{})
+	return key
+}
+
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// waitFor waits until f returns true.
+func waitFor(c *qt.C, f func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if f() {
+			return
+		}
+	}
+	c.Fatalf("condition not satisfied in time")
+}